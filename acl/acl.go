@@ -0,0 +1,301 @@
+// Package acl provides topic access control for the mangos relay. Rules grant identities the right
+// to publish or subscribe to topic patterns, identities are established when a client connects,
+// either from the common name of its TLS certificate or by exchanging a token.
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Anonymous is the identity of clients that have not identified themselves
+	Anonymous = "anonymous"
+	// AnyIdentity is the identity key of rules that apply to every identity
+	AnyIdentity = "*"
+)
+
+// Action is the operation that is checked against the rules
+type Action string
+
+const (
+	Publish   Action = "publish"
+	Subscribe Action = "subscribe"
+)
+
+var ErrNoPolicyFile = errors.New("Policy was not loaded from a file")
+
+// TopicRules lists topic patterns that are allowed or denied, `*` matches any sequence of characters
+type TopicRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Permissions are the topic rules of an identity
+type Permissions struct {
+	Publish   TopicRules `json:"publish"`
+	Subscribe TopicRules `json:"subscribe"`
+}
+
+// Rules is the access control configuration, the rules of an identity are checked first, then the
+// rules for AnyIdentity and finally DefaultAllow. Deny patterns win over allow patterns.
+type Rules struct {
+	DefaultAllow bool                   `json:"default_allow"`
+	Tokens       map[string]string      `json:"tokens"`
+	Identities   map[string]Permissions `json:"identities"`
+}
+
+// Allowed returns true if the identity may perform the action on the topic
+func (r *Rules) Allowed(identity string, action Action, topic string) bool {
+	if identity == "" {
+		identity = Anonymous
+	}
+	return r.allowed([]string{identity, AnyIdentity}, action, topic)
+}
+
+// AllowedForAll returns true if every identity may perform the action on the topic, including the
+// identities that have no rules of their own
+func (r *Rules) AllowedForAll(action Action, topic string) bool {
+	if !r.allowed([]string{AnyIdentity}, action, topic) {
+		return false
+	}
+
+	for id := range r.Identities {
+		if id != AnyIdentity && !r.allowed([]string{id, AnyIdentity}, action, topic) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rules) allowed(ids []string, action Action, topic string) bool {
+	for _, id := range ids {
+		perms, found := r.Identities[id]
+		if !found {
+			continue
+		}
+
+		rules := perms.Publish
+		if action == Subscribe {
+			rules = perms.Subscribe
+		}
+
+		if matchAny(rules.Deny, topic) {
+			return false
+		}
+		if matchAny(rules.Allow, topic) {
+			return true
+		}
+	}
+
+	return r.DefaultAllow
+}
+
+// ParseRules decodes JSON encoded rules
+func ParseRules(data []byte) (*Rules, error) {
+	r := &Rules{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("Failed to parse ACL rules: %s", err.Error())
+	}
+
+	return r, nil
+}
+
+// Policy holds the active rules, it is safe for concurrent use and can reload its rules from a file
+type Policy struct {
+	mu      sync.RWMutex
+	rules   *Rules
+	path    string
+	modTime time.Time
+	stop    chan struct{}
+}
+
+// NewPolicy returns a policy with fixed rules
+func NewPolicy(rules *Rules) *Policy {
+	if rules == nil {
+		rules = &Rules{}
+	}
+	return &Policy{rules: rules}
+}
+
+// LoadPolicy reads the rules from a JSON file, call Watch to reload them when the file changes
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Reload reads the rules from the policy file, the current rules are kept if the file is invalid
+func (p *Policy) Reload() error {
+	if p.path == "" {
+		return ErrNoPolicyFile
+	}
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read ACL file: %s", err.Error())
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read ACL file: %s", err.Error())
+	}
+
+	rules, err := ParseRules(data)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.rules = rules
+	p.modTime = info.ModTime()
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Watch polls the policy file and reloads the rules when it changes, errors are passed to onError
+// and the previous rules stay active. Call Stop to end the watch.
+func (p *Policy) Watch(interval time.Duration, onError func(error)) error {
+	if p.path == "" {
+		return ErrNoPolicyFile
+	}
+
+	p.mu.Lock()
+	if p.stop != nil {
+		p.mu.Unlock()
+		return errors.New("Already watching")
+	}
+	stop := make(chan struct{})
+	p.stop = stop
+	p.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := p.reloadIfChanged(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (p *Policy) reloadIfChanged() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read ACL file: %s", err.Error())
+	}
+
+	p.mu.RLock()
+	changed := !info.ModTime().Equal(p.modTime)
+	p.mu.RUnlock()
+
+	if !changed {
+		return nil
+	}
+
+	return p.Reload()
+}
+
+// Stop ends the file watch
+func (p *Policy) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// SetRules replaces the active rules
+func (p *Policy) SetRules(rules *Rules) {
+	p.mu.Lock()
+	p.rules = rules
+	p.mu.Unlock()
+}
+
+// Identify returns the identity for a handshake token
+func (p *Policy) Identify(token string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	identity, found := p.rules.Tokens[token]
+	return identity, found && token != ""
+}
+
+// CanPublish returns true if the identity may publish to the topic
+func (p *Policy) CanPublish(identity, topic string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rules.Allowed(identity, Publish, topic)
+}
+
+// CanSubscribe returns true if the identity may subscribe to the topic filter
+func (p *Policy) CanSubscribe(identity, topic string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rules.Allowed(identity, Subscribe, topic)
+}
+
+// PublicTopic returns true if every identity may subscribe to the topic
+func (p *Policy) PublicTopic(topic string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rules.AllowedForAll(Subscribe, topic)
+}
+
+func matchAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether the topic matches the pattern, `*` matches any sequence of characters
+func Match(pattern, topic string) bool {
+	p, t := 0, 0
+	star, mark := -1, 0
+
+	for t < len(topic) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, t
+			p++
+		case p < len(pattern) && pattern[p] == topic[t]:
+			p++
+			t++
+		case star >= 0:
+			p = star + 1
+			mark++
+			t = mark
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
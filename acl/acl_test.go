@@ -0,0 +1,154 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"tcf.gateway.*", "tcf.gateway.reload", true},
+		{"tcf.gateway.*", "tcf.gateway.", true},
+		{"tcf.gateway.*", "tcf.dashboard.reload", false},
+		{"*", "anything.at.all", true},
+		{"tcf.*.leader", "tcf.cluster.distributed_store.leader", true},
+		{"tcf.*.leader", "tcf.cluster.leader.old", false},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+		{"", "", true},
+	}
+
+	for _, test := range tests {
+		if Match(test.pattern, test.topic) != test.match {
+			t.Fatalf("Match(%q, %q) should be %v", test.pattern, test.topic, test.match)
+		}
+	}
+}
+
+var testRules = []byte(`{
+	"default_allow": false,
+	"tokens": {"secret": "gateway"},
+	"identities": {
+		"gateway": {
+			"publish": {"allow": ["tcf.gateway.*"], "deny": ["tcf.gateway.admin"]},
+			"subscribe": {"allow": ["tcf.*"]}
+		},
+		"*": {
+			"publish": {"deny": ["tcf.cluster.distributed_store.leader"], "allow": ["tcf.shared.*"]},
+			"subscribe": {"allow": ["tcf.shared.*"]}
+		}
+	}
+}`)
+
+func TestRules(t *testing.T) {
+	rules, err := ParseRules(testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPolicy(rules)
+
+	if identity, found := p.Identify("secret"); !found || identity != "gateway" {
+		t.Fatalf("Token not identified: %v %v", identity, found)
+	}
+
+	if _, found := p.Identify(""); found {
+		t.Fatal("Empty token must not identify")
+	}
+
+	checks := []struct {
+		identity string
+		action   Action
+		topic    string
+		allowed  bool
+	}{
+		{"gateway", Publish, "tcf.gateway.reload", true},
+		{"gateway", Publish, "tcf.gateway.admin", false},
+		{"gateway", Publish, "tcf.shared.state", true},
+		{"gateway", Publish, "tcf.cluster.distributed_store.leader", false},
+		{"gateway", Subscribe, "tcf.gateway.", true},
+		{"", Publish, "tcf.shared.state", true},
+		{Anonymous, Publish, "tcf.gateway.reload", false},
+		{Anonymous, Subscribe, "tcf.gateway.", false},
+	}
+
+	for _, c := range checks {
+		if rules.Allowed(c.identity, c.action, c.topic) != c.allowed {
+			t.Fatalf("%q %v %q should be allowed=%v", c.identity, c.action, c.topic, c.allowed)
+		}
+	}
+
+	if !p.PublicTopic("tcf.shared.state") {
+		t.Fatal("Topic every identity may subscribe to should be public")
+	}
+	if p.PublicTopic("tcf.gateway.reload") {
+		t.Fatal("Topic only the gateway may subscribe to should not be public")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcf-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acl.json")
+	if err = ioutil.WriteFile(path, []byte(`{"default_allow": false}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.CanPublish("gateway", "tcf.test") {
+		t.Fatal("Publish should be denied by default")
+	}
+
+	errs := make(chan error, 10)
+	if err = p.Watch(10*time.Millisecond, func(err error) { errs <- err }); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// Invalid files keep the current rules
+	writeWithNewModTime(t, path, []byte(`{not json`))
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("Invalid rules should be reported")
+	}
+
+	writeWithNewModTime(t, path, []byte(`{"default_allow": true}`))
+	deadline := time.Now().Add(time.Second)
+	for !p.CanPublish("gateway", "tcf.test") {
+		if time.Now().After(deadline) {
+			t.Fatal("Rules were not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeWithNewModTime(t *testing.T, path string, data []byte) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// File systems with a coarse mtime resolution would not see the change otherwise
+	modTime := info.ModTime().Add(time.Second)
+	if err = os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -12,8 +12,11 @@ import (
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/transport/tcp"
 	"github.com/satori/go.uuid"
-	"github.com/TykTechnologies/tykcommon-logger"
 	"github.com/TykTechnologies/tyk-cluster-framework/client"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+	"github.com/TykTechnologies/tyk-cluster-framework/pool"
+	"sync"
+	"time"
 )
 
 type Bus struct{
@@ -24,23 +27,37 @@ type Bus struct{
 	enc encoding.Encoding
 	id string
 	rawMode bool
+	handlerMu sync.RWMutex
 	payloadHandlers map[string]client.PayloadHandler
+	pools map[string]*pool.WorkerPool
 	onRawMessage func([]byte) error
+	rawPool *pool.WorkerPool
+	frameHandlers map[string]FrameHandler
+	framePools map[string]*pool.WorkerPool
 	stopChan chan struct{}
+	gossip *gossip
+	peers peerTable
+	nodes nodeTable
+	relay *relay
 }
 
-var log = logger.GetLogger()
 
 func NewBus(conn_str, me string, rawMode bool, enc encoding.Encoding) (*Bus, error) {
-	return &Bus{
+	b := &Bus{
 		conn_str: conn_str,
 		me: me,
 		enc: enc,
 		rawMode: rawMode,
 		id: uuid.NewV4().String(),
 		payloadHandlers: make(map[string]client.PayloadHandler),
+		pools: make(map[string]*pool.WorkerPool),
+		frameHandlers: make(map[string]FrameHandler),
+		framePools: make(map[string]*pool.WorkerPool),
 		stopChan: make(chan struct{}),
-	}, nil
+	}
+	b.SetTransport("bus")
+
+	return b, nil
 }
 
 func (b *Bus) Connect() error {
@@ -50,20 +67,17 @@ func (b *Bus) Connect() error {
 	}
 
 	hosts := strings.Split(fragment[1], ",")
+	if b.gossip != nil {
+		return b.connectGossip(hosts)
+	}
+
 	if len(hosts) < 2 {
 		return errors.New("Connection string must have at least two or more hosts")
 	}
 
-	var err error
 	for _, h := range hosts {
-		if h == b.me || h == "" {
-			continue
-		}
-
-		fixedHost := fmt.Sprintf("tcp://%v", h)
-
-		if err = b.sock.Dial(fixedHost); err != nil {
-			return fmt.Errorf("socket.Dial: %s", err.Error())
+		if err := b.AddPeer(h); err != nil {
+			return err
 		}
 	}
 
@@ -74,20 +88,80 @@ func (b *Bus) GetID() string {
 	return b.id
 }
 
+// Subscribe attaches a handler to a topic, using the default subscribe options of the client package
 func (b *Bus) Subscribe(topic string, handler client.PayloadHandler) {
+	b.SubscribeWithOptions(topic, handler, client.DefaultSubscribeOptions())
+}
+
+// SubscribeWithOptions attaches a handler to a topic that is run on a worker pool configured by the options
+func (b *Bus) SubscribeWithOptions(topic string, handler client.PayloadHandler, opts client.SubscribeOptions) {
+	workers := pool.New(b.withErrorLogging(topic, opts.Workers))
+
+	b.handlerMu.Lock()
+	existing, found := b.pools[topic]
 	b.payloadHandlers[topic] = handler
+	b.pools[topic] = workers
+	b.handlerMu.Unlock()
+
+	if found {
+		existing.Stop()
+	}
 }
 
+// SetOnRawMsg sets the handler for raw mode messages that are not frames of a subscribed topic, it is run
+// in order on a single worker
 func (b *Bus) SetOnRawMsg(handler func([]byte) error) {
+	b.SetOnRawMsgWithOptions(handler, pool.Options{Ordered: true})
+}
+
+// SetOnRawMsgWithOptions sets the handler for raw mode messages, run on a worker pool configured by the options
+func (b *Bus) SetOnRawMsgWithOptions(handler func([]byte) error, opts pool.Options) {
+	b.handlerMu.Lock()
+	existing := b.rawPool
 	b.onRawMessage = handler
+	b.rawPool = pool.New(b.withErrorLogging("raw", opts))
+	b.handlerMu.Unlock()
+
+	if existing != nil {
+		existing.Stop()
+	}
+}
+
+func (b *Bus) withErrorLogging(topic string, opts pool.Options) pool.Options {
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {
+			b.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.bus",
+				"topic":  topic,
+			}).Error("Handler error: ", err)
+		}
+	}
+
+	return opts
 }
 
 func (b *Bus) handleRawPayload(msg []byte) error {
-	if b.onRawMessage != nil {
-		return b.onRawMessage(msg)
+	if f, err := DecodeFrame(msg); err == nil {
+		if handled, err := b.handleFrame(f); handled {
+			return err
+		}
 	}
 
-	return nil
+	b.handlerMu.RLock()
+	handler, workers := b.onRawMessage, b.rawPool
+	b.handlerMu.RUnlock()
+
+	if handler == nil {
+		return nil
+	}
+
+	return workers.Submit(func() {
+		if err := handler(msg); err != nil {
+			b.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.bus",
+			}).Error("Raw message handler failed: ", err)
+		}
+	})
 }
 
 func (b *Bus) handlePayload(msg []byte) error {
@@ -100,30 +174,65 @@ func (b *Bus) handlePayload(msg []byte) error {
 		return err
 	}
 
-	handler, found := b.payloadHandlers[pl.GetTopic()]
-	if found {
-		handler(pl)
+	if b.relay != nil && !b.relayPayload(pl) {
+		return nil
 	}
 
-	return nil
+	if b.gossip != nil && pl.GetTopic() == GossipTopic {
+		return b.handleGossip(pl)
+	}
+
+	b.nodes.heard(pl.From(), time.Now())
+	return b.dispatchPayload(pl)
+}
+
+// dispatchPayload queues a decoded payload on the worker pool of its topic
+func (b *Bus) dispatchPayload(pl payloads.Payload) error {
+	topic, forUs := b.handlerTopic(pl.GetTopic())
+	if !forUs {
+		return nil
+	}
+
+	labels := []metrics.Label{metrics.Transport(b.Transport()), metrics.Topic(topic)}
+	metrics.IncrCounter(metrics.KeyReceived, 1, labels...)
+
+	b.handlerMu.RLock()
+	handler, found := b.payloadHandlers[topic]
+	workers := b.pools[topic]
+	b.handlerMu.RUnlock()
+
+	if !found {
+		return nil
+	}
+
+	return workers.Submit(func() {
+		start := time.Now()
+		b.HandlePayload(pl, handler)
+		metrics.MeasureSince(metrics.KeyHandlerLatency, start, labels...)
+	})
 }
 
 func (b *Bus) Listen() error {
 	var err error
 	var msg []byte
 
-	if b.sock, err = bus.NewSocket(); err != nil {
+	sock, err := bus.NewSocket()
+	if err != nil {
 		return fmt.Errorf("bus.NewSocket: %s", err)
 	}
 
-	b.sock.AddTransport(tcp.NewTransport())
+	sock.AddTransport(tcp.NewTransport())
+	sock.SetPortHook(b.peerPortHook)
 	listenOn := fmt.Sprintf("tcp://%s", b.me)
-	if err = b.sock.Listen(listenOn); err != nil {
+	if err = sock.Listen(listenOn); err != nil {
 		return fmt.Errorf("sock.Listen: %s", err.Error())
 	}
 
+	// Peers added before now are dialed once the socket exists
+	b.setSocket(sock)
+
 	for {
-		if msg, err = b.sock.Recv(); err != nil {
+		if msg, err = sock.Recv(); err != nil {
 			return fmt.Errorf("sock.Recv: %s", err.Error())
 		}
 
@@ -135,17 +244,40 @@ func (b *Bus) Listen() error {
 		}
 
 
-		// TODO: might want this as a pool
-		go b.handlePayload(msg)
+		// Decoding happens here, handlers run on the worker pool of their subscription
+		if err = b.handlePayload(msg); err != nil {
+			b.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.bus",
+			}).Error("Failed to handle message: ", err)
+		}
 	}
 }
 
 func (b *Bus) Stop() error {
+	b.stopGossip()
 	b.stopChan <- struct{}{}
+
+	b.handlerMu.Lock()
+	for _, p := range b.pools {
+		p.Stop()
+	}
+	for _, p := range b.framePools {
+		p.Stop()
+	}
+	if b.rawPool != nil {
+		b.rawPool.Stop()
+	}
+	b.handlerMu.Unlock()
+
 	return b.sock.Close()
 }
 
+// Send will send a payload to all connected peers, passing through the outbound middleware
 func (b *Bus) Send(topic string, payload payloads.Payload) error {
+	return b.WrapOutbound(b.send)(topic, payload)
+}
+
+func (b *Bus) send(topic string, payload payloads.Payload) error {
 	if payload == nil {
 		return nil
 	}
@@ -154,7 +286,13 @@ func (b *Bus) Send(topic string, payload payloads.Payload) error {
 	if payload.From() == "" {
 		payload.SetFrom(b.GetID())
 	}
+	b.stampRelay(payload)
+
+	return b.write(payload)
+}
 
+// write encodes a payload and sends it to all connected peers
+func (b *Bus) write(payload payloads.Payload) error {
 	data, encErr := payloads.Marshal(payload, b.enc)
 	if encErr != nil {
 		return encErr
@@ -173,7 +311,7 @@ func (b *Bus) Send(topic string, payload payloads.Payload) error {
 	}
 
 	if len(encodedPayload) == 0 {
-		log.WithFields(logrus.Fields{
+		b.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.MangosClient",
 		}).Error("No data to send, not sending")
 		return nil
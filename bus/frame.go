@@ -0,0 +1,168 @@
+package bus
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+	"github.com/TykTechnologies/tyk-cluster-framework/pool"
+)
+
+var (
+	ErrInvalidFrame = errors.New("Invalid frame")
+	ErrFrameTooLong = errors.New("Frame topic or sender too long")
+	ErrNotRawMode   = errors.New("Frames can only be sent in raw mode")
+)
+
+// frameMagic starts every frame so framed messages can be told from other raw messages, the last byte
+// is the version of the layout
+var frameMagic = []byte{'t', 'c', 'f', 1}
+
+// frameHeaderLen is the magic, the type and the three length fields
+const frameHeaderLen = 4 + 1 + 2 + 2 + 4
+
+// Frame is a raw mode message with routing information, it is sent as
+// `magic | type | topic length | topic | sender length | sender | body length | body` with big endian
+// lengths, so the body is never encoded again.
+type Frame struct {
+	Topic string
+	From  string
+	Type  byte
+	Body  []byte
+}
+
+// FrameHandler handles the frames of a topic
+type FrameHandler func(Frame) error
+
+// EncodeFrame returns the wire format of a frame
+func EncodeFrame(f Frame) ([]byte, error) {
+	if len(f.Topic) > math.MaxUint16 || len(f.From) > math.MaxUint16 {
+		return nil, ErrFrameTooLong
+	}
+
+	buf := make([]byte, 0, frameHeaderLen+len(f.Topic)+len(f.From)+len(f.Body))
+	buf = append(buf, frameMagic...)
+	buf = append(buf, f.Type)
+	buf = appendUint16(buf, len(f.Topic))
+	buf = append(buf, f.Topic...)
+	buf = appendUint16(buf, len(f.From))
+	buf = append(buf, f.From...)
+
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(f.Body)))
+	buf = append(buf, l[:]...)
+	return append(buf, f.Body...), nil
+}
+
+func appendUint16(buf []byte, v int) []byte {
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(v))
+	return append(buf, l[:]...)
+}
+
+// DecodeFrame parses a frame, ErrInvalidFrame is returned if the message is not a complete frame. The
+// body of the frame shares the memory of the message.
+func DecodeFrame(msg []byte) (Frame, error) {
+	var f Frame
+	if len(msg) < frameHeaderLen || string(msg[:len(frameMagic)]) != string(frameMagic) {
+		return f, ErrInvalidFrame
+	}
+
+	rest := msg[len(frameMagic):]
+	f.Type = rest[0]
+	rest = rest[1:]
+
+	var topic, from []byte
+	var ok bool
+	if topic, rest, ok = readUint16Prefixed(rest); !ok {
+		return f, ErrInvalidFrame
+	}
+	if from, rest, ok = readUint16Prefixed(rest); !ok {
+		return f, ErrInvalidFrame
+	}
+
+	if len(rest) < 4 || uint64(binary.BigEndian.Uint32(rest)) != uint64(len(rest)-4) {
+		return f, ErrInvalidFrame
+	}
+
+	f.Topic, f.From, f.Body = string(topic), string(from), rest[4:]
+	return f, nil
+}
+
+func readUint16Prefixed(buf []byte) (value, rest []byte, ok bool) {
+	if len(buf) < 2 {
+		return nil, nil, false
+	}
+
+	l := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+l {
+		return nil, nil, false
+	}
+	return buf[2 : 2+l], buf[2+l:], true
+}
+
+// SendFrame sends a framed raw message to all connected peers, it is only supported in raw mode
+func (b *Bus) SendFrame(topic string, msgType byte, body []byte) error {
+	if !b.rawMode {
+		return ErrNotRawMode
+	}
+
+	msg, err := EncodeFrame(Frame{Topic: topic, From: b.id, Type: msgType, Body: body})
+	if err != nil {
+		return err
+	}
+
+	return b.SendRaw(msg)
+}
+
+// SubscribeRaw attaches a handler to the frames of a topic, it is run in order on a single worker.
+// Unframed raw messages and frames of topics without a handler go to the raw message handler.
+func (b *Bus) SubscribeRaw(topic string, handler FrameHandler) {
+	b.SubscribeRawWithOptions(topic, handler, pool.Options{Ordered: true})
+}
+
+// SubscribeRawWithOptions attaches a handler to the frames of a topic that is run on a worker pool
+// configured by the options
+func (b *Bus) SubscribeRawWithOptions(topic string, handler FrameHandler, opts pool.Options) {
+	workers := pool.New(b.withErrorLogging(topic, opts))
+
+	b.handlerMu.Lock()
+	existing, found := b.framePools[topic]
+	b.frameHandlers[topic] = handler
+	b.framePools[topic] = workers
+	b.handlerMu.Unlock()
+
+	if found {
+		existing.Stop()
+	}
+}
+
+// handleFrame queues a frame on the worker pool of its topic, it returns false if the topic has no
+// handler
+func (b *Bus) handleFrame(f Frame) (bool, error) {
+	b.handlerMu.RLock()
+	handler, found := b.frameHandlers[f.Topic]
+	workers := b.framePools[f.Topic]
+	b.handlerMu.RUnlock()
+
+	if !found {
+		return false, nil
+	}
+
+	labels := []metrics.Label{metrics.Transport(b.Transport()), metrics.Topic(f.Topic)}
+	metrics.IncrCounter(metrics.KeyReceived, 1, labels...)
+
+	return true, workers.Submit(func() {
+		start := time.Now()
+		if err := handler(f); err != nil {
+			b.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.bus",
+				"topic":  f.Topic,
+			}).Error("Frame handler failed: ", err)
+		}
+		metrics.MeasureSince(metrics.KeyHandlerLatency, start, labels...)
+	})
+}
@@ -0,0 +1,94 @@
+package bus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+)
+
+func TestFrame(t *testing.T) {
+	f := Frame{Topic: "tcf.test.frame", From: "node-1", Type: 7, Body: []byte("body")}
+	msg, err := EncodeFrame(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeFrame(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Topic != f.Topic || decoded.From != f.From || decoded.Type != f.Type || !bytes.Equal(decoded.Body, f.Body) {
+		t.Fatalf("Unexpected frame: %+v", decoded)
+	}
+
+	// Truncated, padded and unframed messages are rejected
+	for _, invalid := range [][]byte{msg[:len(msg)-1], append(msg, 0), []byte("{\"Topic\": \"json\"}"), nil} {
+		if _, err = DecodeFrame(invalid); err != ErrInvalidFrame {
+			t.Fatalf("Expected ErrInvalidFrame for %q, got: %v", invalid, err)
+		}
+	}
+
+	if _, err = EncodeFrame(Frame{Topic: string(make([]byte, 1<<16))}); err != ErrFrameTooLong {
+		t.Fatalf("Expected ErrFrameTooLong, got: %v", err)
+	}
+}
+
+func TestSubscribeRaw(t *testing.T) {
+	b, err := NewBus("tcp://a:9000,b:9000", "a:9000", true, encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLogger(logging.Discard())
+
+	sock := &testSocket{}
+	b.sock = sock
+
+	frames := make(chan Frame, 1)
+	b.SubscribeRaw("tcf.test.frame", func(f Frame) error {
+		frames <- f
+		return nil
+	})
+
+	raw := make(chan []byte, 2)
+	b.SetOnRawMsg(func(msg []byte) error {
+		raw <- msg
+		return nil
+	})
+
+	if err = b.SendFrame("tcf.test.frame", 1, []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := EncodeFrame(Frame{Topic: "tcf.test.other", Body: []byte("other")})
+
+	for _, msg := range [][]byte{sock.sent[0], other, []byte("unframed")} {
+		if err = b.handlePayload(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case f := <-frames:
+		if f.From != b.GetID() || f.Type != 1 || string(f.Body) != "body" {
+			t.Fatalf("Unexpected frame: %+v", f)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Frame not handled")
+	}
+
+	// Frames without a topic handler and unframed messages go to the raw handler
+	for i := 0; i < 2; i++ {
+		select {
+		case <-raw:
+		case <-time.After(time.Second):
+			t.Fatal("Raw message not handled")
+		}
+	}
+
+	notRaw, _ := NewBus("tcp://a:9000,b:9000", "a:9000", false, encoding.JSON)
+	if err = notRaw.SendFrame("tcf.test.frame", 1, nil); err != ErrNotRawMode {
+		t.Fatalf("Expected ErrNotRawMode, got: %v", err)
+	}
+}
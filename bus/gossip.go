@@ -0,0 +1,440 @@
+package bus
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// GossipTopic is the topic bus members exchange their membership tables on
+const GossipTopic = "tcf.bus.gossip"
+
+var ErrGossipRawMode = errors.New("Gossip is not supported in raw mode")
+
+// MemberState is the health of a bus member, a higher state overrides a lower one of the same incarnation
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+// Member is a node of the bus as known through gossip. Incarnation is raised by the member itself to
+// refute a suspicion or a false death.
+type Member struct {
+	ID          string
+	Addr        string
+	Incarnation uint64
+	State       MemberState
+}
+
+// MemberHook is called when the state of a member changes
+type MemberHook func(Member)
+
+// GossipOptions configures how often members gossip and how quickly silent members are dropped
+type GossipOptions struct {
+	// Interval is the time between gossip rounds, it defaults to one second
+	Interval time.Duration
+	// SuspectAfter defaults to five intervals, DeadAfter to fifteen
+	SuspectAfter time.Duration
+	DeadAfter    time.Duration
+	// ForgetAfter is how long dead members are remembered so old gossip does not revive them, it
+	// defaults to DeadAfter
+	ForgetAfter time.Duration
+}
+
+// gossipMessage is the membership table of the sender, the sender is included
+type gossipMessage struct {
+	From    string
+	Members []Member
+}
+
+type memberEntry struct {
+	Member
+	// lastHeard is when the member last gossiped to us directly, or when we first heard of it
+	lastHeard time.Time
+	// diedAt is when the member was declared dead
+	diedAt time.Time
+}
+
+// gossip is the membership table of a bus, the members are dialed as peers
+type gossip struct {
+	opts GossipOptions
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*memberEntry
+	// seeds are the hosts of the connection string, they are dialed until they dial us
+	seeds    map[string]bool
+	onChange MemberHook
+	stopChan chan struct{}
+}
+
+// peerChanges are the peers to add and remove after a change to the membership table, they are applied
+// once the gossip lock is released
+type peerChanges struct {
+	add    []string
+	remove []string
+}
+
+// EnableGossip makes the bus discover its members through gossip, the connection string then only needs
+// one seed host. Members dial the members they learn about, and members that stop gossiping are suspected
+// and then dropped. It must be called before Connect() and is not supported in raw mode.
+//
+// This is heartbeat gossip, not SWIM: every interval each member sends its whole membership table to all
+// of its peers, and failures are only detected by members falling silent. There is no indirect probing,
+// so the traffic grows with the square of the cluster size and it suits clusters of tens of members.
+func (b *Bus) EnableGossip(opts GossipOptions) error {
+	if b.rawMode {
+		return ErrGossipRawMode
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.SuspectAfter <= 0 {
+		opts.SuspectAfter = 5 * opts.Interval
+	}
+	if opts.DeadAfter <= opts.SuspectAfter {
+		opts.DeadAfter = opts.SuspectAfter + 10*opts.Interval
+	}
+	if opts.ForgetAfter <= 0 {
+		opts.ForgetAfter = opts.DeadAfter
+	}
+
+	b.gossip = &gossip{
+		opts:    opts,
+		members: make(map[string]*memberEntry),
+	}
+	return nil
+}
+
+// SetOnMemberChange sets a hook that is called when a member joins or changes state
+func (b *Bus) SetOnMemberChange(hook MemberHook) {
+	if b.gossip == nil {
+		return
+	}
+
+	b.gossip.mu.Lock()
+	b.gossip.onChange = hook
+	b.gossip.mu.Unlock()
+}
+
+// Members returns the members that are not dead, ordered by address. The bus itself is included.
+func (b *Bus) Members() []Member {
+	if b.gossip == nil {
+		return nil
+	}
+
+	b.gossip.mu.Lock()
+	defer b.gossip.mu.Unlock()
+
+	members := []Member{b.self()}
+	for _, m := range b.gossip.members {
+		if m.State != MemberDead {
+			members = append(members, m.Member)
+		}
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Addr < members[j].Addr
+	})
+	return members
+}
+
+// self returns the bus as a member, it must be called with the gossip lock held
+func (b *Bus) self() Member {
+	return Member{ID: b.id, Addr: normalizeAddr(b.me), Incarnation: b.gossip.incarnation, State: MemberAlive}
+}
+
+// normalizeAddr returns the form of a member address that gossip compares, so members that write the
+// same address differently agree on it
+func normalizeAddr(addr string) string {
+	addr = strings.TrimSpace(addr)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// connectGossip dials the seeds and starts gossiping
+func (b *Bus) connectGossip(hosts []string) error {
+	me := normalizeAddr(b.me)
+	seeds := make(map[string]bool)
+	for _, h := range hosts {
+		if h = normalizeAddr(h); h != me {
+			seeds[h] = true
+		}
+	}
+
+	for h := range seeds {
+		if err := b.AddPeer(h); err != nil {
+			return err
+		}
+	}
+
+	b.gossip.mu.Lock()
+	b.gossip.seeds = seeds
+	b.gossip.stopChan = make(chan struct{})
+	stop := b.gossip.stopChan
+	b.gossip.mu.Unlock()
+
+	go b.gossipLoop(stop)
+	return nil
+}
+
+func (b *Bus) stopGossip() {
+	if b.gossip == nil {
+		return
+	}
+
+	b.gossip.mu.Lock()
+	defer b.gossip.mu.Unlock()
+
+	if b.gossip.stopChan != nil {
+		close(b.gossip.stopChan)
+		b.gossip.stopChan = nil
+	}
+}
+
+// applyPeerChanges dials new members and drops dead ones
+func (b *Bus) applyPeerChanges(changes peerChanges) {
+	for _, addr := range changes.add {
+		if err := b.AddPeer(addr); err != nil {
+			b.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.bus",
+				"member": addr,
+			}).Error("Failed to dial member: ", err)
+		}
+	}
+
+	for _, addr := range changes.remove {
+		// Members we did not dial are not peers
+		b.RemovePeer(addr)
+	}
+}
+
+// shouldDial decides which side of a pair of members dials, so they are connected once. Seeds are dialed
+// by the member that joins until they know it, then the pair follows the same rule.
+func (b *Bus) shouldDial(addr string) bool {
+	return normalizeAddr(addr) > normalizeAddr(b.me)
+}
+
+func (b *Bus) gossipLoop(stop chan struct{}) {
+	ticker := time.NewTicker(b.gossip.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			b.detectFailures(now)
+			if err := b.sendGossip(); err != nil {
+				b.Log().WithFields(logrus.Fields{
+					"prefix": "tcf.bus",
+				}).Error("Failed to gossip: ", err)
+			}
+		}
+	}
+}
+
+// sendGossip sends the membership table to every peer, it is the heartbeat of the member
+func (b *Bus) sendGossip() error {
+	b.gossip.mu.Lock()
+	msg := gossipMessage{From: b.me, Members: []Member{b.self()}}
+	for _, m := range b.gossip.members {
+		msg.Members = append(msg.Members, m.Member)
+	}
+	b.gossip.mu.Unlock()
+
+	p, err := payloads.NewPayload(msg)
+	if err != nil {
+		return err
+	}
+
+	// Gossip is internal, it bypasses the outbound middleware
+	return b.send(GossipTopic, p)
+}
+
+// handleGossip merges the membership table of another member into ours
+func (b *Bus) handleGossip(payload payloads.Payload) error {
+	var msg gossipMessage
+	if err := payload.DecodeMessage(&msg); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var changed []Member
+	var changes peerChanges
+
+	me := normalizeAddr(b.me)
+	msg.From = normalizeAddr(msg.From)
+
+	knowsUs := false
+	b.gossip.mu.Lock()
+	for _, update := range msg.Members {
+		update.Addr = normalizeAddr(update.Addr)
+		if update.Addr == me {
+			knowsUs = update.State != MemberDead
+			// Refute rumours of our failure by outliving them
+			if update.State != MemberAlive && update.Incarnation >= b.gossip.incarnation {
+				b.gossip.incarnation = update.Incarnation + 1
+			}
+			continue
+		}
+
+		if b.mergeMember(update, now, &changes) {
+			changed = append(changed, b.gossip.members[update.Addr].Member)
+		}
+	}
+
+	if sender, found := b.gossip.members[msg.From]; found && sender.State != MemberDead {
+		sender.lastHeard = now
+	}
+
+	// A seed that knows us dials us itself if it is its side of the pair
+	if knowsUs && b.gossip.seeds[msg.From] && !b.shouldDial(msg.From) {
+		changes.remove = append(changes.remove, msg.From)
+	}
+	hook := b.gossip.onChange
+	b.gossip.mu.Unlock()
+
+	b.applyPeerChanges(changes)
+	for _, m := range changed {
+		b.memberEvent(hook, m)
+	}
+	return nil
+}
+
+// mergeMember applies a gossiped member to the table and returns true if it changed, it must be called with
+// the gossip lock held
+func (b *Bus) mergeMember(update Member, now time.Time, changes *peerChanges) bool {
+	local, found := b.gossip.members[update.Addr]
+	if !found {
+		if update.State == MemberDead {
+			return false
+		}
+
+		b.gossip.members[update.Addr] = &memberEntry{Member: update, lastHeard: now}
+		b.connectMember(update.Addr, changes)
+		return true
+	}
+
+	newer := update.Incarnation > local.Incarnation ||
+		(update.Incarnation == local.Incarnation && update.State > local.State)
+	if !newer {
+		return false
+	}
+
+	wasDead := local.State == MemberDead
+	local.Member = update
+
+	switch {
+	case update.State == MemberDead && !wasDead:
+		local.diedAt = now
+		b.disconnectMember(update.Addr, changes)
+	case update.State != MemberDead && wasDead:
+		// The member restarted
+		local.lastHeard = now
+		b.connectMember(update.Addr, changes)
+	}
+	return true
+}
+
+// connectMember dials a member if it is our side of the pair to dial
+func (b *Bus) connectMember(addr string, changes *peerChanges) {
+	if b.shouldDial(addr) {
+		changes.add = append(changes.add, addr)
+	}
+}
+
+// disconnectMember drops a dead member. Seeds are dialed again instead, so they find us when they restart.
+func (b *Bus) disconnectMember(addr string, changes *peerChanges) {
+	if b.gossip.seeds[addr] {
+		changes.add = append(changes.add, addr)
+		return
+	}
+	changes.remove = append(changes.remove, addr)
+}
+
+// detectFailures suspects members that have not gossiped to us, declares them dead after a while and
+// eventually forgets them
+func (b *Bus) detectFailures(now time.Time) {
+	var changed []Member
+	var changes peerChanges
+
+	b.gossip.mu.Lock()
+	for addr, m := range b.gossip.members {
+		silent := now.Sub(m.lastHeard)
+		switch {
+		case m.State == MemberDead:
+			if now.Sub(m.diedAt) > b.gossip.opts.ForgetAfter {
+				delete(b.gossip.members, addr)
+			}
+		case silent > b.gossip.opts.DeadAfter:
+			m.State = MemberDead
+			m.diedAt = now
+			b.disconnectMember(addr, &changes)
+			changed = append(changed, m.Member)
+		case silent > b.gossip.opts.SuspectAfter && m.State == MemberAlive:
+			m.State = MemberSuspect
+			changed = append(changed, m.Member)
+		}
+	}
+	hook := b.gossip.onChange
+	b.gossip.mu.Unlock()
+
+	b.applyPeerChanges(changes)
+	for _, m := range changed {
+		b.memberEvent(hook, m)
+	}
+}
+
+func (b *Bus) memberEvent(hook MemberHook, m Member) {
+	b.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.bus",
+		"member": m.Addr,
+	}).Info("Member is ", m.State)
+
+	if hook == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			b.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.bus",
+			}).Error("Member hook panicked: ", r)
+		}
+	}()
+
+	hook(m)
+}
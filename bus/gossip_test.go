@@ -0,0 +1,179 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+func TestGossipMembership(t *testing.T) {
+	// Members sort below the bus address, so the test bus never has to dial
+	b, err := NewBus("tcp://z:9000", "z:9000", false, encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLogger(logging.Discard())
+
+	if err = b.EnableGossip(GossipOptions{Interval: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Member
+	b.SetOnMemberChange(func(m Member) {
+		events = append(events, m)
+	})
+
+	gossipFrom := func(from string, members ...Member) {
+		p, err := payloads.NewPayload(gossipMessage{From: from, Members: members})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.handleGossip(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One seed is enough to learn about everyone it knows
+	gossipFrom("a:9000",
+		Member{ID: "a", Addr: "a:9000"},
+		Member{ID: "b", Addr: "b:9000"},
+		Member{ID: "c", Addr: "c:9000", State: MemberDead},
+	)
+
+	members := b.Members()
+	if len(members) != 3 || members[0].Addr != "a:9000" || members[1].Addr != "b:9000" || members[2].Addr != "z:9000" {
+		t.Fatalf("Unexpected members: %v", members)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 join events, got: %v", events)
+	}
+
+	// Suspicion of the same incarnation wins, an older incarnation does not
+	gossipFrom("a:9000", Member{ID: "b", Addr: "b:9000", State: MemberSuspect})
+	gossipFrom("a:9000", Member{ID: "b", Addr: "b:9000", State: MemberAlive})
+	if m := b.gossip.members["b:9000"]; m.State != MemberSuspect {
+		t.Fatalf("Expected b to be suspect, got: %v", m.State)
+	}
+
+	// b refutes with a new incarnation
+	gossipFrom("b:9000", Member{ID: "b", Addr: "b:9000", Incarnation: 1})
+	if m := b.gossip.members["b:9000"]; m.State != MemberAlive || m.Incarnation != 1 {
+		t.Fatalf("Expected b to be alive again, got: %+v", m.Member)
+	}
+
+	// We refute rumours about ourselves
+	gossipFrom("a:9000", Member{ID: b.GetID(), Addr: "z:9000", Incarnation: 0, State: MemberSuspect})
+	if b.gossip.incarnation != 1 {
+		t.Fatalf("Expected our incarnation to be raised, got: %v", b.gossip.incarnation)
+	}
+
+	// a keeps gossiping, b goes silent
+	now := time.Now()
+	b.gossip.members["a:9000"].lastHeard = now.Add(10 * time.Second)
+	b.detectFailures(now.Add(6 * time.Second))
+	if m := b.gossip.members["b:9000"]; m.State != MemberSuspect {
+		t.Fatalf("Expected b to be suspect, got: %v", m.State)
+	}
+
+	b.detectFailures(now.Add(16 * time.Second))
+	if m := b.gossip.members["b:9000"]; m.State != MemberDead {
+		t.Fatalf("Expected b to be dead, got: %v", m.State)
+	}
+	if members = b.Members(); len(members) != 2 {
+		t.Fatalf("Dead members should not be listed: %v", members)
+	}
+
+	// Old gossip does not revive a dead member, and it is forgotten eventually
+	gossipFrom("a:9000", Member{ID: "b", Addr: "b:9000", Incarnation: 1})
+	if m := b.gossip.members["b:9000"]; m.State != MemberDead {
+		t.Fatalf("Expected b to stay dead, got: %v", m.State)
+	}
+
+	b.detectFailures(now.Add(40 * time.Second))
+	if _, found := b.gossip.members["b:9000"]; found {
+		t.Fatal("Expected b to be forgotten")
+	}
+}
+
+func TestGossipSeeds(t *testing.T) {
+	b, err := NewBus("tcp://a:9000", "b:9000", false, encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLogger(logging.Discard())
+
+	if err = b.EnableGossip(GossipOptions{Interval: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.connectGossip([]string{"a:9000"}); err != nil {
+		t.Fatal(err)
+	}
+	defer b.stopGossip()
+
+	gossipFrom := func(from string, members ...Member) {
+		p, err := payloads.NewPayload(gossipMessage{From: from, Members: members})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.handleGossip(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The seed is dialed until it knows us
+	gossipFrom("a:9000", Member{ID: "a", Addr: "a:9000"})
+	if peers := b.Peers(); len(peers) != 1 || peers[0].Addr != "a:9000" {
+		t.Fatalf("Expected the seed to be dialed, got: %v", peers)
+	}
+
+	// It sorts below us, so it dials us once it does
+	gossipFrom("a:9000", Member{ID: "a", Addr: "a:9000"}, Member{ID: b.GetID(), Addr: "b:9000"})
+	if peers := b.Peers(); len(peers) != 0 {
+		t.Fatalf("Expected the seed to dial us, got: %v", peers)
+	}
+
+	// A seed that died is dialed again so it finds us when it restarts
+	b.detectFailures(time.Now().Add(time.Minute))
+	if peers := b.Peers(); len(peers) != 1 || peers[0].Addr != "a:9000" {
+		t.Fatalf("Expected the dead seed to be dialed, got: %v", peers)
+	}
+}
+
+func TestGossipAddresses(t *testing.T) {
+	for addr, expect := range map[string]string{
+		" Host:9000":             "host:9000",
+		"localhost:9000":         "127.0.0.1:9000",
+		"[0:0:0:0:0:0:0:1]:9000": "[::1]:9000",
+		"no-port":                "no-port",
+	} {
+		if got := normalizeAddr(addr); got != expect {
+			t.Fatalf("Expected %q for %q, got: %q", expect, addr, got)
+		}
+	}
+
+	b, err := NewBus("tcp://localhost:9001", "127.0.0.1:9000", false, encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.shouldDial("localhost:9000") {
+		t.Fatal("The bus must not dial itself under another name")
+	}
+	if !b.shouldDial("LOCALHOST:9001") || b.shouldDial("127.0.0.1:8999") {
+		t.Fatal("Both sides of a pair must agree on who dials")
+	}
+}
+
+func TestGossipRawMode(t *testing.T) {
+	b, err := NewBus("tcp://a:9000", "a:9000", true, encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.EnableGossip(GossipOptions{}); err != ErrGossipRawMode {
+		t.Fatalf("Expected ErrGossipRawMode, got: %v", err)
+	}
+}
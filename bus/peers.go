@@ -0,0 +1,252 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/go-mangos/mangos"
+)
+
+var ErrUnknownPeer = errors.New("Peer is not known")
+
+// PeerState is the state of the connection to a peer the bus dials
+type PeerState int
+
+const (
+	// PeerConnecting peers have not been connected yet, the bus keeps dialing them
+	PeerConnecting PeerState = iota
+	PeerConnected
+	// PeerDisconnected peers lost their connection, the bus keeps redialing them
+	PeerDisconnected
+	// PeerRemoved peers were removed and are no longer dialed
+	PeerRemoved
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	default:
+		return "removed"
+	}
+}
+
+// Peer is a host the bus dials
+type Peer struct {
+	Addr  string
+	State PeerState
+	// Since is when the peer entered its state
+	Since time.Time
+}
+
+// PeerHook is called when the state of a peer changes
+type PeerHook func(Peer)
+
+type peerEntry struct {
+	Peer
+	dialer mangos.Dialer
+	// pipes counts the open connections, a closed dialer may report its removal after a new one connected
+	pipes int
+}
+
+// peerTable holds the peers of a bus, peers added before the bus listens are dialed once it does
+type peerTable struct {
+	mu       sync.Mutex
+	peers    map[string]*peerEntry
+	onChange PeerHook
+}
+
+func peerURL(addr string) string {
+	return fmt.Sprintf("tcp://%v", addr)
+}
+
+// AddPeer dials a peer in the background, the bus keeps redialing it whenever the connection drops until
+// it is removed. Peers can be added before Listen() is called.
+func (b *Bus) AddPeer(addr string) error {
+	if addr == "" || addr == b.me {
+		return nil
+	}
+
+	b.peers.mu.Lock()
+	if b.peers.peers == nil {
+		b.peers.peers = make(map[string]*peerEntry)
+	}
+
+	if _, found := b.peers.peers[addr]; found {
+		b.peers.mu.Unlock()
+		return nil
+	}
+
+	p := &peerEntry{Peer: Peer{Addr: addr, State: PeerConnecting, Since: time.Now()}}
+	b.peers.peers[addr] = p
+
+	var err error
+	if b.sock != nil {
+		err = b.dialPeer(p)
+	}
+	if err != nil {
+		delete(b.peers.peers, addr)
+	}
+	hook, event := b.peers.onChange, p.Peer
+	b.peers.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	b.peerEvent(hook, event)
+	return nil
+}
+
+// RemovePeer stops dialing a peer and closes the connection to it
+func (b *Bus) RemovePeer(addr string) error {
+	b.peers.mu.Lock()
+	p, found := b.peers.peers[addr]
+	if !found {
+		b.peers.mu.Unlock()
+		return ErrUnknownPeer
+	}
+
+	delete(b.peers.peers, addr)
+	dialer := p.dialer
+	p.dialer = nil
+	p.State = PeerRemoved
+	p.Since = time.Now()
+	hook, event := b.peers.onChange, p.Peer
+	b.peers.mu.Unlock()
+
+	if dialer != nil {
+		dialer.Close()
+	}
+
+	b.peerEvent(hook, event)
+	return nil
+}
+
+// Peers returns the peers the bus dials, ordered by address
+func (b *Bus) Peers() []Peer {
+	b.peers.mu.Lock()
+	defer b.peers.mu.Unlock()
+
+	peers := make([]Peer, 0, len(b.peers.peers))
+	for _, p := range b.peers.peers {
+		peers = append(peers, p.Peer)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Addr < peers[j].Addr
+	})
+	return peers
+}
+
+// SetOnPeerChange sets a hook that is called when a peer is added, connects, disconnects or is removed
+func (b *Bus) SetOnPeerChange(hook PeerHook) {
+	b.peers.mu.Lock()
+	b.peers.onChange = hook
+	b.peers.mu.Unlock()
+}
+
+// dialPeer starts dialing a peer, it must be called with the peer lock held
+func (b *Bus) dialPeer(p *peerEntry) error {
+	d, err := b.sock.NewDialer(peerURL(p.Addr), map[string]interface{}{mangos.OptionDialAsynch: true})
+	if err != nil {
+		return fmt.Errorf("socket.NewDialer: %s", err.Error())
+	}
+
+	if err = d.Dial(); err != nil {
+		return fmt.Errorf("socket.Dial: %s", err.Error())
+	}
+
+	p.dialer = d
+	return nil
+}
+
+// setSocket sets the socket of the bus and dials the peers that were added before it had one
+func (b *Bus) setSocket(sock mangos.Socket) {
+	b.peers.mu.Lock()
+	defer b.peers.mu.Unlock()
+
+	b.sock = sock
+	for addr, p := range b.peers.peers {
+		if p.dialer != nil {
+			continue
+		}
+
+		if err := b.dialPeer(p); err != nil {
+			b.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.bus",
+				"peer":   addr,
+			}).Error("Failed to dial peer: ", err)
+		}
+	}
+}
+
+// peerPortHook tracks the connections to the peers the bus dials
+func (b *Bus) peerPortHook(action mangos.PortAction, port mangos.Port) bool {
+	if !port.IsClient() {
+		return true
+	}
+
+	addr := strings.TrimPrefix(port.Address(), "tcp://")
+
+	b.peers.mu.Lock()
+	p, found := b.peers.peers[addr]
+	if !found {
+		b.peers.mu.Unlock()
+		return true
+	}
+
+	state := p.State
+	if action == mangos.PortActionAdd {
+		p.pipes++
+		state = PeerConnected
+	} else if p.pipes > 0 {
+		p.pipes--
+		if p.pipes == 0 {
+			state = PeerDisconnected
+		}
+	}
+
+	changed := state != p.State
+	if changed {
+		p.State = state
+		p.Since = time.Now()
+	}
+	hook, event := b.peers.onChange, p.Peer
+	b.peers.mu.Unlock()
+
+	if changed {
+		b.peerEvent(hook, event)
+	}
+	return true
+}
+
+func (b *Bus) peerEvent(hook PeerHook, p Peer) {
+	b.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.bus",
+		"peer":   p.Addr,
+	}).Info("Peer is ", p.State)
+
+	if hook == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			b.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.bus",
+			}).Error("Peer hook panicked: ", r)
+		}
+	}()
+
+	hook(p)
+}
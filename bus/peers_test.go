@@ -0,0 +1,78 @@
+package bus
+
+import (
+	"testing"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/go-mangos/mangos"
+)
+
+type testPort struct {
+	mangos.Port
+	addr   string
+	client bool
+}
+
+func (p testPort) Address() string { return p.addr }
+func (p testPort) IsClient() bool  { return p.client }
+
+func TestPeers(t *testing.T) {
+	b, err := NewBus("tcp://a:9000,b:9000", "a:9000", false, encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLogger(logging.Discard())
+
+	var events []Peer
+	b.SetOnPeerChange(func(p Peer) {
+		events = append(events, p)
+	})
+
+	// Peers added before the bus listens are only dialed once it does
+	for _, addr := range []string{"c:9000", "b:9000", "a:9000", "b:9000"} {
+		if err = b.AddPeer(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peers := b.Peers()
+	if len(peers) != 2 || peers[0].Addr != "b:9000" || peers[1].Addr != "c:9000" {
+		t.Fatalf("Unexpected peers: %v", peers)
+	}
+	if len(events) != 2 || events[0].State != PeerConnecting {
+		t.Fatalf("Expected 2 connecting events, got: %v", events)
+	}
+
+	port := testPort{addr: "tcp://b:9000", client: true}
+	b.peerPortHook(mangos.PortActionAdd, port)
+	b.peerPortHook(mangos.PortActionAdd, testPort{addr: "tcp://b:9000"})
+	if p := b.Peers()[0]; p.State != PeerConnected {
+		t.Fatalf("Expected b to be connected, got: %v", p.State)
+	}
+
+	b.peerPortHook(mangos.PortActionRemove, port)
+	if p := b.Peers()[0]; p.State != PeerDisconnected {
+		t.Fatalf("Expected b to be disconnected, got: %v", p.State)
+	}
+
+	// A stale removal does not disconnect a peer twice
+	b.peerPortHook(mangos.PortActionRemove, port)
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got: %v", events)
+	}
+
+	if err = b.RemovePeer("b:9000"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.RemovePeer("b:9000"); err != ErrUnknownPeer {
+		t.Fatalf("Expected ErrUnknownPeer, got: %v", err)
+	}
+
+	if peers = b.Peers(); len(peers) != 1 || peers[0].Addr != "c:9000" {
+		t.Fatalf("Unexpected peers: %v", peers)
+	}
+	if last := events[len(events)-1]; last.Addr != "b:9000" || last.State != PeerRemoved {
+		t.Fatalf("Expected b to be removed, got: %v", last)
+	}
+}
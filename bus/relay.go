@@ -0,0 +1,121 @@
+package bus
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/satori/go.uuid"
+)
+
+var ErrRelayRawMode = errors.New("Relaying is not supported in raw mode")
+
+// RelayOptions configures how far messages are relayed and how long they are remembered
+type RelayOptions struct {
+	// MaxHops is the longest path in links a message travels, it defaults to 8. A message is only
+	// delivered to every node if the mesh has a path this short between every pair of nodes.
+	MaxHops int
+	// SeenTTL is how long relayed message IDs are remembered, it must be longer than a message takes to
+	// cross the mesh and defaults to one minute
+	SeenTTL time.Duration
+}
+
+// relay remembers the messages a bus handled so copies that arrive through other peers are dropped
+type relay struct {
+	opts RelayOptions
+
+	mu          sync.Mutex
+	seen        map[string]time.Time
+	lastExpired time.Time
+}
+
+// EnableRelay makes the bus forward every message it has not seen before to its own peers, so messages
+// reach every node of a partially connected mesh once. All nodes of the mesh must enable it. It must be
+// called before Connect() and is not supported in raw mode.
+func (b *Bus) EnableRelay(opts RelayOptions) error {
+	if b.rawMode {
+		return ErrRelayRawMode
+	}
+
+	if opts.MaxHops <= 0 {
+		opts.MaxHops = 8
+	}
+	if opts.SeenTTL <= 0 {
+		opts.SeenTTL = time.Minute
+	}
+
+	b.relay = &relay{
+		opts: opts,
+		seen: make(map[string]time.Time),
+	}
+	return nil
+}
+
+// firstSeen remembers a message ID and returns false if it was seen before
+func (r *relay) firstSeen(id string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if seenAt, found := r.seen[id]; found && now.Sub(seenAt) <= r.opts.SeenTTL {
+		return false
+	}
+	r.seen[id] = now
+
+	if now.Sub(r.lastExpired) >= r.opts.SeenTTL {
+		r.lastExpired = now
+		for id, seenAt := range r.seen {
+			if now.Sub(seenAt) > r.opts.SeenTTL {
+				delete(r.seen, id)
+			}
+		}
+	}
+
+	return true
+}
+
+// stampRelay gives a message the bus sends a new relay ID, the bus drops the copies its peers send back. A
+// received message that is sent again is a new message, it keeps none of the hops it was received with.
+func (b *Bus) stampRelay(payload payloads.Payload) {
+	if b.relay == nil {
+		return
+	}
+
+	id := uuid.NewV4().String()
+	payloads.SetRelay(payload, id, b.relay.opts.MaxHops)
+	b.relay.firstSeen(id, time.Now())
+}
+
+// relayPayload forwards a received message to the peers of the bus if it has hops left, it returns
+// false if the message was seen before and must be dropped
+func (b *Bus) relayPayload(payload payloads.Payload) bool {
+	id, hops, found := payloads.Relay(payload)
+	if !found {
+		return true
+	}
+
+	if !b.relay.firstSeen(id, time.Now()) {
+		metrics.IncrCounter(metrics.KeyDuplicateDropped, 1, metrics.Transport(b.Transport()), metrics.Topic(payload.GetTopic()))
+		return false
+	}
+
+	if hops <= 1 {
+		return true
+	}
+
+	// Handlers get the payload as it was received
+	forward := payload.Copy()
+	payloads.SetRelay(forward, id, hops-1)
+	if err := b.write(forward); err != nil {
+		b.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.bus",
+			"topic":  payload.GetTopic(),
+		}).Error("Failed to relay message: ", err)
+		return true
+	}
+
+	metrics.IncrCounter(metrics.KeyRelayed, 1, metrics.Transport(b.Transport()), metrics.Topic(payload.GetTopic()))
+	return true
+}
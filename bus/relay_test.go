@@ -0,0 +1,134 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/go-mangos/mangos"
+)
+
+// testSocket records what the bus sends to its peers
+type testSocket struct {
+	mangos.Socket
+	sent [][]byte
+}
+
+func (s *testSocket) Send(msg []byte) error {
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	b, err := NewBus("tcp://a:9000,b:9000", "a:9000", false, encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLogger(logging.Discard())
+	if err = b.EnableRelay(RelayOptions{MaxHops: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := &testSocket{}
+	b.sock = sock
+
+	received := make(chan payloads.Payload, 3)
+	b.Subscribe("tcf.test.relay", func(p payloads.Payload) {
+		received <- p
+	})
+
+	stamped := func(i int) (string, int) {
+		sent, err := b.GetPayload(sock.sent[i], encoding.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, hops, _ := payloads.Relay(sent)
+		return id, hops
+	}
+
+	// Our own messages are stamped and dropped when a peer sends them back
+	p, _ := payloads.NewPayload("hello")
+	if err = b.Send("tcf.test.relay", p); err != nil {
+		t.Fatal(err)
+	}
+	if _, hops := stamped(0); hops != 3 {
+		t.Fatalf("Expected the message to be stamped with 3 hops, got: %v", hops)
+	}
+	if err = b.handlePayload(sock.sent[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(id string, hops int) {
+		p, _ := payloads.NewPayload("hello")
+		p.SetTopic("tcf.test.relay")
+		payloads.SetRelay(p, id, hops)
+		data, err := payloads.Marshal(p, encoding.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.handlePayload(data.([]byte)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new message is handled once and forwarded with a hop less
+	receive("m1", 2)
+	receive("m1", 2)
+	if len(sock.sent) != 2 {
+		t.Fatalf("Expected the message to be forwarded once, sent: %v", len(sock.sent))
+	}
+
+	forwarded, err := b.GetPayload(sock.sent[1], encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, hops, _ := payloads.Relay(forwarded); id != "m1" || hops != 1 {
+		t.Fatalf("Unexpected forward: %v %v", id, hops)
+	}
+
+	// A received message that is sent again gets a new relay ID
+	if err = b.Send("tcf.test.relay", forwarded); err != nil {
+		t.Fatal(err)
+	}
+	if len(sock.sent) != 3 {
+		t.Fatalf("Expected the message to be sent, sent: %v", len(sock.sent))
+	}
+	if id, hops := stamped(2); id == "m1" || hops != 3 {
+		t.Fatalf("Expected the message to be sent with a new relay ID, got: %v %v", id, hops)
+	}
+
+	// A message without hops left is handled but not forwarded
+	receive("m2", 1)
+	if len(sock.sent) != 3 {
+		t.Fatalf("Expected the message not to be forwarded, sent: %v", len(sock.sent))
+	}
+
+	for _, want := range []string{"m1", "m2"} {
+		select {
+		case got := <-received:
+			if id, _, _ := payloads.Relay(got); id != want {
+				t.Fatalf("Expected %v, got: %v", want, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Relayed message not handled")
+		}
+	}
+
+	select {
+	case got := <-received:
+		t.Fatalf("Duplicate was handled: %v", got.GetHeaders())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// IDs are forgotten after the TTL
+	if !b.relay.firstSeen("m1", time.Now().Add(2*time.Minute)) {
+		t.Fatal("Expected m1 to be forgotten")
+	}
+
+	raw, _ := NewBus("tcp://a:9000,b:9000", "a:9000", true, encoding.JSON)
+	if err = raw.EnableRelay(RelayOptions{}); err != ErrRelayRawMode {
+		t.Fatalf("Expected ErrRelayRawMode, got: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package bus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/client"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// nodeTTL is how long a node that is not a gossip member stays known after it last sent a message
+var nodeTTL = 10 * time.Minute
+
+// nodeTable holds the IDs of the nodes the bus heard from, so directed messages to nodes that went away
+// fail instead of being sent to nobody
+type nodeTable struct {
+	mu          sync.Mutex
+	lastHeard   map[string]time.Time
+	lastExpired time.Time
+}
+
+func (n *nodeTable) heard(id string, now time.Time) {
+	if id == "" {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.lastHeard == nil {
+		n.lastHeard = make(map[string]time.Time)
+	}
+	n.lastHeard[id] = now
+
+	if now.Sub(n.lastExpired) < nodeTTL {
+		return
+	}
+	n.lastExpired = now
+
+	for id, at := range n.lastHeard {
+		if now.Sub(at) > nodeTTL {
+			delete(n.lastHeard, id)
+		}
+	}
+}
+
+func (n *nodeTable) known(id string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	at, found := n.lastHeard[id]
+	return found && now.Sub(at) <= nodeTTL
+}
+
+// SendTo sends a payload to the inbox of a single node, the node handles it with the handler of the topic.
+// The bus socket reaches every peer, the other nodes drop the message. Nodes are known through gossip, or
+// once they sent a message to the bus, ErrUnknownNode is returned for any other node.
+func (b *Bus) SendTo(nodeID, topic string, payload payloads.Payload) error {
+	if nodeID == b.id {
+		return b.WrapOutbound(b.sendToSelf)(client.InboxTopic(nodeID, topic), payload)
+	}
+
+	if !b.knowsNode(nodeID) {
+		return client.ErrUnknownNode
+	}
+
+	return b.Send(client.InboxTopic(nodeID, topic), payload)
+}
+
+// sendToSelf hands a directed message to the local handler, the bus socket does not deliver to the sender
+func (b *Bus) sendToSelf(inbox string, payload payloads.Payload) error {
+	if payload == nil {
+		return nil
+	}
+
+	payload.SetTopic(inbox)
+	if payload.From() == "" {
+		payload.SetFrom(b.GetID())
+	}
+
+	return b.dispatchPayload(payload)
+}
+
+func (b *Bus) knowsNode(id string) bool {
+	if b.gossip != nil {
+		b.gossip.mu.Lock()
+		defer b.gossip.mu.Unlock()
+
+		for _, m := range b.gossip.members {
+			if m.ID == id && m.State != MemberDead {
+				return true
+			}
+		}
+	}
+
+	return b.nodes.known(id, time.Now())
+}
+
+// handlerTopic returns the topic whose handler runs for a received topic, directed messages run the handler
+// of their topic and messages for the inbox of other nodes are dropped
+func (b *Bus) handlerTopic(topic string) (string, bool) {
+	nodeID, inboxTopic, ok := client.ParseInboxTopic(topic)
+	if !ok {
+		return topic, true
+	}
+
+	return inboxTopic, nodeID == b.id
+}
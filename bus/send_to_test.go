@@ -0,0 +1,79 @@
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/client"
+	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+func TestSendTo(t *testing.T) {
+	b, err := NewBus("tcp://a:9000,b:9000", "a:9000", false, encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLogger(logging.Discard())
+
+	received := make(chan payloads.Payload, 3)
+	b.Subscribe("tcf.test.direct", func(p payloads.Payload) {
+		received <- p
+	})
+
+	p, _ := payloads.NewPayload("hello")
+	if err = b.SendTo("unknown", "tcf.test.direct", p); err != client.ErrUnknownNode {
+		t.Fatalf("Expected ErrUnknownNode, got: %v", err)
+	}
+
+	// Directed messages to ourselves are handled locally
+	if err = b.SendTo(b.GetID(), "tcf.test.direct", p); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if got.GetTopic() != client.InboxTopic(b.GetID(), "tcf.test.direct") {
+			t.Fatalf("Unexpected topic: %v", got.GetTopic())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Directed message not handled")
+	}
+
+	receive := func(topic string) {
+		p, _ := payloads.NewPayload("hello")
+		p.SetTopic(topic)
+		p.SetFrom("peer")
+		data, err := payloads.Marshal(p, encoding.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.handlePayload(data.([]byte)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Messages for the inbox of other nodes are dropped, the sender becomes known
+	receive(client.InboxTopic("other", "tcf.test.direct"))
+	receive(client.InboxTopic(b.GetID(), "tcf.test.direct"))
+
+	select {
+	case got := <-received:
+		if got.From() != "peer" {
+			t.Fatalf("Unexpected sender: %v", got.From())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Directed message not handled")
+	}
+
+	select {
+	case got := <-received:
+		t.Fatalf("Message for another node was handled: %v", got.GetTopic())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if !b.knowsNode("peer") || b.knowsNode("other") {
+		t.Fatal("Expected only the sender to be known")
+	}
+}
@@ -23,12 +23,16 @@ package beacon
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
@@ -38,6 +42,12 @@ const (
 	defaultInterval = 1 * time.Second
 )
 
+var (
+	ErrNotStarted       = errors.New("beacon is not started")
+	ErrClosed           = errors.New("beacon is closed")
+	ErrTransmitTooLarge = errors.New("beacon transmit is too large")
+)
+
 var (
 	ipv4Group = net.IPv4(224, 0, 0, 250)
 	ipv6Group = "ff02::fa"
@@ -54,7 +64,7 @@ type Beacon struct {
 	signals    chan interface{}
 	ipv4Conn   *ipv4.PacketConn // UDP incoming connection for sending/receiving beacons
 	ipv6Conn   *ipv6.PacketConn // UDP incoming connection for sending/receiving beacons
-	ipv4       bool             // Whether or not connection is in ipv4 mode
+	ipv6       bool             // Whether or not connection is in ipv6 mode
 	port       int              // UDP port number we work on
 	interval   time.Duration    // Beacon broadcast interval
 	noecho     bool             // Ignore own (unique) beacons
@@ -62,13 +72,24 @@ type Beacon struct {
 	transmit   []byte           // Beacon transmit data
 	filter     []byte           // Beacon filter data
 	addr       string           // Our own address
-	iface      string
+	ifaces     []string         // Interfaces to beacon on, the first usable one if empty
+	bindAddr   string           // Address to send from, it selects the interface that has it
+	group      string           // Multicast group, the default depends on the IP version
+	ttl        int              // Multicast TTL or hop limit, the OS default if zero
+	targets    []target         // Where beacons are sent, one per interface
+	onError    func(error)      // Reports errors of the periodic transmit
 	wg         sync.WaitGroup
-	inAddr     *net.UDPAddr
-	outAddr    *net.UDPAddr
 	sync.Mutex
 }
 
+// target is an interface beacons are sent on and the address they are sent to
+type target struct {
+	name    string
+	ifIndex int
+	src     net.IP
+	dst     *net.UDPAddr
+}
+
 // New creates a new beacon on a certain UDP port.
 func New() (b *Beacon) {
 
@@ -81,140 +102,203 @@ func New() (b *Beacon) {
 }
 
 func (b *Beacon) start() (err error) {
-
-	if b.iface == "" {
-		b.iface = os.Getenv("BEACON_INTERFACE")
-	}
-	if b.iface == "" {
-		b.iface = os.Getenv("ZSYS_INTERFACE")
+	ifs, err := b.interfaces()
+	if err != nil {
+		return err
 	}
 
-	var ifs []net.Interface
+	group, err := b.groupIP()
+	if err != nil {
+		return err
+	}
 
-	if b.iface == "" {
-		ifs, err = net.Interfaces()
+	if b.ipv6 {
+		conn, err := net.ListenPacket("udp6", net.JoinHostPort(net.IPv6linklocalallnodes.String(), strconv.Itoa(b.port)))
 		if err != nil {
 			return err
 		}
 
+		b.ipv6Conn = ipv6.NewPacketConn(conn)
+		b.ipv6Conn.SetMulticastLoopback(true)
+		b.ipv6Conn.SetControlMessage(ipv6.FlagSrc, true)
+		if b.ttl > 0 {
+			b.ipv6Conn.SetMulticastHopLimit(b.ttl)
+		}
 	} else {
-		iface, err := net.InterfaceByName(b.iface)
+		conn, err := net.ListenPacket("udp4", net.JoinHostPort("224.0.0.0", strconv.Itoa(b.port)))
 		if err != nil {
 			return err
 		}
-		ifs = append(ifs, *iface)
-	}
 
-	conn, err := net.ListenPacket("udp4", net.JoinHostPort("224.0.0.0", strconv.Itoa(b.port)))
-	if err == nil {
 		b.ipv4Conn = ipv4.NewPacketConn(conn)
 		b.ipv4Conn.SetMulticastLoopback(true)
 		b.ipv4Conn.SetControlMessage(ipv4.FlagSrc, true)
+		if b.ttl > 0 {
+			b.ipv4Conn.SetMulticastTTL(b.ttl)
+		}
 	}
 
-	if !b.ipv4 {
-		conn, err := net.ListenPacket("udp6", net.JoinHostPort(net.IPv6linklocalallnodes.String(), strconv.Itoa(b.port)))
+	defer func() {
+		// Do not leak the connection if an interface cannot be joined
+		if err == nil {
+			return
+		}
+		b.targets = nil
+		if b.ipv4Conn != nil {
+			b.ipv4Conn.Close()
+			b.ipv4Conn = nil
+		}
+		if b.ipv6Conn != nil {
+			b.ipv6Conn.Close()
+			b.ipv6Conn = nil
+		}
+	}()
+
+	broadcast := os.Getenv("BEACON_BROADCAST") != ""
+
+	b.targets = nil
+	for i := range ifs {
+		iface := &ifs[i]
+		ip, ipnet, err := b.interfaceAddr(iface)
 		if err != nil {
 			return err
 		}
 
-		b.ipv6Conn = ipv6.NewPacketConn(conn)
-		b.ipv6Conn.SetMulticastLoopback(true)
-		b.ipv6Conn.SetControlMessage(ipv6.FlagSrc, true)
-	}
+		if b.ipv6Conn != nil {
+			err = b.ipv6Conn.JoinGroup(iface, &net.UDPAddr{IP: group})
+		} else {
+			err = b.ipv4Conn.JoinGroup(iface, &net.UDPAddr{IP: group})
+		}
+		if err != nil {
+			return err
+		}
 
-	broadcast := os.Getenv("BEACON_BROADCAST") != ""
+		if b.addr == "" {
+			b.addr = ip.String()
+		}
 
-	for _, iface := range ifs {
-		if b.ipv4Conn != nil {
-			b.inAddr = &net.UDPAddr{
-				IP: ipv4Group,
-			}
-			err := b.ipv4Conn.JoinGroup(&iface, b.inAddr)
-			if err != nil {
-				return err
-			}
+		t := target{name: iface.Name, ifIndex: iface.Index}
+		if b.bindAddr != "" {
+			t.src = ip
+		}
 
-			// Find IP of the interface
-			// TODO(armen): Let user set the ipaddress which here can be verified to be valid
-			addrs, err := iface.Addrs()
-			if err != nil {
-				return err
+		switch {
+		case broadcast && !b.ipv6:
+			bcast := make(net.IP, len(ipnet.IP))
+			for i := range ipnet.IP {
+				bcast[i] = ipnet.IP[i] | ^ipnet.Mask[i]
 			}
+			t.dst = &net.UDPAddr{IP: bcast, Port: b.port}
 
-			if len(addrs) <= 0 {
-				return errors.New("no address to bind to")
+		case iface.Flags&net.FlagLoopback != 0 && b.group == "":
+			if b.ipv6 {
+				t.dst = &net.UDPAddr{IP: net.IPv6interfacelocalallnodes, Port: b.port}
+			} else {
+				t.dst = &net.UDPAddr{IP: net.IPv4allsys, Port: b.port}
 			}
 
-			ip, ipnet, err := net.ParseCIDR(addrs[0].String())
-			if err != nil {
-				return err
-			}
-			b.addr = ip.String()
+		default:
+			t.dst = &net.UDPAddr{IP: group, Port: b.port}
+		}
 
-			switch {
-			case broadcast:
-				bcast := ipnet.IP
-				for i := 0; i < len(ipnet.Mask); i++ {
-					bcast[i] |= ^ipnet.Mask[i]
-				}
-				b.outAddr = &net.UDPAddr{IP: bcast, Port: b.port}
+		b.targets = append(b.targets, t)
+	}
 
-			case iface.Flags&net.FlagLoopback != 0:
-				b.outAddr = &net.UDPAddr{IP: net.IPv4allsys, Port: b.port}
+	go b.listen()
+	go b.signal()
 
-			default:
-				b.outAddr = &net.UDPAddr{IP: ipv4Group, Port: b.port}
-			}
+	return nil
+}
 
-			break
-		} else if b.ipv6Conn != nil {
-			b.inAddr = &net.UDPAddr{
-				IP: net.ParseIP(ipv6Group),
-			}
-			err := b.ipv6Conn.JoinGroup(&iface, b.inAddr)
-			if err != nil {
-				return err
-			}
+// interfaces returns the interfaces to beacon on, these are the selected interfaces or, without a
+// selection, the first interface that is up and has an address of the IP version
+func (b *Beacon) interfaces() ([]net.Interface, error) {
+	names := b.ifaces
+	if len(names) == 0 {
+		env := os.Getenv("BEACON_INTERFACE")
+		if env == "" {
+			env = os.Getenv("ZSYS_INTERFACE")
+		}
+		if env != "" {
+			names = strings.Split(env, ",")
+		}
+	}
 
-			// Find IP of the interface
-			// TODO(armen): Let user set the ipaddress which here can be verified to be valid
-			addrs, err := iface.Addrs()
-			if err != nil {
-				return err
-			}
-			ip, ipnet, err := net.ParseCIDR(addrs[0].String())
+	if len(names) > 0 {
+		ifs := make([]net.Interface, 0, len(names))
+		for _, name := range names {
+			iface, err := net.InterfaceByName(strings.TrimSpace(name))
 			if err != nil {
-				return err
+				return nil, err
 			}
-			b.addr = ip.String()
-
-			switch {
-			case broadcast:
-				bcast := ipnet.IP
-				for i := 0; i < len(ipnet.Mask); i++ {
-					bcast[i] |= ^ipnet.Mask[i]
-				}
-				b.outAddr = &net.UDPAddr{IP: bcast, Port: b.port}
+			ifs = append(ifs, *iface)
+		}
+		return ifs, nil
+	}
 
-			case iface.Flags&net.FlagLoopback != 0:
-				b.outAddr = &net.UDPAddr{IP: net.IPv6interfacelocalallnodes, Port: b.port}
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
 
-			default:
-				b.outAddr = &net.UDPAddr{IP: net.ParseIP(ipv6Group), Port: b.port}
-			}
-			break
+	for i := range all {
+		if all[i].Flags&net.FlagUp == 0 {
+			continue
+		}
+		if _, _, err := b.interfaceAddr(&all[i]); err == nil {
+			return all[i : i+1], nil
 		}
 	}
 
-	if b.ipv4Conn == nil && b.ipv6Conn == nil {
-		return errors.New("no interfaces to bind to")
+	return nil, errors.New("no interfaces to bind to")
+}
+
+// interfaceAddr returns the address beacons are sent from on an interface, the bind address if it is set
+// or else the first address of the IP version
+func (b *Beacon) interfaceAddr(iface *net.Interface) (net.IP, *net.IPNet, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	go b.listen()
-	go b.signal()
+	bindIP := net.ParseIP(b.bindAddr)
+	for _, addr := range addrs {
+		ip, ipnet, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			continue
+		}
 
-	return nil
+		if (ip.To4() == nil) != b.ipv6 {
+			continue
+		}
+
+		if bindIP != nil && !ip.Equal(bindIP) {
+			continue
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return ip, ipnet, nil
+	}
+
+	return nil, nil, fmt.Errorf("no address to bind to on %s", iface.Name)
+}
+
+// groupIP returns the multicast group to join
+func (b *Beacon) groupIP() (net.IP, error) {
+	if b.group == "" {
+		if b.ipv6 {
+			return net.ParseIP(ipv6Group), nil
+		}
+		return ipv4Group, nil
+	}
+
+	ip := net.ParseIP(b.group)
+	if ip == nil || !ip.IsMulticast() || (ip.To4() == nil) != b.ipv6 {
+		return nil, fmt.Errorf("invalid multicast group: %s", b.group)
+	}
+	return ip, nil
 }
 
 // Close terminates the beacon.
@@ -228,17 +312,15 @@ func (b *Beacon) Close() {
 	b.Unlock()
 
 	// Send a nil udp data to wake up listen()
-	if b.ipv4Conn != nil {
-		b.ipv4Conn.WriteTo(nil, nil, b.outAddr)
-	} else {
-		b.ipv6Conn.WriteTo(nil, nil, b.outAddr)
+	if len(b.targets) > 0 {
+		b.write(nil, b.targets[0])
 	}
 
 	b.wg.Wait()
 
 	if b.ipv4Conn != nil {
 		b.ipv4Conn.Close()
-	} else {
+	} else if b.ipv6Conn != nil {
 		b.ipv6Conn.Close()
 	}
 }
@@ -255,7 +337,41 @@ func (b *Beacon) Port() int {
 
 // SetInterface sets interface to bind and listen on.
 func (b *Beacon) SetInterface(iface string) *Beacon {
-	b.iface = iface
+	if iface == "" {
+		b.ifaces = nil
+		return b
+	}
+	return b.SetInterfaces(iface)
+}
+
+// SetInterfaces sets the interfaces to bind and listen on, beacons are sent on each of them.
+func (b *Beacon) SetInterfaces(ifaces ...string) *Beacon {
+	b.ifaces = ifaces
+	return b
+}
+
+// SetBindAddress sets the address beacons are sent from, without selected interfaces the interface
+// that has the address is used.
+func (b *Beacon) SetBindAddress(addr string) *Beacon {
+	b.bindAddr = addr
+	return b
+}
+
+// SetIPv6 makes the beacon use IPv6 instead of IPv4.
+func (b *Beacon) SetIPv6(enabled bool) *Beacon {
+	b.ipv6 = enabled
+	return b
+}
+
+// SetGroup sets the multicast group to beacon on, it must match the IP version.
+func (b *Beacon) SetGroup(group string) *Beacon {
+	b.group = group
+	return b
+}
+
+// SetTTL sets the multicast TTL (hop limit for IPv6), beacons stay on the local network by default.
+func (b *Beacon) SetTTL(ttl int) *Beacon {
+	b.ttl = ttl
 	return b
 }
 
@@ -288,6 +404,32 @@ func (b *Beacon) Publish(transmit []byte) error {
 	return err
 }
 
+// Send sends a transmit to peers once, next to the periodic transmit. The beacon must have been
+// started with Publish. It is sent on every interface, the first error is returned.
+func (b *Beacon) Send(transmit []byte) error {
+	if len(transmit) > beaconMax {
+		return ErrTransmitTooLarge
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.terminated {
+		return ErrClosed
+	}
+	if len(b.targets) == 0 {
+		return ErrNotStarted
+	}
+
+	var firstErr error
+	for _, t := range b.targets {
+		if err := b.write(transmit, t); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // Silence stops broadcasting beacon.
 func (b *Beacon) Silence() *Beacon {
 	b.Lock()
@@ -384,26 +526,59 @@ func (b *Beacon) signal() {
 				b.Unlock()
 				return
 			}
+			var errs []error
 			if b.transmit != nil {
-				// Signal other beacons
-				var err error
-				if b.ipv4Conn != nil {
-					_, err = b.ipv4Conn.WriteTo(b.transmit, nil, b.outAddr)
-				} else {
-					_, err = b.ipv6Conn.WriteTo(b.transmit, nil, b.outAddr)
-				}
-
-				if err != nil {
-					panic(err)
+				// Signal other beacons on every interface
+				for _, t := range b.targets {
+					if err := b.write(b.transmit, t); err != nil {
+						errs = append(errs, err)
+					}
 				}
 			}
 			b.Unlock()
 
+			// Reported outside the lock, the handler may call the beacon
+			for _, err := range errs {
+				b.reportError(err)
+			}
+
 			ticker = time.After(b.interval)
 		}
 	}
 }
 
+// SetErrorHandler sets a callback for errors of the periodic transmit, they are logged if it is not set
+func (b *Beacon) SetErrorHandler(fn func(error)) *Beacon {
+	b.onError = fn
+	return b
+}
+
+func (b *Beacon) reportError(err error) {
+	if b.onError != nil {
+		b.onError(err)
+		return
+	}
+
+	logging.Default().WithFields(logrus.Fields{
+		"prefix": "tcf.beacon",
+	}).Error("Failed to send beacon: ", err)
+}
+
+// write sends a beacon out of the interface of a target
+func (b *Beacon) write(transmit []byte, t target) error {
+	var err error
+	if b.ipv4Conn != nil {
+		_, err = b.ipv4Conn.WriteTo(transmit, &ipv4.ControlMessage{IfIndex: t.ifIndex, Src: t.src}, t.dst)
+	} else {
+		_, err = b.ipv6Conn.WriteTo(transmit, &ipv6.ControlMessage{IfIndex: t.ifIndex, Src: t.src}, t.dst)
+	}
+
+	if err != nil {
+		return fmt.Errorf("interface %s: %s", t.name, err.Error())
+	}
+	return nil
+}
+
 // Restart starts broadcasting beacon to peers at the specified interval again
 func (b *Beacon) Restart(transmit []byte) error {
 	b.Lock()
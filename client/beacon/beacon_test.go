@@ -116,3 +116,46 @@ func TestBeacon(t *testing.T) {
 		time.Sleep(50 * time.Millisecond)
 	}
 }
+
+func TestBeaconOptions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Println("Beacon tests skipped on windows")
+		return
+	}
+
+	// The bind address selects the interface and the source of the beacons
+	transmit := []byte("BOUND-BEACON")
+	b := New()
+	b.SetPort(9998).SetInterval(50 * time.Millisecond).SetBindAddress("127.0.0.1").SetTTL(1)
+	if err := b.Publish(transmit); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Addr() != "127.0.0.1" {
+		t.Fatalf("expected to send from 127.0.0.1, got %s", b.Addr())
+	}
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected to receive a signal but got nothing!")
+	case s := <-b.Signals():
+		signal := s.(*Signal)
+		if !bytes.Equal(transmit, signal.Transmit) {
+			t.Fatalf("expected % X, got % X", transmit, signal.Transmit)
+		}
+	}
+	b.Close()
+
+	invalid := map[string]*Beacon{
+		"unknown interface": New().SetInterfaces("tcf-missing0"),
+		"unbound address":   New().SetBindAddress("192.0.2.1"),
+		"unicast group":     New().SetGroup("10.0.0.1"),
+		"IPv6 group":        New().SetGroup("ff02::fa"),
+	}
+	for name, b := range invalid {
+		if err := b.SetPort(9998).Publish(nil); err == nil {
+			b.Close()
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
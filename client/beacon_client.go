@@ -39,8 +39,8 @@ func (p *payloadMap) Get(filter string) (PayloadHandler, bool) {
 // for Gyre (https://github.com/zeromq/gyre/blob/master/beacon/beacon.go), the file has been
 // internalised here so that some modifications could be made.
 //
-// The BeaconClient will transmit a payload over UDP at a pre-defined interval, and can
-// support multiple filters and payload handlers, Beacon will only Subscribe and Broadcast,
+// The BeaconClient will transmit payloads over UDP, every filter that is broadcast has its own
+// interval, and can support multiple filters and payload handlers, Beacon will only Subscribe and Broadcast,
 // the "Publish" method is not implemented because it would not make sense with regards to how
 // Beacon is implemented.
 //
@@ -49,17 +49,29 @@ func (p *payloadMap) Get(filter string) (PayloadHandler, bool) {
 // For a usage example see the `examples/beacon_broadcast/beacon_example.go` file.
 type BeaconClient struct {
 	ClientHandler
+	// Interval is the broadcast interval in seconds for broadcasts that do not set one
 	Interval      int
 	Port          int
 	SubscribeChan chan string
+	// Interfaces are the network interfaces to beacon on, the first usable one is used if empty
+	Interfaces []string
+	// BindAddress is the address to send from, it selects the interface that has it
+	BindAddress string
+	// IPv6 beacons over IPv6 instead of IPv4
+	IPv6 bool
+	// Group is the multicast group, TTL the multicast TTL or hop limit
+	Group string
+	TTL   int
 
 	beacon          *beacon.Beacon
-	publishing      bool
-	hasStarted      bool
+	startMu         sync.Mutex
+	started         bool
+	broadcasts      broadcasts
 	listening       bool
 	Encoding        encoding.Encoding
 	payloadHandlers payloadMap
 	id string
+	pools           subscriptionPools
 }
 
 // The default Beacon payload format, because we need to handle channel subscriptions manually.
@@ -70,6 +82,8 @@ type BeaconTransmit struct {
 
 // Stop will stop the client
 func (b *BeaconClient) Stop() error {
+	b.broadcasts.StopAll()
+	b.pools.StopAll()
 	b.beacon.Close()
 	return nil
 }
@@ -90,12 +104,20 @@ func (b *BeaconClient) Publish(filter string, p payloads.Payload) error {
 	return errors.New("Beacon only broadcasts and subscribes")
 }
 
+// PublishWithOptions is not implemented, see `Publish`
+func (b *BeaconClient) PublishWithOptions(filter string, p payloads.Payload, opts PublishOptions) error {
+	if opts.Retain {
+		return ErrRetainNotSupported
+	}
+	return b.Publish(filter, p)
+}
+
 func (b *BeaconClient) registerHandlerForChannel(filter string, handler PayloadHandler) {
-	log.WithFields(logrus.Fields{
+	b.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.beaconclient",
 	}).Debugf("Adding handler for: %v\n", filter)
 	b.payloadHandlers.Add(filter, handler)
-	log.WithFields(logrus.Fields{
+	b.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.beaconclient",
 	}).Debugf("Done adding handler for: %v\n", filter)
 }
@@ -105,7 +127,7 @@ func (b *BeaconClient) handleBeaconMessage(s *beacon.Signal) {
 
 	decErr := msgpack.Unmarshal(s.Transmit, &beaconMsg)
 	if decErr != nil {
-		log.WithFields(logrus.Fields{
+		b.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.beaconclient",
 		}).Errorf("Beacon decode error! %v\n", decErr)
 		return
@@ -116,32 +138,65 @@ func (b *BeaconClient) handleBeaconMessage(s *beacon.Signal) {
 		return
 	}
 
-	b.HandleRawMessage(beaconMsg.Transmit, handler, b.Encoding)
+	workers, found := b.pools.Get(beaconMsg.Channel)
+	if !found {
+		return
+	}
+
+	if err := b.DispatchRawMessage(beaconMsg.Channel, beaconMsg.Transmit, handler, b.Encoding, workers); err != nil {
+		b.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.beaconclient",
+		}).Error("Failed to handle message: ", err)
+	}
+}
+
+// ensureStarted opens the beacon connections once, the beacon has no periodic transmit of its own
+// because every broadcast sends on its own schedule
+func (b *BeaconClient) ensureStarted() error {
+	b.startMu.Lock()
+	defer b.startMu.Unlock()
+
+	if b.started {
+		return nil
+	}
+
+	if err := b.beacon.Publish(nil); err != nil {
+		return err
+	}
+	b.started = true
+	return nil
 }
 
 func (b *BeaconClient) startListening(filter string) {
 	b.beacon.Subscribe([]byte{})
 	b.listening = true
 
+	if err := b.ensureStarted(); err != nil {
+		b.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.beaconclient",
+		}).Error("Failed to start beacon: ", err)
+		return
+	}
+
 	select {
 	case b.SubscribeChan <- filter:
-		log.WithFields(logrus.Fields{
+		b.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.beaconclient",
 		}).Info("Subscription notification sent")
 	default:
-		log.WithFields(logrus.Fields{
+		b.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.beaconclient",
 		}).Debug("Subscription notification failed to send, continuing")
 	}
 
-	log.WithFields(logrus.Fields{
+	b.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.beaconclient",
 	}).Debug("Listening")
 
 	for {
 		s := <-b.beacon.Signals()
 		if s != nil {
-			log.WithFields(logrus.Fields{
+			b.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.beaconclient",
 			}).Debug("Message received: ", string(s.(*beacon.Signal).Transmit))
 			b.handleBeaconMessage(s.(*beacon.Signal))
@@ -153,6 +208,14 @@ func (b *BeaconClient) startListening(filter string) {
 // Subscribe enables you to add a payload handler to a chanel filter, so multiple functions
 // can be set against different channels. Wildcards are not supported.
 func (b *BeaconClient) Subscribe(filter string, handler PayloadHandler) (chan string, error) {
+	return b.SubscribeWithOptions(filter, handler, DefaultSubscribeOptions())
+}
+
+// SubscribeWithOptions adds a payload handler to a channel filter that is run on a worker pool
+// configured by the options.
+func (b *BeaconClient) SubscribeWithOptions(filter string, handler PayloadHandler, opts SubscribeOptions) (chan string, error) {
+	handler = opts.Retry.wrap(handler)
+	b.pools.Start(filter, opts, b.Log())
 	b.registerHandlerForChannel(filter, handler)
 
 	if b.listening {
@@ -173,11 +236,14 @@ func (b *BeaconClient) SetEncoding(enc encoding.Encoding) error {
 // if the prefix of the connection string is `beacon://`
 func (b *BeaconClient) Init(config interface{}) error {
 	if runtime.GOOS == "windows" {
-		log.Fatal("Beacon is not compatible with windows OS")
+		return errors.New("Beacon is not compatible with windows OS")
 	}
 
+	b.SetTransport("beacon")
 	b.beacon = beacon.New()
 	b.beacon.SetPort(b.Port).SetInterval(time.Duration(b.Interval) * time.Second)
+	b.beacon.SetErrorHandler(func(err error) { b.ReportError(err) })
+	b.beacon.SetInterfaces(b.Interfaces...).SetBindAddress(b.BindAddress).SetIPv6(b.IPv6).SetGroup(b.Group).SetTTL(b.TTL)
 	b.SubscribeChan = make(chan string)
 
 	b.payloadHandlers = payloadMap{
@@ -187,12 +253,44 @@ func (b *BeaconClient) Init(config interface{}) error {
 	return nil
 }
 
-// Broadcast will send the set payload via UDP every interval to the specified channel.
+// Broadcast will send the set payload via UDP every interval seconds to the specified channel, the
+// interval of the client is used if it is not positive. Several channels can broadcast at once, calling
+// it again for a channel replaces its payload and a nil payload halts it, like StopBroadcast() does.
 func (b *BeaconClient) Broadcast(filter string, payload payloads.Payload, interval int) error {
+	if err := b.StopBroadcast(filter); err != nil && err != ErrNotBroadcasting {
+		return err
+	}
+	if payload == nil {
+		return nil
+	}
+
+	if interval <= 0 {
+		interval = b.Interval
+	}
+	if interval <= 0 {
+		interval = 1
+	}
+	return b.BroadcastWithOptions(filter, payload, BroadcastOptions{Interval: time.Duration(interval) * time.Second})
+}
+
+// SendTo is not supported, beacons reach every node on the network
+func (b *BeaconClient) SendTo(nodeID, topic string, p payloads.Payload) error {
+	return ErrSendToNotSupported
+}
 
+// BroadcastWithOptions will send a payload on an interval or cron schedule with optional jitter, a
+// generator can create a fresh payload for each broadcast. Each encoded broadcast must fit in a
+// single beacon datagram.
+func (b *BeaconClient) BroadcastWithOptions(filter string, payload payloads.Payload, opts BroadcastOptions) error {
+	if err := b.ensureStarted(); err != nil {
+		return err
+	}
+	return b.broadcasts.Start(filter, payload, opts, b.WrapOutbound(b.send), b.Log(), "tcf.beaconclient")
+}
+
+// send transmits a payload to a channel once
+func (b *BeaconClient) send(filter string, payload payloads.Payload) error {
 	if payload == nil {
-		b.beacon.Silence()
-		b.publishing = false
 		return nil
 	}
 
@@ -228,35 +326,18 @@ func (b *BeaconClient) Broadcast(filter string, payload payloads.Payload, interv
 	}
 
 	if len(wrappedSend) == 0 {
-		log.WithFields(logrus.Fields{
+		b.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.beaconclient",
 		}).Error("No data to send, not sending")
 		return nil
 	}
 
-	// We're just changing the payload, so don't start another publish.
-	if b.hasStarted {
-		b.beacon.Restart(wrappedSend)
-		return nil
-	}
-
-	log.Info("Publishing")
-	pubErr := b.beacon.Publish(wrappedSend)
-	if pubErr != nil {
-		return pubErr
-	}
-
-	b.publishing = true
-	b.hasStarted = true
-	return nil
-
+	return b.beacon.Send(wrappedSend)
 }
 
-// StopBroadcast will stop the beacon broadcast.
+// StopBroadcast will stop the broadcast of a channel, other channels keep broadcasting.
 func (b *BeaconClient) StopBroadcast(f string) error {
-	b.beacon.Silence()
-	b.publishing = false
-	return nil
+	return b.broadcasts.Stop(f)
 }
 
 func (c *BeaconClient) SetConnectionDropHook(callback func() error) error {
@@ -65,3 +65,139 @@ func TestBeaconClient(t *testing.T) {
 	b.Stop()
 
 }
+
+func TestBeaconClientConcurrentBroadcasts(t *testing.T) {
+	var b Client
+	var err error
+
+	if b, err = NewClient("beacon://0.0.0.0:9998?interval=1", encoding.JSON); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	fast, slow := "tcftestbeaconfast", "tcftestbeaconslow"
+	results := map[string]chan testPayloadData{
+		fast: make(chan testPayloadData, 20),
+		slow: make(chan testPayloadData, 20),
+	}
+
+	for ch, resultChan := range results {
+		resultChan := resultChan
+		if _, err = b.Subscribe(ch, func(payload payloads.Payload) {
+			var d testPayloadData
+			if err := payload.DecodeMessage(&d); err != nil {
+				t.Errorf("Decode payload failed: %v", err)
+				return
+			}
+			resultChan <- d
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ch, interval := range map[string]time.Duration{fast: 200 * time.Millisecond, slow: 500 * time.Millisecond} {
+		var pl payloads.Payload
+		if pl, err = payloads.NewPayload(testPayloadData{ch}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.BroadcastWithOptions(ch, pl, BroadcastOptions{Interval: interval}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ch, resultChan := range results {
+		select {
+		case v := <-resultChan:
+			if v.FullName != ch {
+				t.Fatalf("Unexpected return value on %v: %v", ch, v)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Received no messages on %v", ch)
+		}
+	}
+
+	if err := b.StopBroadcast(slow); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StopBroadcast(slow); err != ErrNotBroadcasting {
+		t.Fatalf("Expected ErrNotBroadcasting, got: %v", err)
+	}
+
+	// Drain anything sent before the stop
+	time.Sleep(time.Second)
+	for len(results[slow]) > 0 {
+		<-results[slow]
+	}
+	for len(results[fast]) > 0 {
+		<-results[fast]
+	}
+
+	select {
+	case v := <-results[fast]:
+		if v.FullName != fast {
+			t.Fatalf("Unexpected return value: %v", v)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Broadcast stopped with another filter")
+	}
+
+	select {
+	case v := <-results[slow]:
+		t.Fatalf("Broadcast continued after stop: %v", v)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestBeaconClientBroadcastReplace(t *testing.T) {
+	var b Client
+	var err error
+
+	if b, err = NewClient("beacon://0.0.0.0:9997?interval=1", encoding.JSON); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	ch := "tcftestbeaconreplace"
+	resultChan := make(chan testPayloadData, 20)
+	if _, err = b.Subscribe(ch, func(payload payloads.Payload) {
+		var d testPayloadData
+		if err := payload.DecodeMessage(&d); err != nil {
+			t.Errorf("Decode payload failed: %v", err)
+			return
+		}
+		resultChan <- d
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	broadcast := func(name string) {
+		pl, err := payloads.NewPayload(testPayloadData{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.Broadcast(ch, pl, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Broadcasting again on a channel replaces its payload
+	broadcast("first")
+	broadcast("second")
+
+	select {
+	case v := <-resultChan:
+		if v.FullName != "second" {
+			t.Fatalf("Expected the replaced payload, got: %v", v)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Received no messages")
+	}
+
+	// A nil payload stops the broadcast
+	if err = b.Broadcast(ch, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.StopBroadcast(ch); err != ErrNotBroadcasting {
+		t.Fatalf("Expected ErrNotBroadcasting, got: %v", err)
+	}
+}
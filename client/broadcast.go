@@ -0,0 +1,186 @@
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/cron"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+var (
+	ErrAlreadyBroadcasting = errors.New("Filter already broadcasting, stop first")
+	ErrNotBroadcasting     = errors.New("Filter not broadcasting")
+	ErrNoBroadcastSchedule = errors.New("Broadcast needs an interval or a cron expression")
+
+	ErrBroadcastOptionsNotSupported = errors.New("Broadcast options are not supported by this transport")
+)
+
+// PayloadGenerator creates the payload for each broadcast
+type PayloadGenerator func() (payloads.Payload, error)
+
+// BroadcastOptions configures when a broadcast is sent and what it sends
+type BroadcastOptions struct {
+	// Interval is the time between broadcasts
+	Interval time.Duration
+	// Cron is a cron expression, see the cron package, it is used instead of the interval if set
+	Cron string
+	// Jitter delays each broadcast by a random duration up to it, so a cluster does not send in lockstep
+	Jitter time.Duration
+	// Generate creates a fresh payload for each broadcast, the payload passed to the broadcast is
+	// ignored if it is set
+	Generate PayloadGenerator
+}
+
+// nextBroadcast returns when the broadcast after now is due
+type nextBroadcast func(now time.Time) time.Time
+
+func (o BroadcastOptions) schedule() (nextBroadcast, error) {
+	var next nextBroadcast
+	switch {
+	case o.Cron != "":
+		c, err := cron.Parse(o.Cron)
+		if err != nil {
+			return nil, err
+		}
+		next = c.Next
+	case o.Interval > 0:
+		next = func(now time.Time) time.Time {
+			return now.Add(o.Interval)
+		}
+	default:
+		return nil, ErrNoBroadcastSchedule
+	}
+
+	if o.Jitter <= 0 {
+		return next, nil
+	}
+
+	return func(now time.Time) time.Time {
+		at := next(now)
+		if at.IsZero() {
+			return at
+		}
+		return at.Add(time.Duration(rand.Int63n(int64(o.Jitter))))
+	}, nil
+}
+
+// broadcasts runs the broadcasts of a client, it is safe for concurrent use
+type broadcasts struct {
+	mu    sync.Mutex
+	stops map[string]chan struct{}
+}
+
+// Start broadcasts on a filter with publish until the filter is stopped
+func (b *broadcasts) Start(filter string, payload payloads.Payload, opts BroadcastOptions, publish func(string, payloads.Payload) error, logger logging.Logger, prefix string) error {
+	next, err := opts.schedule()
+	if err != nil {
+		return err
+	}
+
+	generate := opts.Generate
+	if generate == nil {
+		generate = func() (payloads.Payload, error) {
+			return payload, nil
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, found := b.stops[filter]; found {
+		return ErrAlreadyBroadcasting
+	}
+
+	if b.stops == nil {
+		b.stops = make(map[string]chan struct{})
+	}
+	stop := make(chan struct{})
+	b.stops[filter] = stop
+
+	log := logger.WithFields(logrus.Fields{"prefix": prefix})
+
+	go func() {
+		var last time.Time
+		for {
+			from := time.Now()
+			if from.Before(last) {
+				from = last
+			}
+
+			at := next(from)
+			if at.IsZero() {
+				log.Warning("Broadcast schedule never fires again, stopping: ", filter)
+				b.remove(filter, stop)
+				return
+			}
+			if !at.After(last) {
+				log.Error("Broadcast schedule went back in time, stopping: ", filter)
+				b.remove(filter, stop)
+				return
+			}
+			last = at
+
+			timer := time.NewTimer(time.Until(at))
+			select {
+			case <-stop:
+				timer.Stop()
+				log.Info("Stopping broadcast on: ", filter)
+				return
+			case <-timer.C:
+			}
+
+			p, err := generate()
+			if err == nil {
+				log.Debug("Sending: ", p)
+				err = publish(filter, p)
+			}
+
+			if err != nil {
+				log.Error("Failed to broadcast: ", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the broadcast on a filter
+func (b *broadcasts) Stop(filter string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stop, found := b.stops[filter]
+	if !found {
+		return ErrNotBroadcasting
+	}
+
+	close(stop)
+	delete(b.stops, filter)
+	return nil
+}
+
+// remove forgets a broadcast that ended by itself, unless it was already replaced
+func (b *broadcasts) remove(filter string, stop chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stops[filter] == stop {
+		delete(b.stops, filter)
+	}
+}
+
+// StopAll stops every broadcast
+func (b *broadcasts) StopAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for filter, stop := range b.stops {
+		close(stop)
+		delete(b.stops, filter)
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+func TestBroadcasts(t *testing.T) {
+	var b broadcasts
+	var mu sync.Mutex
+	var sent []string
+
+	publish := func(topic string, p payloads.Payload) error {
+		mu.Lock()
+		sent = append(sent, p.GetHeader("tick"))
+		mu.Unlock()
+		return nil
+	}
+
+	sentCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent)
+	}
+
+	if err := b.Start("tcf.test.broadcast", nil, BroadcastOptions{}, publish, logging.Discard(), "tcf.test"); err != ErrNoBroadcastSchedule {
+		t.Fatalf("Expected ErrNoBroadcastSchedule, got: %v", err)
+	}
+
+	if err := b.Start("tcf.test.broadcast", nil, BroadcastOptions{Cron: "* * *"}, publish, logging.Discard(), "tcf.test"); err == nil {
+		t.Fatal("Starting with an invalid cron expression should fail")
+	}
+
+	n := 0
+	opts := BroadcastOptions{
+		Interval: 20 * time.Millisecond,
+		Jitter:   5 * time.Millisecond,
+		Generate: func() (payloads.Payload, error) {
+			n++
+			if n == 2 {
+				return nil, errors.New("generator failed")
+			}
+			p, err := payloads.NewPayload("tick")
+			if err != nil {
+				return nil, err
+			}
+			p.SetHeader("tick", strconv.Itoa(n))
+			return p, nil
+		},
+	}
+
+	if err := b.Start("tcf.test.broadcast", nil, opts, publish, logging.Discard(), "tcf.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Start("tcf.test.broadcast", nil, opts, publish, logging.Discard(), "tcf.test"); err != ErrAlreadyBroadcasting {
+		t.Fatalf("Expected ErrAlreadyBroadcasting, got: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := b.Stop("tcf.test.broadcast"); err != nil {
+		t.Fatal(err)
+	}
+
+	stoppedAt := sentCount()
+	if stoppedAt < 3 {
+		t.Fatalf("Expected at least 3 broadcasts, got: %v", stoppedAt)
+	}
+
+	// Every broadcast is freshly generated, the failed second one is skipped
+	mu.Lock()
+	if sent[0] != "1" || sent[1] != "3" {
+		t.Fatalf("Unexpected broadcasts: %v", sent)
+	}
+	mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	if c := sentCount(); c != stoppedAt {
+		t.Fatalf("Broadcast continued after stop: %v", c)
+	}
+
+	if err := b.Stop("tcf.test.broadcast"); err != ErrNotBroadcasting {
+		t.Fatalf("Expected ErrNotBroadcasting, got: %v", err)
+	}
+
+	// A stopped filter can be broadcast on again
+	if err := b.Start("tcf.test.broadcast", nil, opts, publish, logging.Discard(), "tcf.test"); err != nil {
+		t.Fatal(err)
+	}
+	b.StopAll()
+}
@@ -5,6 +5,8 @@ import (
 	"github.com/TykTechnologies/logrus"
 	"github.com/satori/go.uuid"
 	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/middleware"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
 	"net/url"
 	"strconv"
@@ -15,22 +17,38 @@ import (
 type Client interface {
 	Connect() error
 	Publish(string, payloads.Payload) error
+	PublishWithOptions(string, payloads.Payload, PublishOptions) error
+	PublishWithAck(string, payloads.Payload, AckOptions) (DeliveryReport, error)
+	SendTo(string, string, payloads.Payload) error
 	Subscribe(string, PayloadHandler) (chan string, error)
+	SubscribeWithOptions(string, PayloadHandler, SubscribeOptions) (chan string, error)
 	Broadcast(string, payloads.Payload, int) error
+	BroadcastWithOptions(string, payloads.Payload, BroadcastOptions) error
 	StopBroadcast(string) error
 	SetEncoding(encoding.Encoding) error
 	Init(interface{}) error
 	Stop() error
 	SetConnectionDropHook(func() error) error
+	SetLogger(logging.Logger)
+	SetErrorHandler(func(error))
 	GetID() string
+	Use(...middleware.InboundMiddleware)
+	UseOutbound(...middleware.OutboundMiddleware)
 }
 
 // NewClient will create a new client object based on the enum provided, the object will be pre-configured
 // with the defaults needed and any custom configurations passed in for the type.
-// For `beacon`, it is possible to set an `?interval=time_in_ms` option to set the broadcast interval.
+// For `redis`, it is possible to set a `?min_receivers=n` option so that a publish returns an error if
+// fewer than n subscribers received the message.
+// For `beacon`, it is possible to set an `?interval=seconds` option to set the interval of broadcasts that do not set one.
+// `?interface=eth0,eth1` selects the interfaces to beacon on, `?bind=address` the address to send from,
+// `?ipv6=true` switches to IPv6, and `?group=address` and `?ttl=n` set the multicast group and TTL.
 // For `mangos`, it is possible to set an `?disable_publisher` boolean that stops the client from creating
 // a publishing channel, this is useful for servers that run their own clients to subscribe to themselves.
-// Should be used in conjunction with the `disable_loopback` option in the server.
+// Should be used in conjunction with the `disable_loopback` option in the server. A `?token=` option sets the
+// token the client presents to a server with access control enabled. A list of federated servers can be
+// given as `mangos://host1:9100,host2:9100`, the client fails over to the next server when it loses its
+// connection.
 func NewClient(connectionString string, baselineEncoding encoding.Encoding) (Client, error) {
 	parts := strings.Split(connectionString, "://")
 	if len(parts) < 2 {
@@ -45,8 +63,21 @@ func NewClient(connectionString string, baselineEncoding encoding.Encoding) (Cli
 		log.WithFields(logrus.Fields{
 			"prefix": "tcf",
 		}).Info("Using Redis back-end")
+		URL, err := url.Parse(connectionString)
+		if err != nil {
+			return nil, err
+		}
+
+		var minReceivers int
+		if asStr := URL.Query().Get("min_receivers"); asStr != "" {
+			if minReceivers, err = strconv.Atoi(asStr); err != nil {
+				return nil, err
+			}
+		}
+
 		c := &RedisClient{
 			URL: connectionString,
+			MinReceivers: minReceivers,
 			id: id,
 		}
 		c.SetEncoding(baselineEncoding)
@@ -82,6 +113,25 @@ func NewClient(connectionString string, baselineEncoding encoding.Encoding) (Cli
 			return nil, portConvErr
 		}
 
+		var interfaces []string
+		if asStr := URL.Query().Get("interface"); asStr != "" {
+			interfaces = strings.Split(asStr, ",")
+		}
+
+		var ipv6 bool
+		if asStr := URL.Query().Get("ipv6"); asStr != "" {
+			if ipv6, err = strconv.ParseBool(asStr); err != nil {
+				return nil, err
+			}
+		}
+
+		var ttl int
+		if asStr := URL.Query().Get("ttl"); asStr != "" {
+			if ttl, err = strconv.Atoi(asStr); err != nil {
+				return nil, err
+			}
+		}
+
 		log.WithFields(logrus.Fields{
 			"prefix": "tcf",
 		}).Debugf("Port is: %v\n", parts[1])
@@ -90,8 +140,13 @@ func NewClient(connectionString string, baselineEncoding encoding.Encoding) (Cli
 		}).Debugf("Interval is: %v\n", asInt)
 
 		c := &BeaconClient{
-			Port:     portAsInt,
-			Interval: asInt,
+			Port:        portAsInt,
+			Interval:    asInt,
+			Interfaces:  interfaces,
+			BindAddress: URL.Query().Get("bind"),
+			IPv6:        ipv6,
+			Group:       URL.Query().Get("group"),
+			TTL:         ttl,
 			id: id,
 		}
 		c.SetEncoding(baselineEncoding)
@@ -108,11 +163,15 @@ func NewClient(connectionString string, baselineEncoding encoding.Encoding) (Cli
 			return nil, err
 		}
 
-		parts := strings.Split(URL.Host, ":")
-		if len(parts) < 2 {
-			return nil, errors.New("No port specified")
+		var servers []string
+		for _, host := range strings.Split(URL.Host, ",") {
+			parts := strings.Split(host, ":")
+			if len(parts) < 2 {
+				return nil, errors.New("No port specified")
+			}
+			servers = append(servers, "tcp://"+host)
 		}
-		url := "tcp://" + URL.Host
+		url := servers[0]
 		log.WithFields(logrus.Fields{
 			"prefix": "tcf",
 		}).Info("Connecting to: ", url)
@@ -121,7 +180,9 @@ func NewClient(connectionString string, baselineEncoding encoding.Encoding) (Cli
 
 		c := &MangosClient{
 			URL:              url,
+			Servers:          servers,
 			disablePublisher: disablePublisher != "",
+			authToken:        URL.Query().Get("token"),
 			id: id,
 		}
 
@@ -2,39 +2,209 @@ package client
 
 import (
 	"fmt"
+	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+	"github.com/TykTechnologies/tyk-cluster-framework/middleware"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/TykTechnologies/tyk-cluster-framework/pool"
+	"github.com/TykTechnologies/tyk-cluster-framework/tracing"
+	"time"
 )
 
 // ClientHandler provides helper functions and wrappers to decode a raw message into a payload object
-// to pass onto a payload handler
-type ClientHandler struct{}
+// to pass onto a payload handler, it also holds the middleware chain of the client.
+type ClientHandler struct {
+	middleware  *middleware.Chain
+	transport   string
+	logger      logging.Logger
+	onError     func(error)
+	delivery    *deliveryState
+	deadLetters DeadLetterSink
+}
 
 // HandleRawMessage will take the raw data, payload handler and encoding.Encoding, decode the value,
-// pass it to the handler and return an error if there was a problem
-func (c ClientHandler) HandleRawMessage(rawMessage interface{}, payloadHandler PayloadHandler, enc encoding.Encoding) error {
+// pass it to the handler and return an error if there was a problem. Failed messages are sent to the
+// dead letter sink.
+func (c ClientHandler) HandleRawMessage(rawMessage interface{}, payloadHandler PayloadHandler, enc encoding.Encoding) (err error) {
 	// First, decode the message based on it's type and encoding.Encoding
 	asPayload, err := c.GetPayload(rawMessage, enc)
 	if err != nil {
+		c.deadLetter("", rawMessage, err, 1)
 		return err
 	}
 
-	// Call the registered handler
-	payloadHandler(asPayload)
+	defer func() {
+		if r := recover(); r != nil {
+			failed := handlerFailure(r)
+			c.deadLetter(asPayload.GetTopic(), rawMessage, failed.Err, failed.Attempts)
+			err = failed
+		}
+	}()
+
+	c.HandlePayload(asPayload, payloadHandler)
 	return nil
 }
 
+// DispatchRawMessage decodes the raw message and queues the handler call on the worker pool of the
+// subscription, decoding errors and ErrDropped are returned straight away
+func (c ClientHandler) DispatchRawMessage(filter string, rawMessage interface{}, payloadHandler PayloadHandler, enc encoding.Encoding, workers *pool.WorkerPool) error {
+	asPayload, err := c.DecodeReceived(filter, rawMessage, enc)
+	if err != nil {
+		return err
+	}
+
+	return c.DispatchPayload(filter, rawMessage, asPayload, payloadHandler, workers)
+}
+
+// DecodeReceived counts a received message and decodes it, messages that fail are sent to the dead
+// letter sink
+func (c ClientHandler) DecodeReceived(filter string, rawMessage interface{}, enc encoding.Encoding) (payloads.Payload, error) {
+	metrics.IncrCounter(metrics.KeyReceived, 1, metrics.Transport(c.transport), metrics.Topic(filter))
+
+	asPayload, err := c.GetPayload(rawMessage, enc)
+	if err != nil {
+		c.deadLetter(filter, rawMessage, err, 1)
+	}
+	return asPayload, err
+}
+
+// DispatchPayload queues the handler call for a decoded payload on the worker pool of the subscription,
+// the raw message is sent to the dead letter sink if the handler fails. Messages acknowledged on receipt
+// are acknowledged once they are queued, so a busy pool does not hold up their publisher.
+func (c ClientHandler) DispatchPayload(filter string, rawMessage interface{}, asPayload payloads.Payload, payloadHandler PayloadHandler, workers *pool.WorkerPool) error {
+	labels := []metrics.Label{metrics.Transport(c.transport), metrics.Topic(filter)}
+	err := workers.Submit(func() {
+		defer c.deadLetterOnPanic(filter, rawMessage)
+
+		start := time.Now()
+		c.handlePayload(asPayload, payloadHandler, false)
+		metrics.MeasureSince(metrics.KeyHandlerLatency, start, labels...)
+	})
+
+	if err == nil && c.delivery != nil && onReceipt(asPayload) {
+		c.delivery.ack(asPayload)
+	}
+	return err
+}
+
+// HandlePayload will call the registered handler with an already decoded payload through the middleware,
+// the call is wrapped in a consumer span that continues the trace of the publisher
+func (c ClientHandler) HandlePayload(payload payloads.Payload, payloadHandler PayloadHandler) {
+	c.handlePayload(payload, payloadHandler, true)
+}
+
+// handlePayload handles a payload, ackReceipt is false if a message acknowledged on receipt was
+// acknowledged when it was queued
+func (c ClientHandler) handlePayload(payload payloads.Payload, payloadHandler PayloadHandler, ackReceipt bool) {
+	// Messages published with acks are handled once and acknowledged after the handler returns, a
+	// failed message is not acknowledged so the publisher sends it again. Directed messages are
+	// acknowledged on receipt.
+	if c.delivery != nil {
+		if !c.delivery.begin(payload, ackReceipt) {
+			return
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				c.delivery.abort(payload)
+				panic(r)
+			}
+		}()
+	}
+
+	handler := c.middleware.WrapInbound(middleware.InboundHandler(payloadHandler))
+	tracing.Inbound(c.transport)(handler)(payload)
+
+	if c.delivery != nil {
+		c.delivery.done(payload)
+	}
+}
+
 // GetPayload will extract the payload object from the message
 func (c ClientHandler) GetPayload(rawMessage interface{}, enc encoding.Encoding) (payloads.Payload, error) {
 	msgHandler := NewMessageHandler()
 	asPayload, err := msgHandler.HandleRawMessage(rawMessage, enc)
 	if err != nil {
+		metrics.IncrCounter(metrics.KeyDecodeFailed, 1, metrics.Transport(c.transport))
 		return nil, err
 	}
 
 	if err = asPayload.Verify(); err != nil {
+		metrics.IncrCounter(metrics.KeyVerifyFailed, 1, metrics.Transport(c.transport), metrics.Topic(asPayload.GetTopic()))
 		return nil, fmt.Errorf("Payload verification failed: %v", err)
 	}
 
 	return asPayload, nil
-}
\ No newline at end of file
+}
+
+// SetTransport sets the name of the transport, it is used to label metrics
+func (c *ClientHandler) SetTransport(name string) {
+	c.transport = name
+}
+
+// Transport returns the name of the transport
+func (c ClientHandler) Transport() string {
+	return c.transport
+}
+
+// SetLogger sets the logger of the client, it should be called before the client connects
+func (c *ClientHandler) SetLogger(l logging.Logger) {
+	c.logger = l
+}
+
+// Log returns the logger of the client, or the default logger if none was set
+func (c ClientHandler) Log() logging.Logger {
+	return logging.OrDefault(c.logger)
+}
+
+// SetErrorHandler sets a callback for errors that stop the client from receiving, for example when
+// a listener fails. It should be called before the client connects.
+func (c *ClientHandler) SetErrorHandler(fn func(error)) {
+	c.onError = fn
+}
+
+// ReportError logs an error that happened outside of a call into the client and passes it to the
+// error handler
+func (c ClientHandler) ReportError(err error) {
+	c.Log().WithFields(logrus.Fields{
+		"prefix":    "tcf.client",
+		"transport": c.transport,
+	}).Error(err)
+
+	if c.onError != nil {
+		c.onError(err)
+	}
+}
+
+// Use adds inbound middleware, it wraps every payload handler of the client
+func (c *ClientHandler) Use(m ...middleware.InboundMiddleware) {
+	if c.middleware == nil {
+		c.middleware = middleware.NewChain()
+	}
+	c.middleware.Use(m...)
+}
+
+// UseOutbound adds outbound middleware, it wraps every publish of the client
+func (c *ClientHandler) UseOutbound(m ...middleware.OutboundMiddleware) {
+	if c.middleware == nil {
+		c.middleware = middleware.NewChain()
+	}
+	c.middleware.UseOutbound(m...)
+}
+
+// WrapOutbound wraps the send function of a client with the outbound middleware, published
+// messages and failures are counted and the trace context is injected into the payload
+func (c ClientHandler) WrapOutbound(send middleware.OutboundHandler) middleware.OutboundHandler {
+	return tracing.Outbound(c.transport)(c.middleware.WrapOutbound(func(topic string, payload payloads.Payload) error {
+		err := send(topic, payload)
+		if err != nil {
+			metrics.IncrCounter(metrics.KeyPublishFailed, 1, metrics.Transport(c.transport), metrics.Topic(topic))
+			return err
+		}
+
+		metrics.IncrCounter(metrics.KeyPublished, 1, metrics.Transport(c.transport), metrics.Topic(topic))
+		return nil
+	}))
+}
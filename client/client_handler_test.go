@@ -2,9 +2,18 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
 	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+	"github.com/TykTechnologies/tyk-cluster-framework/middleware"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/TykTechnologies/tyk-cluster-framework/pool"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHandleRawMessage(t *testing.T) {
@@ -39,3 +48,409 @@ func TestHandleRawMessage(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDispatchRawMessage(t *testing.T) {
+	sink := metrics.NewInmemSink()
+	metrics.SetSink(sink)
+	defer metrics.SetSink(nil)
+
+	ch := ClientHandler{}
+	ch.SetTransport("test")
+	workers := pool.New(pool.Options{Ordered: true})
+
+	pl, err := payloads.NewPayload(testPayloadData{FullName: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asByte, err := json.Marshal(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resultChan := make(chan testPayloadData, 1)
+	ph := func(p payloads.Payload) {
+		var d testPayloadData
+		if decErr := p.DecodeMessage(&d); decErr != nil {
+			t.Fatalf("Decode payload failed: %v was: %v", decErr, p)
+		}
+		resultChan <- d
+	}
+
+	if err := ch.DispatchRawMessage("tcf.test.dispatch", asByte, ph, encoding.JSON, workers); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ch.DispatchRawMessage("tcf.test.dispatch", []byte("not a payload"), ph, encoding.JSON, workers); err == nil {
+		t.Fatal("Dispatching an invalid message should fail")
+	}
+
+	select {
+	case d := <-resultChan:
+		if d.FullName != "foo" {
+			t.Fatalf("Value incorrect: %v\n", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for handler")
+	}
+	workers.Stop()
+
+	if v := sink.Counter(metrics.KeyReceived, metrics.Transport("test"), metrics.Topic("tcf.test.dispatch")); v != 2 {
+		t.Fatalf("Expected 2 received messages, got: %v", v)
+	}
+
+	if v := sink.Counter(metrics.KeyDecodeFailed, metrics.Transport("test")); v != 1 {
+		t.Fatalf("Expected 1 decode failure, got: %v", v)
+	}
+
+	if v := sink.Sample(metrics.KeyHandlerLatency, metrics.Transport("test"), metrics.Topic("tcf.test.dispatch")); v.Count != 1 {
+		t.Fatalf("Expected 1 handler latency sample, got: %v", v.Count)
+	}
+}
+
+func TestReportError(t *testing.T) {
+	ch := ClientHandler{}
+	ch.SetLogger(logging.Discard())
+
+	var reported error
+	ch.SetErrorHandler(func(err error) {
+		reported = err
+	})
+
+	listenErr := errors.New("listener failed")
+	ch.ReportError(listenErr)
+
+	if reported != listenErr {
+		t.Fatalf("Error handler not called, got: %v", reported)
+	}
+}
+
+// testBus delivers payloads between client handlers in memory, drop decides if a delivery is lost
+type testBus struct {
+	mu       sync.Mutex
+	handlers map[string]map[*ClientHandler]PayloadHandler
+	drop     func(topic string, to *ClientHandler) bool
+}
+
+func (b *testBus) client(id string) *ClientHandler {
+	c := &ClientHandler{}
+	c.enableDelivery(func() string { return id }, func(topic string, p payloads.Payload) error {
+		b.mu.Lock()
+		var targets []*ClientHandler
+		var handlers []PayloadHandler
+		for to, h := range b.handlers[topic] {
+			if b.drop == nil || !b.drop(topic, to) {
+				targets = append(targets, to)
+				handlers = append(handlers, h)
+			}
+		}
+		b.mu.Unlock()
+
+		for i, to := range targets {
+			go to.HandlePayload(p.Copy(), handlers[i])
+		}
+		return nil
+	}, func(topic string, h PayloadHandler) (chan string, error) {
+		b.subscribe(c, topic, h)
+		return nil, nil
+	})
+	return c
+}
+
+func (b *testBus) subscribe(c *ClientHandler, topic string, h PayloadHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.handlers[topic] == nil {
+		b.handlers[topic] = make(map[*ClientHandler]PayloadHandler)
+	}
+	b.handlers[topic][c] = h
+}
+
+func TestPublishWithAck(t *testing.T) {
+	bus := &testBus{handlers: make(map[string]map[*ClientHandler]PayloadHandler)}
+	publisher := bus.client("pub")
+	s1, s2 := bus.client("s1"), bus.client("s2")
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	for id, s := range map[string]*ClientHandler{"s1": s1, "s2": s2} {
+		id := id
+		bus.subscribe(s, "tcf.test.ack", func(p payloads.Payload) {
+			mu.Lock()
+			calls[id]++
+			mu.Unlock()
+		})
+	}
+
+	// The first delivery to s2 is lost
+	dropped := false
+	bus.drop = func(topic string, to *ClientHandler) bool {
+		if topic == "tcf.test.ack" && to == s2 && !dropped {
+			dropped = true
+			return true
+		}
+		return false
+	}
+
+	p, _ := payloads.NewPayload(testPayloadData{FullName: "revoke"})
+	report, err := publisher.PublishWithAck("tcf.test.ack", p, AckOptions{
+		Timeout:       2 * time.Second,
+		RetryInterval: 50 * time.Millisecond,
+		Expect:        []string{"s1", "s2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Acked) != 2 || report.Acked[0] != "s1" || report.Acked[1] != "s2" || len(report.Missing) != 0 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	if report.Attempts < 2 {
+		t.Fatalf("Lost delivery should have been retried: %+v", report)
+	}
+
+	if p.GetHeader(payloads.HeaderMessageID) != "" {
+		t.Fatal("The payload of the caller should not be changed")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if calls["s1"] != 1 || calls["s2"] != 1 {
+		t.Fatalf("Each subscriber should handle the message once: %v", calls)
+	}
+	mu.Unlock()
+
+	p, _ = payloads.NewPayload(testPayloadData{FullName: "revoke"})
+	report, err = publisher.PublishWithAck("tcf.test.ack", p, AckOptions{
+		Timeout:       200 * time.Millisecond,
+		RetryInterval: 50 * time.Millisecond,
+		Expect:        []string{"s1", "s3"},
+	})
+	if err != ErrAckTimeout {
+		t.Fatalf("Expected timeout, got: %v", err)
+	}
+
+	if len(report.Missing) != 1 || report.Missing[0] != "s3" {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	if _, err = (&ClientHandler{}).PublishWithAck("tcf.test.ack", p, DefaultAckOptions()); err != ErrAckNotSupported {
+		t.Fatalf("Expected ErrAckNotSupported, got: %v", err)
+	}
+}
+
+func TestSendTo(t *testing.T) {
+	bus := &testBus{handlers: make(map[string]map[*ClientHandler]PayloadHandler)}
+	sender, target := bus.client("sender"), bus.client("target")
+
+	received := make(chan payloads.Payload, 1)
+	bus.subscribe(target, InboxTopic("target", "tcf.test.direct"), func(p payloads.Payload) {
+		received <- p
+	})
+
+	opts := AckOptions{Timeout: 200 * time.Millisecond, RetryInterval: 50 * time.Millisecond}
+	p, _ := payloads.NewPayload(testPayloadData{FullName: "direct"})
+	if err := sender.sendToWithAck("target", "tcf.test.direct", p, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-received:
+	default:
+		t.Fatal("Directed message not handled")
+	}
+
+	// A node acknowledges on receipt, a handler slower than the timeout is not resent
+	var slowCalls int32
+	bus.subscribe(target, InboxTopic("target", "tcf.test.slow"), func(p payloads.Payload) {
+		atomic.AddInt32(&slowCalls, 1)
+		time.Sleep(400 * time.Millisecond)
+	})
+
+	p, _ = payloads.NewPayload(testPayloadData{FullName: "slow"})
+	if err := sender.sendToWithAck("target", "tcf.test.slow", p, opts); err != nil {
+		t.Fatal(err)
+	}
+	if p.GetHeader(payloads.HeaderAckOnReceipt) != "" {
+		t.Fatal("Sending should not change the payload")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if c := atomic.LoadInt32(&slowCalls); c != 1 {
+		t.Fatalf("Expected the slow handler to be called once, got: %v", c)
+	}
+
+	p, _ = payloads.NewPayload(testPayloadData{FullName: "direct"})
+	if err := sender.sendToWithAck("gone", "tcf.test.direct", p, opts); err != ErrNodeTimeout {
+		t.Fatalf("Expected ErrNodeTimeout, got: %v", err)
+	}
+
+	// The server reports nodes it cannot deliver to straight away
+	server := bus.client("server")
+	for node, expect := range map[string]error{"unknown": ErrUnknownNode, "unsubscribed": ErrNodeNotSubscribed} {
+		reason := control.ReasonUnknownNode
+		if expect == ErrNodeNotSubscribed {
+			reason = control.ReasonNotSubscribed
+		}
+
+		node := node
+		bus.subscribe(server, InboxTopic(node, "tcf.test.direct"), func(p payloads.Payload) {
+			ack, _ := payloads.NewPayload(control.Undeliverable{
+				MessageID:    p.GetHeader(payloads.HeaderMessageID),
+				SubscriberID: node,
+				Reason:       reason,
+			})
+			server.delivery.publish(p.GetHeader(payloads.HeaderAckTo), ack)
+		})
+
+		start := time.Now()
+		if err := sender.sendToWithAck(node, "tcf.test.direct", p, opts); err != expect {
+			t.Fatalf("Expected %v, got: %v", expect, err)
+		}
+		if time.Since(start) >= opts.Timeout {
+			t.Fatal("An undeliverable message should not wait for the timeout")
+		}
+	}
+
+	// Receipts are acknowledged once the message is queued, not when a busy pool gets to it
+	acks := make(chan payloads.Payload, 1)
+	bus.subscribe(sender, "tcf.ack.receipt", func(p payloads.Payload) {
+		acks <- p
+	})
+
+	block := make(chan struct{})
+	workers := pool.New(pool.Options{Ordered: true})
+	defer workers.Stop()
+	workers.Submit(func() { <-block })
+	defer close(block)
+
+	p, _ = payloads.NewPayload(testPayloadData{FullName: "queued"})
+	p.SetHeader(payloads.HeaderMessageID, "queued")
+	p.SetHeader(payloads.HeaderAckTo, "tcf.ack.receipt")
+	p.SetHeader(payloads.HeaderAckOnReceipt, "1")
+	if err := target.DispatchPayload("tcf.test.direct", nil, p, func(payloads.Payload) {}, workers); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-acks:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the receipt to be acknowledged while the pool is busy")
+	}
+
+	node, topic, ok := ParseInboxTopic(InboxTopic("target", "tcf.test.direct"))
+	if !ok || node != "target" || topic != "tcf.test.direct" {
+		t.Fatalf("Unexpected inbox: %v %v", node, topic)
+	}
+	if _, _, ok = ParseInboxTopic("tcf.test.direct"); ok {
+		t.Fatal("Expected a plain topic not to parse as an inbox")
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	ch := ClientHandler{}
+	ch.SetLogger(logging.Discard())
+	letters := make(chan DeadLetter, 2)
+	ch.SetDeadLetterSink(DeadLetterFunc(func(l DeadLetter) error {
+		letters <- l
+		return nil
+	}))
+
+	pl, err := payloads.NewPayload(testPayloadData{FullName: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asByte, err := json.Marshal(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workers := pool.New(pool.Options{Ordered: true, OnError: func(error) {}})
+	defer workers.Stop()
+
+	t.Run("Undecodable message", func(t *testing.T) {
+		if err := ch.DispatchRawMessage("tcf.test.deadletter", []byte("not a payload"), func(payloads.Payload) {}, encoding.JSON, workers); err == nil {
+			t.Fatal("Dispatching an invalid message should fail")
+		}
+
+		l := <-letters
+		if l.Topic != "tcf.test.deadletter" || string(l.Raw) != "not a payload" || l.Attempts != 1 || l.Reason == "" {
+			t.Fatalf("Unexpected dead letter: %+v", l)
+		}
+	})
+
+	t.Run("Retries exhausted", func(t *testing.T) {
+		calls := 0
+		handler := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}.wrap(HandlerWithError(func(payloads.Payload) error {
+			calls++
+			return errors.New("handler failed")
+		}))
+
+		if err := ch.DispatchRawMessage("tcf.test.deadletter", asByte, handler, encoding.JSON, workers); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case l := <-letters:
+			if l.Attempts != 3 || l.Reason != "handler failed" || string(l.Raw) != string(asByte) {
+				t.Fatalf("Unexpected dead letter: %+v", l)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for dead letter")
+		}
+
+		if calls != 3 {
+			t.Fatalf("Expected 3 calls, got: %v", calls)
+		}
+	})
+
+	t.Run("Retry succeeds", func(t *testing.T) {
+		calls := 0
+		handler := RetryPolicy{MaxAttempts: 3}.wrap(func(payloads.Payload) {
+			calls++
+			if calls == 1 {
+				panic("boom")
+			}
+		})
+
+		if err := ch.HandleRawMessage(asByte, handler, encoding.JSON); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != 2 || len(letters) != 0 {
+			t.Fatalf("Expected a successful retry, got %v calls and %v dead letters", calls, len(letters))
+		}
+	})
+
+	t.Run("Handler error behind recovery", func(t *testing.T) {
+		recovering := ch
+		recovering.Use(middleware.InboundRecovery(nil))
+
+		handler := RetryPolicy{MaxAttempts: 2}.wrap(HandlerWithError(func(payloads.Payload) error {
+			return errors.New("handler failed")
+		}))
+
+		err := recovering.HandleRawMessage(asByte, handler, encoding.JSON)
+		if failed, ok := err.(*HandlerError); !ok || failed.Attempts != 2 {
+			t.Fatalf("Expected the handler error to pass the recovery, got: %v", err)
+		}
+
+		l := <-letters
+		if l.Attempts != 2 || l.Reason != "handler failed" {
+			t.Fatalf("Unexpected dead letter: %+v", l)
+		}
+	})
+
+	t.Run("Panic without retries", func(t *testing.T) {
+		err := ch.HandleRawMessage(asByte, func(payloads.Payload) { panic("boom") }, encoding.JSON)
+		if _, ok := err.(*HandlerError); !ok {
+			t.Fatalf("Expected a handler error, got: %v", err)
+		}
+
+		l := <-letters
+		if l.Attempts != 1 || l.Reason != "Recovered from panic in handler: boom" {
+			t.Fatalf("Unexpected dead letter: %+v", l)
+		}
+	})
+}
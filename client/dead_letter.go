@@ -0,0 +1,139 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// DeadLetter is a message that could not be decoded, verified or handled
+type DeadLetter struct {
+	// Topic is the subscription the message was received on, it is empty if the message was handled
+	// without one and could not be decoded
+	Topic string
+	// Raw is the message as it was received
+	Raw      []byte
+	Reason   string
+	Attempts int
+	Time     time.Time
+}
+
+// DeadLetterSink receives the messages a client gave up on
+type DeadLetterSink interface {
+	DeadLetter(DeadLetter) error
+}
+
+// DeadLetterFunc is a callback that receives dead letters
+type DeadLetterFunc func(DeadLetter) error
+
+func (f DeadLetterFunc) DeadLetter(l DeadLetter) error {
+	return f(l)
+}
+
+// DeadLetterTopic publishes dead letters as payloads on a topic, the client may be the one the letters
+// come from
+type DeadLetterTopic struct {
+	Client Client
+	Topic  string
+}
+
+func (t DeadLetterTopic) DeadLetter(l DeadLetter) error {
+	p, err := payloads.NewPayload(l)
+	if err != nil {
+		return err
+	}
+	return t.Client.Publish(t.Topic, p)
+}
+
+// DeadLetterFile appends dead letters to a file, one JSON object per line
+type DeadLetterFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenDeadLetterFile opens or creates a file to append dead letters to
+func OpenDeadLetterFile(path string) (*DeadLetterFile, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open dead letter file: %s", err.Error())
+	}
+	return &DeadLetterFile{file: f}, nil
+}
+
+func (f *DeadLetterFile) DeadLetter(l DeadLetter) error {
+	line, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err = f.file.Write(append(line, '\n'))
+	return err
+}
+
+func (f *DeadLetterFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+// SetDeadLetterSink sets where messages go that fail to decode or verify, or whose handler still fails
+// after the attempts of the retry policy of the subscription. It should be called before subscribing.
+func (c *ClientHandler) SetDeadLetterSink(sink DeadLetterSink) {
+	c.deadLetters = sink
+}
+
+// deadLetter passes a failed message to the dead letter sink
+func (c ClientHandler) deadLetter(topic string, rawMessage interface{}, reason error, attempts int) {
+	if c.deadLetters == nil {
+		return
+	}
+
+	l := DeadLetter{
+		Topic:    topic,
+		Reason:   reason.Error(),
+		Attempts: attempts,
+		Time:     time.Now(),
+	}
+
+	switch raw := rawMessage.(type) {
+	case []byte:
+		l.Raw = raw
+	case string:
+		l.Raw = []byte(raw)
+	default:
+		l.Raw = []byte(fmt.Sprint(raw))
+	}
+
+	if err := c.deadLetters.DeadLetter(l); err != nil {
+		c.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.client",
+			"topic":  topic,
+		}).Error("Failed to send dead letter: ", err)
+		return
+	}
+
+	metrics.IncrCounter(metrics.KeyDeadLettered, 1, metrics.Transport(c.transport), metrics.Topic(topic))
+}
+
+// deadLetterOnPanic is deferred around a handler call, it sends the message to the dead letter sink
+// and carries on panicking so the worker pool reports the failure
+func (c ClientHandler) deadLetterOnPanic(topic string, rawMessage interface{}) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	failed := handlerFailure(r)
+	c.deadLetter(topic, rawMessage, failed.Err, failed.Attempts)
+	panic(r)
+}
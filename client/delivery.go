@@ -0,0 +1,370 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/satori/go.uuid"
+)
+
+var (
+	ErrAckNotSupported = errors.New("Acknowledgements are not supported by this transport")
+	ErrAckTimeout      = errors.New("Not all acknowledgements were received in time")
+)
+
+// AckTopicPrefix is the prefix of the topics clients receive acknowledgements on
+const AckTopicPrefix = "tcf.ack."
+
+// dedupeTTL is how long subscribers remember the IDs of handled messages, it must be longer than the
+// time a publisher keeps retrying
+var dedupeTTL = 10 * time.Minute
+
+// expireInterval is how often handled message IDs are checked for expiry
+var expireInterval = time.Minute
+
+// AckOptions configures an at-least-once publish
+type AckOptions struct {
+	// Timeout is how long the publisher waits for acknowledgements
+	Timeout time.Duration
+	// RetryInterval is how often the message is published again while acknowledgements are missing
+	RetryInterval time.Duration
+	// Expect are the IDs of the subscribers that must acknowledge the message
+	Expect []string
+	// MinAcks is the number of subscribers that must acknowledge the message
+	MinAcks int
+}
+
+// DefaultAckOptions waits for 5 seconds and retries every second
+func DefaultAckOptions() AckOptions {
+	return AckOptions{
+		Timeout:       5 * time.Second,
+		RetryInterval: time.Second,
+	}
+}
+
+// DeliveryReport lists the subscribers that acknowledged a message
+type DeliveryReport struct {
+	MessageID string
+	// Acked are the IDs of the subscribers that acknowledged the message, ordered
+	Acked []string
+	// Missing are the expected subscribers that did not acknowledge the message, ordered
+	Missing  []string
+	Attempts int
+}
+
+// Ack is sent by a subscriber once it handled a message
+type Ack struct {
+	MessageID    string
+	SubscriberID string
+	// Reason is set by a mangos server that cannot deliver the message to the subscriber
+	Reason string `json:",omitempty"`
+}
+
+// pendingDelivery collects the acks of a message, acked and refused are guarded by the delivery lock
+// and notify wakes up the publisher
+type pendingDelivery struct {
+	acked   map[string]bool
+	refused map[string]string
+	notify  chan struct{}
+}
+
+// deliveryState holds the pending deliveries of a publisher and the messages a subscriber handled
+type deliveryState struct {
+	mu        sync.Mutex
+	owner     *ClientHandler
+	id        func() string
+	publish   func(string, payloads.Payload) error
+	subscribe func(string, PayloadHandler) (chan string, error)
+
+	ackSubscribed bool
+	pending       map[string]*pendingDelivery
+	// handled maps message IDs to the time they were handled, a zero time means in progress
+	handled     map[string]time.Time
+	lastExpired time.Time
+}
+
+// enableDelivery turns on acknowledgements, the functions are those of the client that embeds the handler
+func (c *ClientHandler) enableDelivery(id func() string, publish func(string, payloads.Payload) error, subscribe func(string, PayloadHandler) (chan string, error)) {
+	c.delivery = &deliveryState{
+		owner:     c,
+		id:        id,
+		publish:   publish,
+		subscribe: subscribe,
+		pending:   make(map[string]*pendingDelivery),
+		handled:   make(map[string]time.Time),
+	}
+}
+
+// PublishWithAck publishes a payload at least once, it is published again every RetryInterval until the
+// expected subscribers acknowledged it or the timeout passes. Subscribers handle every message ID once.
+// Without Expect or MinAcks the payload is published once and acknowledgements are collected until the
+// timeout. ErrAckTimeout is returned with the report if acknowledgements are missing, ErrUnknownNode or
+// ErrNodeNotSubscribed as soon as the server reports that an expected subscriber cannot receive it.
+func (c *ClientHandler) PublishWithAck(filter string, payload payloads.Payload, opts AckOptions) (DeliveryReport, error) {
+	d := c.delivery
+	if d == nil {
+		return DeliveryReport{}, ErrAckNotSupported
+	}
+
+	if err := d.subscribeToAcks(); err != nil {
+		return DeliveryReport{}, err
+	}
+
+	// The headers are set on a copy, the caller may publish the payload again
+	report := DeliveryReport{MessageID: uuid.NewV4().String()}
+	payload = payload.Copy()
+	payload.SetHeader(payloads.HeaderMessageID, report.MessageID)
+	payload.SetHeader(payloads.HeaderAckTo, AckTopicPrefix+d.id())
+
+	p := &pendingDelivery{acked: make(map[string]bool), refused: make(map[string]string), notify: make(chan struct{}, 1)}
+	d.mu.Lock()
+	d.pending[report.MessageID] = p
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, report.MessageID)
+		d.mu.Unlock()
+	}()
+
+	retry := len(opts.Expect) > 0 || opts.MinAcks > 0
+	timeout := time.After(opts.Timeout)
+	var retryTicker <-chan time.Time
+
+	send := true
+	for {
+		if send {
+			send = false
+			report.Attempts++
+			if err := d.publish(filter, payload); err != nil {
+				return report, err
+			}
+			if retry && opts.RetryInterval > 0 {
+				retryTicker = time.After(opts.RetryInterval)
+			}
+		}
+
+		select {
+		case <-p.notify:
+			if !retry {
+				continue
+			}
+
+			d.mu.Lock()
+			complete := deliveryComplete(p.acked, opts)
+			refused := refusedExpected(p.refused, opts)
+			if complete || refused != nil {
+				report = completeReport(report, p.acked, opts)
+			}
+			d.mu.Unlock()
+
+			if refused != nil {
+				return report, refused
+			}
+			if complete {
+				return report, nil
+			}
+		case <-retryTicker:
+			send = true
+		case <-timeout:
+			d.mu.Lock()
+			complete := deliveryComplete(p.acked, opts)
+			report = completeReport(report, p.acked, opts)
+			d.mu.Unlock()
+
+			if retry && !complete {
+				return report, ErrAckTimeout
+			}
+			return report, nil
+		}
+	}
+}
+
+func deliveryComplete(acked map[string]bool, opts AckOptions) bool {
+	if len(acked) < opts.MinAcks {
+		return false
+	}
+
+	for _, id := range opts.Expect {
+		if !acked[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// refusedExpected returns the error for the first expected subscriber the server cannot deliver to
+func refusedExpected(refused map[string]string, opts AckOptions) error {
+	for _, id := range opts.Expect {
+		switch refused[id] {
+		case "":
+		case control.ReasonNotSubscribed:
+			return ErrNodeNotSubscribed
+		default:
+			return ErrUnknownNode
+		}
+	}
+	return nil
+}
+
+func completeReport(report DeliveryReport, acked map[string]bool, opts AckOptions) DeliveryReport {
+	report.Acked = make([]string, 0, len(acked))
+	for id := range acked {
+		report.Acked = append(report.Acked, id)
+	}
+	sort.Strings(report.Acked)
+
+	report.Missing = []string{}
+	for _, id := range opts.Expect {
+		if !acked[id] {
+			report.Missing = append(report.Missing, id)
+		}
+	}
+	sort.Strings(report.Missing)
+
+	return report
+}
+
+// subscribeToAcks subscribes to the ack topic of the client the first time it publishes with acks
+func (d *deliveryState) subscribeToAcks() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ackSubscribed {
+		return nil
+	}
+
+	if _, err := d.subscribe(AckTopicPrefix+d.id(), d.handleAck); err != nil {
+		return err
+	}
+
+	d.ackSubscribed = true
+	return nil
+}
+
+func (d *deliveryState) handleAck(payload payloads.Payload) {
+	var ack Ack
+	if err := payload.DecodeMessage(&ack); err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	p, found := d.pending[ack.MessageID]
+	if found && ack.Reason != "" {
+		p.refused[ack.SubscriberID] = ack.Reason
+	} else if found {
+		p.acked[ack.SubscriberID] = true
+	}
+	d.mu.Unlock()
+
+	if !found {
+		return
+	}
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// begin returns false if the message was handled before or is being handled, duplicates that were
+// handled are acknowledged again because the first ack may have been lost. Messages acknowledged on
+// receipt are acknowledged here unless ackReceipt is false, also while they are being handled.
+func (d *deliveryState) begin(payload payloads.Payload, ackReceipt bool) bool {
+	id := payload.GetHeader(payloads.HeaderMessageID)
+	if id == "" {
+		return true
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	handledAt, seen := d.handled[id]
+	if !seen {
+		d.handled[id] = time.Time{}
+		d.expire(now)
+	}
+	d.mu.Unlock()
+
+	if onReceipt(payload) {
+		if ackReceipt {
+			d.ack(payload)
+		}
+	} else if seen && !handledAt.IsZero() {
+		d.ack(payload)
+	}
+
+	return !seen
+}
+
+// done marks a message as handled and acknowledges it unless it was acknowledged on receipt
+func (d *deliveryState) done(payload payloads.Payload) {
+	id := payload.GetHeader(payloads.HeaderMessageID)
+	if id == "" {
+		return
+	}
+
+	d.mu.Lock()
+	d.handled[id] = time.Now()
+	d.mu.Unlock()
+
+	if !onReceipt(payload) {
+		d.ack(payload)
+	}
+}
+
+func onReceipt(payload payloads.Payload) bool {
+	return payload.GetHeader(payloads.HeaderAckOnReceipt) != ""
+}
+
+// abort forgets a message whose handler failed, so it is handled again when it is resent
+func (d *deliveryState) abort(payload payloads.Payload) {
+	id := payload.GetHeader(payloads.HeaderMessageID)
+	if id == "" {
+		return
+	}
+
+	d.mu.Lock()
+	delete(d.handled, id)
+	d.mu.Unlock()
+}
+
+// expire forgets handled messages after dedupeTTL, it must be called with the lock held
+func (d *deliveryState) expire(now time.Time) {
+	if now.Sub(d.lastExpired) < expireInterval {
+		return
+	}
+	d.lastExpired = now
+
+	for id, handledAt := range d.handled {
+		if !handledAt.IsZero() && now.Sub(handledAt) > dedupeTTL {
+			delete(d.handled, id)
+		}
+	}
+}
+
+func (d *deliveryState) ack(payload payloads.Payload) {
+	ackTo := payload.GetHeader(payloads.HeaderAckTo)
+	if ackTo == "" {
+		return
+	}
+
+	p, err := payloads.NewPayload(Ack{
+		MessageID:    payload.GetHeader(payloads.HeaderMessageID),
+		SubscriberID: d.id(),
+	})
+	if err == nil {
+		err = d.publish(ackTo, p)
+	}
+
+	if err != nil {
+		d.owner.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.client",
+			"topic":  ackTo,
+		}).Error("Failed to send ack: ", err)
+	}
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+var ErrNotSubscribed = errors.New("Client is not subscribed to the topic")
+
+// maxAheadOfGap bounds how many sequence numbers are remembered past a gap, when it is exceeded the
+// missing messages are given up on
+const maxAheadOfGap = 1024
+
+// logPosition tracks the sequence numbers received on a topic, every number up to seq was received and
+// ahead holds the numbers received after a gap
+type logPosition struct {
+	log   string
+	seq   uint64
+	ahead map[uint64]bool
+	// requested is set when seq was set by a catch up request before the log was known
+	requested bool
+}
+
+// accept records a sequence number and returns false if it was received before
+func (p *logPosition) accept(log string, seq uint64) bool {
+	if p.log != log {
+		// A new log, or the server started a new one, start tracking from here
+		if !p.requested || p.log != "" {
+			p.seq = seq - 1
+		}
+		p.log = log
+		p.ahead = nil
+		p.requested = false
+	}
+
+	if seq <= p.seq || p.ahead[seq] {
+		return false
+	}
+
+	if seq == p.seq+1 {
+		p.seq = seq
+	} else {
+		if p.ahead == nil {
+			p.ahead = make(map[uint64]bool)
+		}
+		p.ahead[seq] = true
+	}
+
+	for p.ahead[p.seq+1] {
+		delete(p.ahead, p.seq+1)
+		p.seq++
+	}
+
+	if len(p.ahead) > maxAheadOfGap {
+		p.skipGap()
+	}
+
+	return true
+}
+
+// skipGap moves past the oldest gap
+func (p *logPosition) skipGap() {
+	var lowest uint64
+	for seq := range p.ahead {
+		if lowest == 0 || seq < lowest {
+			lowest = seq
+		}
+	}
+
+	p.seq = lowest - 1
+	for p.ahead[p.seq+1] {
+		delete(p.ahead, p.seq+1)
+		p.seq++
+	}
+}
+
+// acceptSequence drops payloads that were already received, a catch up resends messages the client may
+// have received live
+func (m *MangosClient) acceptSequence(p payloads.Payload) bool {
+	log, seq, found := payloads.Sequence(p)
+	if !found {
+		return true
+	}
+
+	m.positionsMu.Lock()
+	defer m.positionsMu.Unlock()
+
+	pos, found := m.positions[p.GetTopic()]
+	if !found {
+		pos = &logPosition{}
+		m.positions[p.GetTopic()] = pos
+	}
+
+	return pos.accept(log, seq)
+}
+
+// CatchUp asks the server to resend the messages of a topic after the sequence number, the server must
+// have a message log enabled. Messages the client already received are not handled again. Clients
+// catch up on the topics they received logged messages on automatically when they reconnect. The
+// subscription of the topic must be connected, ErrNotSubscribed is returned otherwise.
+func (m *MangosClient) CatchUp(topic string, since uint64) error {
+	addr, subscribed := m.subscriptionAddr(topic)
+	if !subscribed {
+		return ErrNotSubscribed
+	}
+
+	m.positionsMu.Lock()
+	pos, found := m.positions[topic]
+	if !found {
+		pos = &logPosition{}
+		m.positions[topic] = pos
+	}
+	pos.seq = since
+	pos.ahead = nil
+	pos.requested = pos.log == ""
+	req := control.CatchUp{Topic: topic, Log: pos.log, Since: since, LocalAddr: addr}
+	m.positionsMu.Unlock()
+
+	return m.sendControl(control.CatchUpTopic, req)
+}
+
+// subscriptionAddr returns the local address of the connection of the subscription that receives a
+// topic, the most specific filter wins
+func (m *MangosClient) subscriptionAddr(topic string) (string, bool) {
+	m.announceMu.Lock()
+	defer m.announceMu.Unlock()
+
+	var addr, filter string
+	found := false
+	for f, a := range m.announcements {
+		if strings.HasPrefix(topic, f) && (!found || len(f) > len(filter)) {
+			addr, filter, found = a.LocalAddr, f, true
+		}
+	}
+	return addr, found
+}
+
+// catchUpAll requests the messages missed on every logged topic
+func (m *MangosClient) catchUpAll() {
+	m.positionsMu.Lock()
+	reqs := make([]control.CatchUp, 0, len(m.positions))
+	for topic, pos := range m.positions {
+		reqs = append(reqs, control.CatchUp{Topic: topic, Log: pos.log, Since: pos.seq})
+	}
+	m.positionsMu.Unlock()
+
+	for _, req := range reqs {
+		var found bool
+		if req.LocalAddr, found = m.subscriptionAddr(req.Topic); !found {
+			continue
+		}
+
+		if err := m.sendControl(control.CatchUpTopic, req); err != nil {
+			return
+		}
+	}
+}
@@ -1,16 +1,19 @@
 package client
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
 	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
 	"github.com/TykTechnologies/tyk-cluster-framework/helpers"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/TykTechnologies/tyk-cluster-framework/pool"
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/pub"
 	"github.com/go-mangos/mangos/protocol/sub"
-	"github.com/go-mangos/mangos/transport/tcp"
 	"net/url"
 	"strconv"
 	"sync"
@@ -49,26 +52,51 @@ func (p *socketMap) Get(filter string) (mangos.Socket, PayloadHandler, bool) {
 // all clients can publish to a server and the server can publish to a client using topics
 type MangosClient struct {
 	ClientHandler
+	// URL is the server the client is connected to
 	URL string
+	// Servers are the servers the client fails over between, they must all listen on the same port
+	Servers []string
 
 	pubSock            mangos.Socket
 	disablePublisher   bool
 	Encoding           encoding.Encoding
 	payloadHandlers    socketMap
-	broadcastKillChans map[string]chan struct{}
+	broadcasts         broadcasts
 	SubscribeChan      chan string
 	onDisconnect       func() error
 	id string
+	pools              subscriptionPools
+	authToken          string
+	tlsConfig          *tls.Config
+	announceMu         sync.Mutex
+	announcements      map[string]control.Subscribe
+	subsMu             sync.Mutex
+	subscriptions      map[string]*subscription
+	serversMu          sync.Mutex
+	failoverMu         sync.Mutex
+	current            int
+	stopped            bool
+	positionsMu        sync.Mutex
+	positions          map[string]*logPosition
+	confirmMu          sync.Mutex
+	confirmations      map[string]chan struct{}
 }
 
 // Init will initialise a MangosClient
 func (m *MangosClient) Init(config interface{}) error {
-
+	m.SetTransport("mangos")
 	m.SubscribeChan = make(chan string)
-	m.broadcastKillChans = make(map[string]chan struct{})
 	m.payloadHandlers = socketMap{
 		payloadHandlers: make(map[string]*socketPayloadHandler),
 	}
+	m.announcements = make(map[string]control.Subscribe)
+	m.subscriptions = make(map[string]*subscription)
+	m.positions = make(map[string]*logPosition)
+	m.confirmations = make(map[string]chan struct{})
+	m.enableDelivery(m.GetID, m.Publish, m.Subscribe)
+	if len(m.Servers) == 0 {
+		m.Servers = []string{m.URL}
+	}
 
 	return nil
 }
@@ -89,6 +117,12 @@ func (m *MangosClient) Connect() error {
 func (m *MangosClient) Stop() error {
 	var err error
 
+	m.failoverMu.Lock()
+	m.stopped = true
+	m.failoverMu.Unlock()
+
+	m.broadcasts.StopAll()
+	m.pools.StopAll()
 	if err = m.pubSock.Close(); err != nil {
 		return err
 	}
@@ -98,6 +132,27 @@ func (m *MangosClient) Stop() error {
 
 // Publish will publish a Payload to a topic, the underlying topology is handled by the library
 func (m *MangosClient) Publish(filter string, payload payloads.Payload) error {
+	return m.WrapOutbound(m.publish)(filter, payload)
+}
+
+// PublishWithOptions will publish a Payload to a topic, retained payloads are kept by the server and
+// delivered to clients that subscribe later
+func (m *MangosClient) PublishWithOptions(filter string, payload payloads.Payload, opts PublishOptions) error {
+	if payload != nil {
+		payload = applyPublishOptions(payload, opts)
+	}
+	return m.Publish(filter, payload)
+}
+
+// SendTo publishes a Payload to the inbox of a single node through the server and waits for the node to
+// receive it. ErrUnknownNode is returned if the server does not know the node, ErrNodeNotSubscribed if
+// the node does not subscribe to the topic and ErrNodeTimeout if it does not acknowledge within the default
+// ack timeout. Servers in a federation do not report unknown nodes, SendTo times out for them.
+func (m *MangosClient) SendTo(nodeID, topic string, payload payloads.Payload) error {
+	return m.sendToWithAck(nodeID, topic, payload, DefaultAckOptions())
+}
+
+func (m *MangosClient) publish(filter string, payload payloads.Payload) error {
 	if payload == nil {
 		return nil
 	}
@@ -128,7 +183,7 @@ func (m *MangosClient) Publish(filter string, payload payloads.Payload) error {
 	asPayload := append([]byte(filter), encodedPayload...)
 
 	if len(asPayload) == 0 {
-		log.WithFields(logrus.Fields{
+		m.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.MangosClient",
 		}).Error("No data to send, not sending")
 		return nil
@@ -146,13 +201,13 @@ func (m *MangosClient) Publish(filter string, payload payloads.Payload) error {
 }
 
 func (m *MangosClient) registerHandlerForChannel(socket mangos.Socket, filter string, handler PayloadHandler) {
-	log.WithFields(logrus.Fields{
+	m.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.MangosClient",
 	}).Debugf("Adding handler for: %v\n", filter)
 
 	m.payloadHandlers.Add(socket, filter, handler)
 
-	log.WithFields(logrus.Fields{
+	m.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.MangosClient",
 	}).Debugf("Done adding handler for: %v\n", filter)
 }
@@ -164,35 +219,51 @@ func (m *MangosClient) notifySub(channel string) {
 	}
 }
 
-func (m *MangosClient) startListening(sock mangos.Socket, channel string) {
+func (m *MangosClient) startListening(sock mangos.Socket, channel string, workers *pool.WorkerPool) {
 	var msg []byte
 	var err error
-	log.Debug("[CLIENT] Listening on: ", channel)
+	m.Log().Debug("[CLIENT] Listening on: ", channel)
+	inbox := []byte(InboxTopic(m.GetID(), channel))
 
 	m.notifySub(channel)
 
 	for {
-		log.Debug("[CLIENT] Listening...")
+		m.Log().Debug("[CLIENT] Listening...")
 
 		if msg, err = sock.Recv(); err != nil {
-			log.WithFields(logrus.Fields{
-				"prefix": "tcf.MangosClient",
-			}).Fatal("Cannot recv: ", err.Error())
+			// The socket is closed when the client stops, anything else means this subscription is dead
+			if err != mangos.ErrClosed {
+				m.ReportError(fmt.Errorf("Cannot recv on %s: %s", channel, err.Error()))
+			}
+			return
 		}
 
-		log.Debug("[CLIENT] Received: raw data: ", string(msg))
+		m.Log().Debug("[CLIENT] Received: raw data: ", string(msg))
+
+		// Messages for this connection only carry a direct prefix before their topic
+		var direct bool
+		msg, direct = control.StripDirect(msg)
+		if direct && bytes.HasPrefix(msg, confirmTopic) {
+			m.handleConfirm(msg[len(confirmTopic):])
+			continue
+		}
 
 		// Strip the namespace
-		payload := msg[len(channel):]
+		var payload []byte
+		if bytes.HasPrefix(msg, inbox) {
+			payload = msg[len(inbox):]
+		} else {
+			payload = msg[len(channel):]
+		}
 
-		log.Debug("Received: stripped data: ", string(payload))
+		m.Log().Debug("Received: stripped data: ", string(payload))
 
 		_, handler, found := m.payloadHandlers.Get(channel)
 		if found {
-			log.Debug("Found handler for: ", channel)
-			handlingErr := m.HandleRawMessage(payload, handler, m.Encoding)
+			m.Log().Debug("Found handler for: ", channel)
+			handlingErr := m.dispatch(channel, payload, handler, workers)
 			if handlingErr != nil {
-				log.WithFields(logrus.Fields{
+				m.Log().WithFields(logrus.Fields{
 					"prefix": "tcf.MangosClient",
 				}).Error("Failed to handle message: ", handlingErr)
 			}
@@ -202,30 +273,81 @@ func (m *MangosClient) startListening(sock mangos.Socket, channel string) {
 
 }
 
+// dispatch decodes a message and queues it for its handler, unless it was received before
+func (m *MangosClient) dispatch(channel string, msg []byte, handler PayloadHandler, workers *pool.WorkerPool) error {
+	payload, err := m.DecodeReceived(channel, msg, m.Encoding)
+	if err != nil {
+		return err
+	}
+
+	if !m.acceptSequence(payload) {
+		m.Log().Debug("Dropped duplicate on: ", channel)
+		return nil
+	}
+
+	return m.DispatchPayload(channel, msg, payload, handler, workers)
+}
+
 // Subscribe will subscribe to a topic and attache a PayloadHandler, this is only available in the client
 func (m *MangosClient) Subscribe(filter string, handler PayloadHandler) (chan string, error) {
+	return m.SubscribeWithOptions(filter, handler, DefaultSubscribeOptions())
+}
+
+// SubscribeWithOptions will subscribe to a topic and run the PayloadHandler on a worker pool
+// configured by the options
+func (m *MangosClient) SubscribeWithOptions(filter string, handler PayloadHandler, opts SubscribeOptions) (chan string, error) {
+	handler = opts.Retry.wrap(handler)
 	var sock mangos.Socket
 	var err error
 
 	if sock, err = sub.NewSocket(); err != nil {
 		return m.SubscribeChan, fmt.Errorf("can't get new sub socket: %s", err.Error())
 	}
-	sock.AddTransport(tcp.NewTransport())
-
-	log.Info("Dialing: ", m.URL)
-	if err = sock.Dial(m.URL); err != nil {
-		return m.SubscribeChan, fmt.Errorf("can't dial on sub socket: %s", err.Error())
+	if err = m.prepareSocket(sock); err != nil {
+		return nil, err
 	}
 
+	// Subscribe before dialing so nothing is missed once the connection is up
 	err = sock.SetOption(mangos.OptionSubscribe, []byte(filter))
-	//err = sock.SetOption(mangos.OptionSubscribe, []byte(""))
 	if err != nil {
 		return nil, err
 	}
 
+	// Directed messages for this topic arrive on the inbox of the client
+	err = sock.SetOption(mangos.OptionSubscribe, []byte(InboxTopic(m.GetID(), filter)))
+	if err != nil {
+		return nil, err
+	}
+
+	sock.SetPortHook(m.subscriptionPortHook(sock, filter))
+
+	s := &subscription{sock: sock}
+	m.subsMu.Lock()
+	m.subscriptions[filter] = s
+	m.subsMu.Unlock()
+
+	m.failoverMu.Lock()
+	m.Log().Info("Dialing: ", m.URL)
+	err = m.dialSubscription(s, m.URL)
+	m.failoverMu.Unlock()
+
+	if err != nil {
+		if len(m.servers()) < 2 {
+			m.subsMu.Lock()
+			delete(m.subscriptions, filter)
+			m.subsMu.Unlock()
+			return m.SubscribeChan, fmt.Errorf("can't dial on sub socket: %s", err.Error())
+		}
+
+		m.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosClient",
+		}).Warning("Can't dial on sub socket, failing over: ", err)
+		go m.failover()
+	}
+
 	m.registerHandlerForChannel(sock, filter, handler)
 
-	go m.startListening(sock, filter)
+	go m.startListening(sock, filter, m.pools.Start(filter, opts, m.Log()))
 	return m.SubscribeChan, nil
 }
 
@@ -235,56 +357,20 @@ func (m *MangosClient) SetEncoding(enc encoding.Encoding) error {
 	return nil
 }
 
-// Broadcast will send a payload at a predefined rate, call StopBroadcast() to halt.
+// Broadcast will send a payload every interval seconds, call StopBroadcast() to halt.
 func (m *MangosClient) Broadcast(filter string, payload payloads.Payload, interval int) error {
-	_, found := m.broadcastKillChans[filter]
-	if found {
-		return errors.New("Filter already broadcasting, stop first")
-	}
-
-	killChan := make(chan struct{})
-	go func(f string, p payloads.Payload, i int, k chan struct{}) {
-		var ticker <-chan time.Time
-		ticker = time.After(time.Duration(i) * time.Second)
-
-		for {
-			select {
-			case <-k:
-				// Kill broadcast
-				log.WithFields(logrus.Fields{
-					"prefix": "tcf.MangosClient",
-				}).Info("Stopping broadcast on: ", f)
-				return
-			case <-ticker:
-
-				log.WithFields(logrus.Fields{
-					"prefix": "tcf.MangosClient",
-				}).Debug("Sending: ", p)
-
-				if pErr := m.Publish(f, p); pErr != nil {
-					log.WithFields(logrus.Fields{
-						"prefix": "tcf.MangosClient",
-					}).Error("Failed to broadcast: ", pErr)
-				}
-				ticker = time.After(time.Duration(i) * time.Second)
-			}
-		}
-
-	}(filter, payload, interval, killChan)
+	return m.BroadcastWithOptions(filter, payload, BroadcastOptions{Interval: time.Duration(interval) * time.Second})
+}
 
-	m.broadcastKillChans[filter] = killChan
-	return nil
+// BroadcastWithOptions will send a payload on an interval or cron schedule with optional jitter, a
+// generator can create a fresh payload for each broadcast. Call StopBroadcast() to halt.
+func (m *MangosClient) BroadcastWithOptions(filter string, payload payloads.Payload, opts BroadcastOptions) error {
+	return m.broadcasts.Start(filter, payload, opts, m.Publish, m.Log(), "tcf.MangosClient")
 }
 
-// StopBroadcast will stop a broadcasted payload.
+// StopBroadcast will stop a broadcast
 func (m *MangosClient) StopBroadcast(f string) error {
-	killChan, found := m.broadcastKillChans[f]
-	if !found {
-		return errors.New("Filter not broadcasting")
-	}
-
-	killChan <- struct{}{}
-	return nil
+	return m.broadcasts.Stop(f)
 }
 
 func (m *MangosClient) startMessagePublisher() error {
@@ -294,7 +380,7 @@ func (m *MangosClient) startMessagePublisher() error {
 
 	var err error
 	if m.pubSock, err = pub.NewSocket(); err != nil {
-		log.Errorf("can't get new pub socket: %s", err)
+		m.Log().Errorf("can't get new pub socket: %s", err)
 		return nil
 	}
 
@@ -307,37 +393,48 @@ func (m *MangosClient) startMessagePublisher() error {
 
 	var p int
 	if p, err = strconv.Atoi(u.Port()); err != nil {
-		log.Error(err)
+		m.Log().Error(err)
 		return err
 	}
 
 	// The return address must always be inbound port+1 in order to find the correct publisher
-	returnAddress := fmt.Sprintf("tcp://0.0.0.0:%v", p+1)
-	log.Info("Creating Publisher...")
+	returnAddress := m.transportURL(fmt.Sprintf("tcp://0.0.0.0:%v", p+1))
+	m.Log().Info("Creating Publisher...")
+
+	if m.authToken != "" && m.tlsConfig == nil {
+		m.Log().Warning("The auth token is sent to the server without TLS")
+	}
 
-	m.pubSock.AddTransport(tcp.NewTransport())
+	if err = m.prepareSocket(m.pubSock); err != nil {
+		return err
+	}
 	if err = m.pubSock.Listen(returnAddress); err != nil {
-		log.Errorf("can't listen on pub socket: %s", err.Error())
+		m.Log().Errorf("can't listen on pub socket: %s", err.Error())
 		return errors.New("Can't listen on pub socket")
 	}
 
-	log.Info("Setting port hook")
+	m.Log().Info("Setting port hook")
 	m.pubSock.SetPortHook(m.onPortAction)
 
-	log.Info("Created Publisher on: ", returnAddress)
+	m.Log().Info("Created Publisher on: ", returnAddress)
 
 	return nil
 }
 
 func (m *MangosClient) onPortAction(action mangos.PortAction, data mangos.Port) bool {
-	log.WithFields(logrus.Fields{
+	m.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.MangosClient",
 	}).Info("New publish connection change detected")
 
+	// The server connected to our publisher, it can now receive control messages
+	if action == mangos.PortActionAdd {
+		go m.identify()
+	}
+
 	if action == mangos.PortActionRemove {
 		if m.onDisconnect != nil {
 			if err := m.onDisconnect(); err != nil {
-				log.WithFields(logrus.Fields{
+				m.Log().WithFields(logrus.Fields{
 					"prefix": "tcf.MangosClient",
 				}).Error("Disconnect callback returned error: ", err)
 			}
@@ -1,9 +1,13 @@
 package client
 
 import (
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
 	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
 	"github.com/TykTechnologies/tyk-cluster-framework/server"
+	"github.com/go-mangos/mangos"
+	"sync"
 	"testing"
 	"time"
 )
@@ -427,3 +431,155 @@ func TestMangosClient(t *testing.T) {
 	}
 
 }
+
+func TestSubscriptionAddr(t *testing.T) {
+	m := &MangosClient{announcements: map[string]control.Subscribe{
+		"tcf.a":   {Filter: "tcf.a", LocalAddr: "127.0.0.1:5000"},
+		"tcf.a.b": {Filter: "tcf.a.b", LocalAddr: "127.0.0.1:5001"},
+	}}
+
+	if addr, found := m.subscriptionAddr("tcf.a.b.c"); !found || addr != "127.0.0.1:5001" {
+		t.Fatalf("Most specific subscription should receive the replay, got %v", addr)
+	}
+
+	if addr, found := m.subscriptionAddr("tcf.a.c"); !found || addr != "127.0.0.1:5000" {
+		t.Fatalf("Unexpected subscription: %v", addr)
+	}
+
+	if _, found := m.subscriptionAddr("tcf.b"); found {
+		t.Fatal("Topic without a subscription should not be found")
+	}
+
+	if err := m.CatchUp("tcf.b", 0); err != ErrNotSubscribed {
+		t.Fatalf("Expected ErrNotSubscribed, got: %v", err)
+	}
+}
+
+// countingSocket counts the messages sent on a publisher
+type countingSocket struct {
+	mangos.Socket
+	mu   sync.Mutex
+	sent int
+}
+
+func (c *countingSocket) Send(msg []byte) error {
+	c.mu.Lock()
+	c.sent++
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *countingSocket) Sent() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sent
+}
+
+func TestControlConfirmation(t *testing.T) {
+	m := &MangosClient{id: "client-1", Encoding: encoding.JSON}
+	m.Init(nil)
+	m.SetLogger(logging.Discard())
+	pub := &countingSocket{}
+	m.pubSock = pub
+
+	defer func(retry time.Duration) { controlRetry = retry }(controlRetry)
+	controlRetry = 10 * time.Millisecond
+
+	confirm := func(c control.Confirm) {
+		p, _ := payloads.NewPayload(c)
+		data, err := payloads.Marshal(p, encoding.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.handleConfirm(data.([]byte))
+	}
+
+	result := make(chan bool, 1)
+	go func() {
+		result <- m.sendConfirmed(helloConfirmation, control.HelloTopic, control.Hello{ClientID: m.GetID()})
+	}()
+
+	// The hello is sent again until the server confirms it, confirmations for other clients are ignored
+	time.Sleep(50 * time.Millisecond)
+	confirm(control.Confirm{Topic: control.HelloTopic, ClientID: "client-2"})
+	if sent := pub.Sent(); sent < 2 {
+		t.Fatalf("Expected the hello to be sent again, sent: %v", sent)
+	}
+
+	confirm(control.Confirm{Topic: control.HelloTopic, ClientID: m.GetID()})
+	select {
+	case ok := <-result:
+		if !ok {
+			t.Fatal("Expected the hello to be confirmed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Hello was not confirmed")
+	}
+
+	sent := pub.Sent()
+	time.Sleep(50 * time.Millisecond)
+	if pub.Sent() != sent {
+		t.Fatal("A confirmed hello should not be sent again")
+	}
+}
+
+func TestPublishOptions(t *testing.T) {
+	p, err := payloads.NewPayload(testPayloadData{"retained"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retained := applyPublishOptions(p, PublishOptions{Retain: true})
+	if !payloads.IsRetained(retained) {
+		t.Fatal("Expected the payload to be retained")
+	}
+
+	// A later plain publish of the same payload is not retained
+	if payloads.IsRetained(p) {
+		t.Fatal("Publish options should not change the payload")
+	}
+}
+
+func TestLogPosition(t *testing.T) {
+	p := &logPosition{}
+
+	// Tracking starts at the first message, earlier messages are not expected
+	for _, seq := range []uint64{5, 6, 8} {
+		if !p.accept("log-1", seq) {
+			t.Fatalf("%v should be accepted", seq)
+		}
+	}
+
+	if p.accept("log-1", 6) || p.accept("log-1", 8) {
+		t.Fatal("Duplicates should be dropped")
+	}
+
+	// A replay fills the gap
+	if !p.accept("log-1", 7) || p.seq != 8 {
+		t.Fatalf("Gap should be filled, at %v", p.seq)
+	}
+
+	// A different log starts over
+	if !p.accept("log-2", 1) || p.seq != 1 {
+		t.Fatalf("New log should restart tracking, at %v", p.seq)
+	}
+
+	// An explicit catch up before the log is known keeps its position
+	p = &logPosition{requested: true}
+	if !p.accept("log-1", 10) || p.seq != 0 {
+		t.Fatalf("Requested position should be kept, at %v", p.seq)
+	}
+
+	if !p.accept("log-1", 1) {
+		t.Fatal("Replayed message should be accepted")
+	}
+
+	p = &logPosition{}
+	p.accept("log-1", 1)
+	for seq := uint64(3); seq < maxAheadOfGap+4; seq++ {
+		p.accept("log-1", seq)
+	}
+	if p.seq != maxAheadOfGap+3 || len(p.ahead) != 0 {
+		t.Fatalf("Old gap should be given up on, at %v with %v ahead", p.seq, len(p.ahead))
+	}
+}
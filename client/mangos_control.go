@@ -0,0 +1,224 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/transport/tcp"
+	"github.com/go-mangos/mangos/transport/tlstcp"
+)
+
+// controlRetry is how often a control message is sent again until the server confirms it, mangos calls
+// port hooks before the pipe is added so the first messages over a new connection can be lost
+var controlRetry = 250 * time.Millisecond
+
+// controlAttempts is how often a control message is sent before the client gives up on a confirmation
+var controlAttempts = 40
+
+var confirmTopic = []byte(control.ConfirmTopic)
+
+const helloConfirmation = "hello"
+
+func subscribeConfirmation(localAddr string) string {
+	return "subscribe " + localAddr
+}
+
+// SetAuthToken sets the token the client presents to the server to establish its identity for access
+// control, it must be called before Connect()
+func (m *MangosClient) SetAuthToken(token string) {
+	m.authToken = token
+}
+
+// SetTLSConfig makes the client connect to a server that listens with TLS, set a client certificate in
+// the config to identify the client to the server. The publisher of the client listens with TLS too and
+// presents the certificate to the server. It must be called before Connect()
+func (m *MangosClient) SetTLSConfig(cfg *tls.Config) {
+	m.tlsConfig = cfg
+}
+
+// prepareSocket adds the transport to a socket, with TLS when it is configured
+func (m *MangosClient) prepareSocket(sock mangos.Socket) error {
+	if m.tlsConfig == nil {
+		sock.AddTransport(tcp.NewTransport())
+		return nil
+	}
+
+	sock.AddTransport(tlstcp.NewTransport())
+	return sock.SetOption(mangos.OptionTLSConfig, m.tlsConfig)
+}
+
+// transportURL returns the address to dial or listen on for the transport
+func (m *MangosClient) transportURL(server string) string {
+	if m.tlsConfig == nil {
+		return server
+	}
+	return strings.Replace(server, "tcp://", "tls+tcp://", 1)
+}
+
+// subscriptionPortHook announces the subscription to the server for every connection of its socket,
+// the connection is subscribed to its direct topic so the server can send it the retained messages
+func (m *MangosClient) subscriptionPortHook(sock mangos.Socket, filter string) mangos.PortHook {
+	return func(action mangos.PortAction, port mangos.Port) bool {
+		m.pipeChanged(filter, action == mangos.PortActionAdd)
+
+		local, err := port.GetProp(mangos.PropLocalAddr)
+		if err != nil {
+			return true
+		}
+
+		addr, ok := local.(net.Addr)
+		if !ok {
+			return true
+		}
+
+		// Socket options are not changed from within the hook
+		direct := []byte(control.DirectTopic(addr.String()))
+		if action != mangos.PortActionAdd {
+			m.confirmed(subscribeConfirmation(addr.String()))
+			go sock.SetOption(mangos.OptionUnsubscribe, direct)
+			return true
+		}
+
+		announcement := control.Subscribe{Filter: filter, LocalAddr: addr.String(), ClientID: m.GetID()}
+		m.announceMu.Lock()
+		m.announcements[filter] = announcement
+		m.announceMu.Unlock()
+
+		go func() {
+			if err := sock.SetOption(mangos.OptionSubscribe, direct); err != nil {
+				m.ReportError(fmt.Errorf("Cannot subscribe to direct messages on %s: %s", filter, err.Error()))
+				return
+			}
+			m.sendConfirmed(subscribeConfirmation(announcement.LocalAddr), control.SubscribeTopic, announcement)
+		}()
+
+		return true
+	}
+}
+
+// identify sends the hello, all subscription announcements and the catch up requests, it runs when the server connects to
+// the publisher of the client because anything sent before that is lost. The catch up requests are not
+// confirmed, they are sent once the confirmed hello shows that the publisher is attached.
+func (m *MangosClient) identify() {
+	hello := control.Hello{ClientID: m.GetID(), Token: m.authToken}
+	if !m.sendConfirmed(helloConfirmation, control.HelloTopic, hello) {
+		return
+	}
+
+	m.announceMu.Lock()
+	announcements := make([]control.Subscribe, 0, len(m.announcements))
+	for _, a := range m.announcements {
+		announcements = append(announcements, a)
+	}
+	m.announceMu.Unlock()
+
+	for _, a := range announcements {
+		if !m.sendConfirmed(subscribeConfirmation(a.LocalAddr), control.SubscribeTopic, a) {
+			return
+		}
+	}
+
+	m.catchUpAll()
+}
+
+// sendConfirmed sends a control message until the server confirms it, it returns false if the message
+// was not confirmed
+func (m *MangosClient) sendConfirmed(key, topic string, msg interface{}) bool {
+	done := m.awaitConfirmation(key)
+	defer m.confirmed(key)
+
+	for i := 0; i < controlAttempts; i++ {
+		if m.isStopped() || m.sendControl(topic, msg) != nil {
+			return false
+		}
+
+		select {
+		case <-done:
+			return true
+		case <-time.After(controlRetry):
+		}
+	}
+
+	m.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.MangosClient",
+		"topic":  topic,
+	}).Warning("Server did not confirm control message")
+	return false
+}
+
+// awaitConfirmation returns a channel that is closed when the confirmation arrives
+func (m *MangosClient) awaitConfirmation(key string) chan struct{} {
+	m.confirmMu.Lock()
+	defer m.confirmMu.Unlock()
+
+	done, found := m.confirmations[key]
+	if !found {
+		done = make(chan struct{})
+		m.confirmations[key] = done
+	}
+	return done
+}
+
+// confirmed stops sending a control message
+func (m *MangosClient) confirmed(key string) {
+	m.confirmMu.Lock()
+	defer m.confirmMu.Unlock()
+
+	if done, found := m.confirmations[key]; found {
+		close(done)
+		delete(m.confirmations, key)
+	}
+}
+
+// handleConfirm processes a confirmation the server sent to a connection of the client
+func (m *MangosClient) handleConfirm(msg []byte) {
+	pl, err := m.GetPayload(msg, m.Encoding)
+	if err != nil {
+		return
+	}
+
+	var c control.Confirm
+	if err = pl.DecodeMessage(&c); err != nil {
+		return
+	}
+
+	switch c.Topic {
+	case control.HelloTopic:
+		if c.ClientID == m.GetID() {
+			m.confirmed(helloConfirmation)
+		}
+	case control.SubscribeTopic:
+		m.confirmed(subscribeConfirmation(c.LocalAddr))
+	}
+}
+
+func (m *MangosClient) isStopped() bool {
+	m.failoverMu.Lock()
+	defer m.failoverMu.Unlock()
+	return m.stopped
+}
+
+// sendControl publishes a control message, it bypasses the middleware because control messages are
+// consumed by the server
+func (m *MangosClient) sendControl(topic string, msg interface{}) error {
+	p, err := payloads.NewPayload(msg)
+	if err == nil {
+		err = m.publish(topic, p)
+	}
+
+	if err != nil {
+		m.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosClient",
+			"topic":  topic,
+		}).Error("Failed to send control message: ", err)
+	}
+
+	return err
+}
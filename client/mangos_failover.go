@@ -0,0 +1,158 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/go-mangos/mangos"
+)
+
+// failoverDelay is how long a subscription may stay disconnected before the client moves to the next
+// server, mangos reconnects on its own if the server comes back within it.
+var failoverDelay = 2 * time.Second
+
+var ErrNoServerAvailable = errors.New("No server available")
+
+// subscription is a subscriber socket and its connection to the current server
+type subscription struct {
+	sock   mangos.Socket
+	dialer mangos.Dialer
+	// pipes counts the open connections, a closed dialer may report its removal after a new one connected
+	pipes int
+}
+
+// pipeChanged tracks the connections of a subscription, a lost connection starts a failover
+func (m *MangosClient) pipeChanged(filter string, added bool) {
+	m.subsMu.Lock()
+	if s, found := m.subscriptions[filter]; found {
+		if added {
+			s.pipes++
+		} else if s.pipes > 0 {
+			s.pipes--
+		}
+	}
+	m.subsMu.Unlock()
+
+	if !added && len(m.servers()) > 1 {
+		go m.failover()
+	}
+}
+
+// SetServers replaces the servers the client fails over between, the client stays on its current server
+// until it loses the connection. The servers must all listen on the same port.
+func (m *MangosClient) SetServers(servers []string) {
+	m.failoverMu.Lock()
+	defer m.failoverMu.Unlock()
+
+	m.serversMu.Lock()
+	m.Servers = append([]string{}, servers...)
+	m.serversMu.Unlock()
+
+	// Failover tries the servers after the current one, start at the first if the current one is gone
+	m.current = -1
+	for i, server := range servers {
+		if server == m.URL {
+			m.current = i
+		}
+	}
+}
+
+// servers returns the servers the client fails over between, the list is replaced by SetServers
+func (m *MangosClient) servers() []string {
+	m.serversMu.Lock()
+	defer m.serversMu.Unlock()
+
+	return m.Servers
+}
+
+func (m *MangosClient) allConnected() bool {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+
+	for _, s := range m.subscriptions {
+		if s.pipes == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// dialSubscription connects a subscription to a server, any previous connection is closed first so the
+// subscription never receives from two servers.
+func (m *MangosClient) dialSubscription(s *subscription, server string) error {
+	m.subsMu.Lock()
+	old := s.dialer
+	s.dialer = nil
+	m.subsMu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	d, err := s.sock.NewDialer(m.transportURL(server), nil)
+	if err != nil {
+		return err
+	}
+
+	if err = d.Dial(); err != nil {
+		return err
+	}
+
+	m.subsMu.Lock()
+	s.dialer = d
+	m.subsMu.Unlock()
+
+	return nil
+}
+
+// failover moves all subscriptions to the next server that accepts them, the servers are tried in the
+// order they were configured, starting after the current one.
+func (m *MangosClient) failover() {
+	time.Sleep(failoverDelay)
+
+	m.failoverMu.Lock()
+	defer m.failoverMu.Unlock()
+
+	if m.stopped || m.allConnected() {
+		return
+	}
+
+	m.subsMu.Lock()
+	subs := make([]*subscription, 0, len(m.subscriptions))
+	for _, s := range m.subscriptions {
+		subs = append(subs, s)
+	}
+	m.subsMu.Unlock()
+
+	servers := m.servers()
+	for i := 1; i <= len(servers); i++ {
+		next := (m.current + i) % len(servers)
+		server := servers[next]
+
+		var err error
+		for _, s := range subs {
+			if err = m.dialSubscription(s, server); err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			m.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.MangosClient",
+				"server": server,
+			}).Warning("Failover failed: ", err)
+			continue
+		}
+
+		m.current = next
+		m.URL = server
+		m.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosClient",
+		}).Info("Failed over to: ", server)
+		return
+	}
+
+	m.ReportError(ErrNoServerAvailable)
+	go m.failover()
+}
@@ -0,0 +1,24 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+var ErrRetainNotSupported = errors.New("Retained messages are not supported by this transport")
+
+// PublishOptions configures a single publish
+type PublishOptions struct {
+	// Retain asks the transport to keep the payload as the last value of the topic, it is delivered to
+	// subscribers that join later so they learn the current state without waiting for the next publish.
+	Retain bool
+}
+
+// applyPublishOptions returns a copy of the payload with the envelope headers that carry the publish
+// options, the options only apply to this publish
+func applyPublishOptions(p payloads.Payload, opts PublishOptions) payloads.Payload {
+	p = p.Copy()
+	payloads.SetRetained(p, opts.Retain)
+	return p
+}
@@ -2,9 +2,11 @@ package client
 
 import (
 	"errors"
+	"fmt"
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/TykTechnologies/tyk-cluster-framework/pool"
 	"github.com/garyburd/redigo/redis"
 	"net/url"
 	"strings"
@@ -19,20 +21,26 @@ type RedisClient struct {
 	URL                string
 	pool               *redis.Pool
 	Encoding           encoding.Encoding
-	broadcastKillChans map[string]chan struct{}
+	broadcasts         broadcasts
 	SubscribeChan      chan string
+	// MinReceivers makes Publish fail with ErrTooFewReceivers if fewer subscribers received the message
+	MinReceivers       int
 	id string
+	pools              subscriptionPools
 }
 
 // Init will initialise the redis client
 func (c *RedisClient) Init(config interface{}) error {
-	c.broadcastKillChans = make(map[string]chan struct{})
+	c.SetTransport("redis")
 	c.SubscribeChan = make(chan string)
+	c.enableDelivery(c.GetID, c.Publish, c.Subscribe)
 	return nil
 }
 
 // Stop will close all redis connections
 func (c *RedisClient) Stop() error {
+	c.broadcasts.StopAll()
+	c.pools.StopAll()
 	return c.pool.Close()
 }
 
@@ -52,20 +60,51 @@ func (c *RedisClient) Connect() error {
 		return err
 	}
 
-	log.WithFields(logrus.Fields{
+	c.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.redisclient",
 	}).Info("Connected: ", c.URL)
 	return nil
 }
 
+// ErrTooFewReceivers is returned by a publish that did not reach `MinReceivers` subscribers
+var ErrTooFewReceivers error = errors.New("Publish reached fewer subscribers than required")
+
 // Publish will publish a Payload on the redis pub/sub channel
 func (c *RedisClient) Publish(filter string, p payloads.Payload) error {
+	_, err := c.PublishWithCount(filter, p)
+	return err
+}
+
+// PublishWithOptions will publish a Payload on the redis pub/sub channel, retained payloads are also
+// stored in a companion key that is read when a client subscribes to the channel
+func (c *RedisClient) PublishWithOptions(filter string, p payloads.Payload, opts PublishOptions) error {
+	if p != nil {
+		p = applyPublishOptions(p, opts)
+	}
+	return c.Publish(filter, p)
+}
+
+// PublishWithCount will publish a Payload on the redis pub/sub channel and return the number of
+// subscribers that received it, if `MinReceivers` is set and fewer subscribers received the
+// message, ErrTooFewReceivers is returned along with the count.
+func (c *RedisClient) PublishWithCount(filter string, p payloads.Payload) (int, error) {
+	var receivers int
+	err := c.WrapOutbound(func(filter string, p payloads.Payload) error {
+		var err error
+		receivers, err = c.publish(filter, p)
+		return err
+	})(filter, p)
+
+	return receivers, err
+}
+
+func (c *RedisClient) publish(filter string, p payloads.Payload) (int, error) {
 	if TCFConfig.SetEncodingForPayloadsGlobally {
 		p.SetEncoding(c.Encoding)
 	}
 	data, encErr := payloads.Marshal(p, c.Encoding)
 	if encErr != nil {
-		return encErr
+		return 0, encErr
 	}
 
 	var toSend string
@@ -77,29 +116,92 @@ func (c *RedisClient) Publish(filter string, p payloads.Payload) error {
 		toSend = data.(string)
 		break
 	default:
-		return errors.New("Encoded data is not supported")
+		return 0, errors.New("Encoded data is not supported")
 	}
 
 	if len(toSend) == 0 {
-		log.WithFields(logrus.Fields{
+		c.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.redisclient",
 		}).Error("No data to send, not sending")
-		return nil
+		return 0, nil
+	}
+
+	if c.pool == nil {
+		return 0, errors.New("Not connected")
 	}
 
 	conn := c.pool.Get()
 	defer conn.Close()
 
-	if conn == nil {
-		log.WithFields(logrus.Fields{
-			"prefix": "tcf.redisclient",
-		}).Warning("Not connected, connecting")
-		c.Connect()
+	// The pool returns a connection with the dial error set if it could not connect
+	if err := conn.Err(); err != nil {
+		return 0, fmt.Errorf("Failed publishing: %s", err.Error())
 	}
 
-	//fmt.Printf("REDIS PUBLISHING: %v\n", string(toSend))
-	conn.Do("PUBLISH", filter, string(toSend))
-	return nil
+	var receivers int
+	var err error
+	if payloads.IsRetained(p) {
+		receivers, err = publishRetained(conn, filter, toSend)
+	} else {
+		receivers, err = redis.Int(conn.Do("PUBLISH", filter, toSend))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Failed publishing: %s", err.Error())
+	}
+
+	if c.MinReceivers > 0 && receivers < c.MinReceivers {
+		return receivers, ErrTooFewReceivers
+	}
+
+	return receivers, nil
+}
+
+// SendTo publishes a Payload to the inbox of a single node, ErrUnknownNode is returned if the node is
+// not subscribed to the topic
+func (c *RedisClient) SendTo(nodeID, topic string, p payloads.Payload) error {
+	receivers, err := c.PublishWithCount(InboxTopic(nodeID, topic), p)
+	if receivers == 0 && (err == nil || err == ErrTooFewReceivers) {
+		return ErrUnknownNode
+	}
+	return err
+}
+
+// retainedKey is the companion key that holds the last retained payload of a channel
+func retainedKey(channel string) string {
+	return "tcf:retained:" + channel
+}
+
+// publishRetained stores the payload in the companion key and publishes it in one transaction
+func publishRetained(conn redis.Conn, channel string, data string) (int, error) {
+	conn.Send("MULTI")
+	conn.Send("SET", retainedKey(channel), data)
+	conn.Send("PUBLISH", channel, data)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(replies) != 2 {
+		return 0, errors.New("Unexpected reply to retained publish")
+	}
+
+	return redis.Int(replies[1], nil)
+}
+
+// deliverRetained reads the retained payload of a channel and dispatches it to the handler
+func (c *RedisClient) deliverRetained(filter string, handler PayloadHandler, workers *pool.WorkerPool) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", retainedKey(filter)))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read retained payload: %s", err.Error())
+	}
+
+	return c.DispatchRawMessage(filter, data, handler, c.Encoding, workers)
 }
 
 func (c *RedisClient) notifySub(channel string) {
@@ -111,6 +213,14 @@ func (c *RedisClient) notifySub(channel string) {
 
 // Subscribe will create a subscription on the redis topic and attach a handler
 func (c *RedisClient) Subscribe(filter string, handler PayloadHandler) (chan string, error) {
+	return c.SubscribeWithOptions(filter, handler, DefaultSubscribeOptions())
+}
+
+// SubscribeWithOptions will create a subscription on the redis topic and run the handler on
+// a worker pool configured by the options
+func (c *RedisClient) SubscribeWithOptions(filter string, handler PayloadHandler, opts SubscribeOptions) (chan string, error) {
+	handler = opts.Retry.wrap(handler)
+	workers := c.pools.Start(filter, opts, c.Log())
 
 	// Create a subscription and a hold loop, the outer loop is to re-create the object if it breaks.
 	go func(filter string, handler PayloadHandler) {
@@ -119,32 +229,52 @@ func (c *RedisClient) Subscribe(filter string, handler PayloadHandler) (chan str
 		defer conn.Close()
 
 		if conn == nil {
-			log.Println("Not connected, connecting")
+			c.Log().Info("Not connected, connecting")
 			c.Connect()
 		}
 
+		// Directed messages for this topic arrive on the inbox of the client
 		psc := redis.PubSubConn{Conn: conn}
-		psc.Subscribe(filter)
+		if err := psc.Subscribe(filter, InboxTopic(c.GetID(), filter)); err != nil {
+			c.ReportError(fmt.Errorf("Failed to subscribe to %s: %s", filter, err.Error()))
+			return
+		}
 
 		for {
 			switch v := psc.Receive().(type) {
 			case redis.Message:
-				c.HandleRawMessage(v.Data, handler, c.Encoding)
+				if err := c.DispatchRawMessage(filter, v.Data, handler, c.Encoding, workers); err != nil {
+					c.Log().WithFields(logrus.Fields{
+						"prefix": "tcf.redisclient",
+					}).Error("Failed to handle message: ", err)
+				}
 
 			case redis.Subscription:
-				log.WithFields(logrus.Fields{
+				c.Log().WithFields(logrus.Fields{
 					"prefix": "tcf.redisclient",
 				}).Info("Subscription started: ", v.Channel)
+
+				if v.Channel != filter {
+					break
+				}
+
+				// Subscribed first so nothing published in between is missed, the retained payload
+				// may be delivered twice in that case
+				if err := c.deliverRetained(filter, handler, workers); err != nil {
+					c.Log().WithFields(logrus.Fields{
+						"prefix": "tcf.redisclient",
+					}).Error("Failed to deliver retained payload: ", err)
+				}
 				c.notifySub(filter)
 
 			case error:
-				log.WithFields(logrus.Fields{
+				c.Log().WithFields(logrus.Fields{
 					"prefix": "tcf.redisclient",
 				}).Error("Redis disconnected: ", v)
 				break
 			}
 		}
-		log.WithFields(logrus.Fields{
+		c.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.redisclient",
 		}).Warning("Connection closed")
 
@@ -219,56 +349,20 @@ func (c *RedisClient) setupRedisPool(s string) (*redis.Pool, error) {
 	return thisClientPool, nil
 }
 
-// Broadcast will publish a periodic message to a topic at a preset interval
+// Broadcast will send a payload every interval seconds, call StopBroadcast() to halt.
 func (c *RedisClient) Broadcast(filter string, payload payloads.Payload, interval int) error {
-	_, found := c.broadcastKillChans[filter]
-	if found {
-		return errors.New("Filter already broadcasting, stop first")
-	}
-
-	killChan := make(chan struct{})
-	go func(f string, p payloads.Payload, i int, k chan struct{}) {
-		var ticker <-chan time.Time
-		ticker = time.After(time.Duration(i) * time.Second)
-
-		for {
-			select {
-			case <-k:
-				// Kill broadcast
-				log.WithFields(logrus.Fields{
-					"prefix": "tcf.redisclient",
-				}).Info("Stopping broadcast on: ", f)
-				return
-			case <-ticker:
-
-				log.WithFields(logrus.Fields{
-					"prefix": "tcf.redisclient",
-				}).Debug("Sending: ", p)
-
-				if pErr := c.Publish(f, p); pErr != nil {
-					log.WithFields(logrus.Fields{
-						"prefix": "tcf.redisclient",
-					}).Error("Failed to broadcast: ", pErr)
-				}
-				ticker = time.After(time.Duration(i) * time.Second)
-			}
-		}
-
-	}(filter, payload, interval, killChan)
+	return c.BroadcastWithOptions(filter, payload, BroadcastOptions{Interval: time.Duration(interval) * time.Second})
+}
 
-	c.broadcastKillChans[filter] = killChan
-	return nil
+// BroadcastWithOptions will send a payload on an interval or cron schedule with optional jitter, a
+// generator can create a fresh payload for each broadcast. Call StopBroadcast() to halt.
+func (c *RedisClient) BroadcastWithOptions(filter string, payload payloads.Payload, opts BroadcastOptions) error {
+	return c.broadcasts.Start(filter, payload, opts, c.Publish, c.Log(), "tcf.redisclient")
 }
 
 // StopBroadcast will stop a broadcast
 func (c *RedisClient) StopBroadcast(f string) error {
-	killChan, found := c.broadcastKillChans[f]
-	if !found {
-		return errors.New("Filter not broadcasting")
-	}
-
-	killChan <- struct{}{}
-	return nil
+	return c.broadcasts.Stop(f)
 }
 
 func (c *RedisClient) SetConnectionDropHook(callback func() error) error {
@@ -343,4 +343,101 @@ func TestPayload(t *testing.T) {
 
 		b.Stop()
 	})
+
+	t.Run("Publish Receiver Count", func(t *testing.T) {
+		var c Client
+		var err error
+
+		ch := "tcf.test.redis-server.receiver-count"
+		if c, err = NewClient(cs+"/?min_receivers=1", encoding.JSON); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+
+		var pl payloads.Payload
+		if pl, err = payloads.NewPayload(testPayloadData{"Nobody listening"}); err != nil {
+			t.Fatal(err)
+		}
+
+		var cnt int
+		cnt, err = c.(*RedisClient).PublishWithCount(ch, pl)
+		if err != ErrTooFewReceivers {
+			t.Fatalf("Expected ErrTooFewReceivers, got: %v", err)
+		}
+
+		if cnt != 0 {
+			t.Fatalf("Expected no receivers, got: %v", cnt)
+		}
+
+		var subChan chan string
+		if subChan, err = c.Subscribe(ch, func(payload payloads.Payload) {}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-subChan:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Channel wait timed out")
+		}
+
+		if cnt, err = c.(*RedisClient).PublishWithCount(ch, pl); err != nil {
+			t.Fatal(err)
+		}
+
+		if cnt != 1 {
+			t.Fatalf("Expected one receiver, got: %v", cnt)
+		}
+
+		c.Stop()
+	})
+
+	t.Run("Retained Publish", func(t *testing.T) {
+		var c Client
+		var err error
+
+		ch := "tcf.test.redis-server.retained"
+		msg := "Retained state"
+		if c, err = NewClient(cs, encoding.JSON); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+
+		var pl payloads.Payload
+		if pl, err = payloads.NewPayload(testPayloadData{msg}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Nobody is subscribed yet, the payload is only kept in the companion key
+		if err = c.PublishWithOptions(ch, pl, PublishOptions{Retain: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		resultChan := make(chan testPayloadData, 1)
+		if _, err = c.Subscribe(ch, func(payload payloads.Payload) {
+			var d testPayloadData
+			if err := payload.DecodeMessage(&d); err != nil {
+				t.Fatalf("Decode payload failed: %v", err)
+			}
+			resultChan <- d
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case v := <-resultChan:
+			if v.FullName != msg {
+				t.Fatalf("Unexpected return value: %v", v)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Retained payload not delivered")
+		}
+
+		c.Stop()
+	})
 }
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// RetryPolicy configures how often a failing handler is called for the same payload, a handler fails
+// when it panics or when a handler made by `HandlerWithError()` returns an error. Retries hold up the
+// worker they run on.
+type RetryPolicy struct {
+	// MaxAttempts is the number of calls before the payload is given up on, zero means one
+	MaxAttempts int
+	// Backoff is the wait before the first retry, it doubles with every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// HandlerError is the failure of a handler after all of its attempts
+type HandlerError struct {
+	Err      error
+	Attempts int
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("Handler failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// HandlerFailure lets the failure pass the recovery middleware
+func (e *HandlerError) HandlerFailure() {}
+
+// returnedError is the panic value of a handler made by HandlerWithError
+type returnedError struct {
+	err error
+}
+
+func (e returnedError) Error() string {
+	return e.err.Error()
+}
+
+// HandlerFailure lets the error pass the recovery middleware
+func (e returnedError) HandlerFailure() {}
+
+// HandlerWithError turns a handler that returns an error into a PayloadHandler, returned errors count as
+// failures for the retry policy and the dead letter sink, `middleware.InboundRecovery` does not recover them.
+func HandlerWithError(fn func(payloads.Payload) error) PayloadHandler {
+	return func(payload payloads.Payload) {
+		if err := fn(payload); err != nil {
+			panic(returnedError{err: err})
+		}
+	}
+}
+
+// handlerFailure turns a recovered panic value into a HandlerError
+func handlerFailure(r interface{}) *HandlerError {
+	switch v := r.(type) {
+	case *HandlerError:
+		return v
+	case returnedError:
+		return &HandlerError{Err: v.err, Attempts: 1}
+	default:
+		return &HandlerError{Err: fmt.Errorf("Recovered from panic in handler: %v", r), Attempts: 1}
+	}
+}
+
+// wrap calls the handler until it succeeds or runs out of attempts, the last failure is raised again as
+// a HandlerError
+func (r RetryPolicy) wrap(handler PayloadHandler) PayloadHandler {
+	if r.MaxAttempts < 2 {
+		return handler
+	}
+
+	return func(payload payloads.Payload) {
+		backoff := r.Backoff
+		var err error
+		for attempt := 1; attempt <= r.MaxAttempts; attempt++ {
+			if err = callHandler(handler, payload); err == nil {
+				return
+			}
+
+			if attempt < r.MaxAttempts && backoff > 0 {
+				time.Sleep(backoff)
+				backoff *= 2
+				if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+					backoff = r.MaxBackoff
+				}
+			}
+		}
+
+		panic(&HandlerError{Err: err, Attempts: r.MaxAttempts})
+	}
+}
+
+func callHandler(handler PayloadHandler, payload payloads.Payload) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = handlerFailure(r).Err
+		}
+	}()
+
+	handler(payload)
+	return nil
+}
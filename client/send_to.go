@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+var (
+	ErrUnknownNode        = errors.New("Node is not known")
+	ErrNodeNotSubscribed  = errors.New("Node does not subscribe to the topic")
+	ErrNodeTimeout        = errors.New("Node did not acknowledge the message in time")
+	ErrSendToNotSupported = errors.New("Directed messages are not supported by this transport")
+)
+
+// InboxTopicPrefix is the prefix of the topics nodes receive directed messages on
+const InboxTopicPrefix = control.InboxPrefix
+
+// InboxTopic returns the topic a node receives the directed messages for a topic on, clients subscribe
+// to the inbox of their own ID for every topic they subscribe to
+func InboxTopic(nodeID, topic string) string {
+	return control.InboxTopic(nodeID, topic)
+}
+
+// ParseInboxTopic returns the node and the topic of an inbox topic, handlers can use it to tell a
+// directed message from a published one
+func ParseInboxTopic(inbox string) (nodeID, topic string, ok bool) {
+	return control.ParseInbox(inbox)
+}
+
+// sendToWithAck publishes to the inbox of a node and waits for the node to acknowledge it, it is used by
+// transports that cannot tell if a node received a message. The node acknowledges the message once it is
+// queued for its handler. The server reports nodes it does not know or that do not subscribe to the topic,
+// ErrNodeTimeout is returned if the node does not acknowledge within the timeout.
+func (c *ClientHandler) sendToWithAck(nodeID, topic string, payload payloads.Payload, opts AckOptions) error {
+	payload = payload.Copy()
+	payload.SetHeader(payloads.HeaderAckOnReceipt, "1")
+	opts.Expect = []string{nodeID}
+	_, err := c.PublishWithAck(InboxTopic(nodeID, topic), payload, opts)
+	if err == ErrAckTimeout {
+		return ErrNodeTimeout
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/pool"
+)
+
+// SubscribeOptions configures how payloads received on a subscription are handed to the handler
+type SubscribeOptions struct {
+	// Workers sets the concurrency, queue depth, ordering, backpressure and error hook of the
+	// worker pool that runs the payload handler.
+	Workers pool.Options
+	// Retry sets how often the handler is called for a payload before it is sent to the dead letter
+	// sink of the client
+	Retry RetryPolicy
+}
+
+// DefaultSubscribeOptions returns the options used by `Subscribe()`, see `SetDefaultSubscribeOptions()`
+func DefaultSubscribeOptions() SubscribeOptions {
+	return TCFConfig.SubscribeOptions
+}
+
+// subscriptionPools tracks the worker pool for each subscription of a client
+type subscriptionPools struct {
+	mu    sync.Mutex
+	pools map[string]*pool.WorkerPool
+}
+
+// Start creates the worker pool for a subscription, replacing (and stopping) any existing one
+func (s *subscriptionPools) Start(filter string, opts SubscribeOptions, logger logging.Logger) *pool.WorkerPool {
+	workerOpts := opts.Workers
+	if workerOpts.OnError == nil {
+		workerOpts.OnError = func(err error) {
+			logger.WithFields(logrus.Fields{
+				"prefix": "tcf.subscription",
+				"topic":  filter,
+			}).Error("Handler error: ", err)
+		}
+	}
+
+	p := pool.New(workerOpts)
+
+	s.mu.Lock()
+	if s.pools == nil {
+		s.pools = make(map[string]*pool.WorkerPool)
+	}
+	existing, found := s.pools[filter]
+	s.pools[filter] = p
+	s.mu.Unlock()
+
+	if found {
+		existing.Stop()
+	}
+
+	return p
+}
+
+// Get returns the worker pool for a subscription
+func (s *subscriptionPools) Get(filter string) (*pool.WorkerPool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, found := s.pools[filter]
+	return p, found
+}
+
+// StopAll stops the worker pools of all subscriptions
+func (s *subscriptionPools) StopAll() {
+	s.mu.Lock()
+	pools := s.pools
+	s.pools = nil
+	s.mu.Unlock()
+
+	for _, p := range pools {
+		p.Stop()
+	}
+}
@@ -1,11 +1,13 @@
 package client
 
 import (
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
-	logger "github.com/TykTechnologies/tykcommon-logger"
+	"github.com/TykTechnologies/tyk-cluster-framework/pool"
 )
 
-var log = logger.GetLogger()
+// log is used where no client logger is available, clients log with the logger set by SetLogger()
+var log = logging.Default()
 
 // RedisOptions provides extended redis options to manage connectivity
 type RedisOptions struct {
@@ -22,6 +24,7 @@ type Config struct {
 	Handlers                       struct {
 		Redis RedisOptions
 	}
+	SubscribeOptions SubscribeOptions
 }
 
 // Global Client config
@@ -29,6 +32,12 @@ var TCFConfig Config = Config{
 	PayloadType:                    payloads.PayloadDefaultPayload,
 	MessageHandlerType:             MessageHandlerDefaultMessageHandler,
 	SetEncodingForPayloadsGlobally: true,
+	SubscribeOptions: SubscribeOptions{
+		Workers: pool.Options{
+			Ordered:      true,
+			Backpressure: pool.Block,
+		},
+	},
 }
 
 func init() {
@@ -50,3 +59,9 @@ func SetEncodingForPayloadsGlobally(t bool) {
 func SetRedisHandlerOptions(redisOptions RedisOptions) {
 	TCFConfig.Handlers.Redis = redisOptions
 }
+
+// SetDefaultSubscribeOptions sets the options used by `Subscribe()`, the default is to deliver
+// payloads in order on a single worker and to block the listener when the queue is full.
+func SetDefaultSubscribeOptions(opts SubscribeOptions) {
+	TCFConfig.SubscribeOptions = opts
+}
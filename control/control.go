@@ -0,0 +1,119 @@
+// Package control defines the messages that mangos clients send to the server on reserved topics to
+// identify themselves and announce their subscriptions. The server consumes them and never relays them.
+package control
+
+import (
+	"bytes"
+	"strings"
+)
+
+const (
+	// Prefix is reserved for control messages
+	Prefix = "tcf.control."
+	// HelloTopic carries a Hello, it is sent when the server connects to the publisher of a client
+	HelloTopic = Prefix + "hello"
+	// SubscribeTopic carries a Subscribe, it is sent for every subscription of a client
+	SubscribeTopic = Prefix + "subscribe"
+	// CatchUpTopic carries a CatchUp, it is sent for every logged topic when a client reconnects
+	CatchUpTopic = Prefix + "catchup"
+	// ConfirmTopic carries a Confirm, the server sends it directly to the connections of a client
+	ConfirmTopic = Prefix + "confirm"
+
+	// DirectPrefix starts the messages the server sends to a single connection of a client
+	DirectPrefix = "tcf.direct."
+	// InboxPrefix starts the topics nodes receive directed messages on
+	InboxPrefix = "tcf.inbox."
+)
+
+// Hello identifies a client to the server
+type Hello struct {
+	ClientID string
+	// Token is exchanged for an identity by the access control policy of the server
+	Token string `json:",omitempty"`
+}
+
+// Subscribe announces a subscription of a client, LocalAddr is the local address of the connection
+// that carries the subscription so the server can match it to the connection it accepted.
+type Subscribe struct {
+	Filter    string
+	LocalAddr string
+	// ClientID tells clients on the same host apart
+	ClientID string `json:",omitempty"`
+}
+
+const (
+	// ReasonUnknownNode is given when no client with the ID of an inbox is connected
+	ReasonUnknownNode = "unknown node"
+	// ReasonNotSubscribed is given when the client of an inbox does not subscribe to the topic
+	ReasonNotSubscribed = "not subscribed"
+)
+
+// Undeliverable is sent by the server on the ack topic of a directed message it cannot deliver, in place
+// of the ack of the subscriber
+type Undeliverable struct {
+	MessageID    string
+	SubscriberID string
+	Reason       string
+}
+
+// Confirm tells a client that the server handled its Hello or Subscribe. Messages a client sends before
+// the server attached its publisher are lost, so clients send them again until they are confirmed.
+type Confirm struct {
+	// Topic is the control topic of the confirmed message
+	Topic    string
+	ClientID string `json:",omitempty"`
+	// LocalAddr is the connection of a confirmed Subscribe
+	LocalAddr string `json:",omitempty"`
+}
+
+// CatchUp asks the server to resend the logged messages of a topic after sequence number Since. Log is
+// the ID of the message log the sequence number belongs to, the server ignores requests for other logs.
+// LocalAddr is the local address of the connection of the subscription that receives the messages.
+type CatchUp struct {
+	Topic     string
+	Log       string `json:",omitempty"`
+	Since     uint64
+	LocalAddr string
+}
+
+// DirectTopic returns the prefix of messages for the connection with the local address, clients
+// subscribe every connection to it. The topic of the message follows the prefix.
+func DirectTopic(localAddr string) string {
+	return DirectPrefix + localAddr + "/"
+}
+
+// StripDirect removes the direct prefix of a message, it returns false if the message has none
+func StripDirect(msg []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(msg, []byte(DirectPrefix)) {
+		return msg, false
+	}
+
+	i := bytes.IndexByte(msg, '/')
+	if i < 0 {
+		return msg, false
+	}
+	return msg[i+1:], true
+}
+
+// InboxTopic returns the topic a node receives the directed messages for a topic on
+func InboxTopic(nodeID, topic string) string {
+	return InboxPrefix + nodeID + "." + topic
+}
+
+// ParseInbox returns the node and the topic of an inbox topic
+func ParseInbox(inbox string) (nodeID, topic string, ok bool) {
+	if !strings.HasPrefix(inbox, InboxPrefix) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(inbox, InboxPrefix), ".", 2)
+	if len(parts) < 2 || parts[0] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// IsControlTopic returns true if the topic is reserved for control messages
+func IsControlTopic(topic string) bool {
+	return strings.HasPrefix(topic, Prefix)
+}
@@ -0,0 +1,86 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"30-10 * * * *",
+		"* * * foo *",
+	}
+
+	for _, expr := range invalid {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Expected %q to fail", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	from := time.Date(2017, time.March, 15, 10, 20, 30, 500, time.UTC)
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2017, time.March, 15, 10, 21, 0, 0, time.UTC)},
+		{"*/15 * * * * *", time.Date(2017, time.March, 15, 10, 20, 45, 0, time.UTC)},
+		{"0 14 * * *", time.Date(2017, time.March, 15, 14, 0, 0, 0, time.UTC)},
+		{"0,30 9-17 * * mon-fri", time.Date(2017, time.March, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2017, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, time.March, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2017, time.March, 15, 10, 25, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted
+		{"0 0 20 * 5", time.Date(2017, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		s, err := Parse(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if next := s.Next(from); !next.Equal(test.next) {
+			t.Errorf("%q: expected %v, got %v", test.expr, test.next, next)
+		}
+	}
+
+	// The hour repeated when daylight saving time ends must not go back in time
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Parse("*/15 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	est := time.Date(2026, time.November, 1, 6, 30, 0, 0, time.UTC).In(ny)
+	if next := s.Next(est); !next.Equal(est.Add(15 * time.Minute)) {
+		t.Errorf("Expected %v after %v, got %v", est.Add(15*time.Minute), est, next)
+	}
+	edt := time.Date(2026, time.November, 1, 5, 50, 0, 0, time.UTC).In(ny)
+	if next := s.Next(edt); !next.Equal(edt.Add(10 * time.Minute)) {
+		t.Errorf("Expected %v after %v, got %v", edt.Add(10*time.Minute), edt, next)
+	}
+
+	s, err = Parse("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.Next(from); !next.IsZero() {
+		t.Errorf("Expected an impossible date to never fire, got %v", next)
+	}
+}
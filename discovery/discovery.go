@@ -0,0 +1,466 @@
+// Package discovery finds the services of a cluster on the local network. Every node announces its
+// service endpoints with a UDP beacon, the nodes that hear them keep a table of peers that expire when
+// their announcements stop. Discovered peers can be fed into the peers of a bus or the server list of a
+// mangos client.
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/bus"
+	"github.com/TykTechnologies/tyk-cluster-framework/client"
+	"github.com/TykTechnologies/tyk-cluster-framework/client/beacon"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/satori/go.uuid"
+)
+
+// DefaultPort is the UDP port announcements are sent on
+const DefaultPort = 9897
+
+// beaconMax is the largest announcement the beacon sends
+const beaconMax = 255
+
+// announcementPrefix starts every announcement, the beacon drops anything else
+var announcementPrefix = []byte("tcf.discovery:")
+
+var (
+	ErrAlreadyStarted       = errors.New("Discovery already started")
+	ErrAnnouncementTooLarge = errors.New("Service announcement does not fit in a beacon")
+	ErrNoPeers              = errors.New("No peers discovered in time")
+	ErrNotAnnouncement      = errors.New("Beacon is not a service announcement")
+)
+
+// Service is an endpoint a node offers, Address defaults to the address the announcement is received from
+type Service struct {
+	Name     string
+	Address  string
+	Port     int
+	Metadata map[string]string
+}
+
+// Endpoint returns the address and port of the service as `host:port`
+func (s Service) Endpoint() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+}
+
+// Peer is a service announced by another node
+type Peer struct {
+	Service
+	// ID identifies the announcing node, a restarted node has a new ID
+	ID       string
+	LastSeen time.Time
+}
+
+// PeerHook is called when a peer is discovered or expires
+type PeerHook func(Peer)
+
+// Config describes the services of the local node and how often they are announced
+type Config struct {
+	// Port defaults to DefaultPort, all nodes of a cluster must use the same port
+	Port int
+	// Interface is the network interface to announce on, it defaults to the BEACON_INTERFACE environment
+	// variable or the first interface
+	Interface string
+	// Services are announced in turn, a node that only discovers announces nothing
+	Services []Service
+	// Interval is the time between announcements, it defaults to one second
+	Interval time.Duration
+	// ExpireAfter is how long a peer is kept without an announcement, it defaults to five rounds of the
+	// announcements of a node with the same number of services
+	ExpireAfter time.Duration
+}
+
+// announcement is what the beacon sends, the fields are short because a beacon holds 255 bytes
+type announcement struct {
+	ID       string            `json:"i"`
+	Name     string            `json:"n"`
+	Address  string            `json:"a,omitempty"`
+	Port     int               `json:"p"`
+	Metadata map[string]string `json:"m,omitempty"`
+}
+
+// watcher is notified of the peers of a service
+type watcher struct {
+	service string
+	join    PeerHook
+	leave   PeerHook
+}
+
+// Discovery announces the services of the local node and tracks the services of its peers
+type Discovery struct {
+	config Config
+	id     string
+	logger logging.Logger
+
+	mu       sync.Mutex
+	beacon   *beacon.Beacon
+	peers    map[string]*Peer
+	watchers []watcher
+	stopChan chan struct{}
+}
+
+// New creates the discovery of a node, call Start() to announce and discover services
+func New(config Config) *Discovery {
+	if config.Port == 0 {
+		config.Port = DefaultPort
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.ExpireAfter <= 0 {
+		rounds := len(config.Services)
+		if rounds == 0 {
+			rounds = 1
+		}
+		config.ExpireAfter = 5 * time.Duration(rounds) * config.Interval
+	}
+
+	return &Discovery{
+		config: config,
+		id:     uuid.NewV4().String(),
+		peers:  make(map[string]*Peer),
+	}
+}
+
+// SetLogger sets the logger of the discovery, it should be called before Start()
+func (d *Discovery) SetLogger(l logging.Logger) {
+	d.logger = l
+}
+
+func (d *Discovery) log() logging.Logger {
+	return logging.OrDefault(d.logger)
+}
+
+// Start announces the services of the node and listens for the announcements of other nodes
+func (d *Discovery) Start() error {
+	transmits := make([][]byte, 0, len(d.config.Services))
+	for _, s := range d.config.Services {
+		t, err := d.encode(s)
+		if err != nil {
+			return err
+		}
+		transmits = append(transmits, t)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopChan != nil {
+		return ErrAlreadyStarted
+	}
+
+	b := beacon.New()
+	b.SetPort(d.config.Port).SetInterval(d.config.Interval).SetInterface(d.config.Interface)
+	b.Subscribe(announcementPrefix)
+
+	var first []byte
+	if len(transmits) > 0 {
+		first = transmits[0]
+	}
+	if err := b.Publish(first); err != nil {
+		return err
+	}
+
+	d.beacon = b
+	d.stopChan = make(chan struct{})
+
+	go d.listen(b.Signals())
+	go d.run(b, transmits, d.stopChan)
+	return nil
+}
+
+// Stop stops announcing and forgets the discovered peers without calling the leave hooks
+func (d *Discovery) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopChan == nil {
+		return
+	}
+
+	close(d.stopChan)
+	d.stopChan = nil
+	d.beacon.Close()
+	d.beacon = nil
+	d.peers = make(map[string]*Peer)
+}
+
+// Peers returns the discovered peers of a service ordered by endpoint, or of all services if the name is
+// empty
+func (d *Discovery) Peers(service string) []Peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers := make([]Peer, 0, len(d.peers))
+	for _, p := range d.peers {
+		if service == "" || p.Name == service {
+			peers = append(peers, copyPeer(p))
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Name != peers[j].Name {
+			return peers[i].Name < peers[j].Name
+		}
+		return peers[i].Endpoint() < peers[j].Endpoint()
+	})
+	return peers
+}
+
+// Wait returns the peers of a service once at least one is discovered, ErrNoPeers is returned after the
+// timeout
+func (d *Discovery) Wait(service string, timeout time.Duration) ([]Peer, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if peers := d.Peers(service); len(peers) > 0 {
+			return peers, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrNoPeers
+		}
+		time.Sleep(d.config.Interval / 4)
+	}
+}
+
+// Watch calls join for every peer of a service that is discovered and leave for every peer that expires,
+// join is called for the known peers straight away. An empty service watches all services.
+func (d *Discovery) Watch(service string, join, leave PeerHook) {
+	d.mu.Lock()
+	d.watchers = append(d.watchers, watcher{service: service, join: join, leave: leave})
+	var known []Peer
+	for _, p := range d.peers {
+		if service == "" || p.Name == service {
+			known = append(known, copyPeer(p))
+		}
+	}
+	d.mu.Unlock()
+
+	for _, p := range known {
+		d.peerEvent(join, p)
+	}
+}
+
+// FeedBus adds the endpoints of a service to the peers of a bus as they are discovered, and removes them
+// when they expire
+func (d *Discovery) FeedBus(b *bus.Bus, service string) {
+	d.Watch(service, func(p Peer) {
+		if err := b.AddPeer(p.Endpoint()); err != nil {
+			d.log().WithFields(logrus.Fields{
+				"prefix": "tcf.discovery",
+				"peer":   p.Endpoint(),
+			}).Error("Failed to add bus peer: ", err)
+		}
+	}, func(p Peer) {
+		// The bus may have removed the peer itself
+		b.RemovePeer(p.Endpoint())
+	})
+}
+
+// FeedMangosClient keeps the server list of a mangos client in step with the discovered endpoints of a
+// service, the client fails over between them. The servers must all listen on the same port.
+func (d *Discovery) FeedMangosClient(m *client.MangosClient, service string) {
+	update := func(Peer) {
+		peers := d.Peers(service)
+		if len(peers) == 0 {
+			// Keep the last known servers, the client can only fail over to a server it knows
+			return
+		}
+
+		servers := make([]string, 0, len(peers))
+		for _, p := range peers {
+			servers = append(servers, "tcp://"+p.Endpoint())
+		}
+		m.SetServers(servers)
+	}
+
+	d.Watch(service, update, update)
+}
+
+func (d *Discovery) encode(s Service) ([]byte, error) {
+	data, err := json.Marshal(announcement{
+		ID:       d.id,
+		Name:     s.Name,
+		Address:  s.Address,
+		Port:     s.Port,
+		Metadata: s.Metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	transmit := append(append([]byte{}, announcementPrefix...), data...)
+	if len(transmit) > beaconMax {
+		return nil, ErrAnnouncementTooLarge
+	}
+	return transmit, nil
+}
+
+// run cycles the announcements of the node, the beacon sends one at a time, and expires silent peers
+func (d *Discovery) run(b *beacon.Beacon, transmits [][]byte, stop chan struct{}) {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+
+	next := 1
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if len(transmits) > 1 {
+				b.Restart(transmits[next%len(transmits)])
+				next++
+			}
+			d.expire(now)
+		}
+	}
+}
+
+func (d *Discovery) listen(signals chan interface{}) {
+	for s := range signals {
+		signal, ok := s.(*beacon.Signal)
+		if !ok {
+			continue
+		}
+
+		if err := d.handleAnnouncement(signal.Addr, signal.Transmit, time.Now()); err != nil {
+			d.log().WithFields(logrus.Fields{
+				"prefix": "tcf.discovery",
+				"from":   signal.Addr,
+			}).Warning("Invalid announcement: ", err)
+		}
+	}
+}
+
+// peerKey identifies a service endpoint, a node that restarts replaces its old entry
+func peerKey(s Service) string {
+	return s.Name + "/" + s.Endpoint()
+}
+
+func (d *Discovery) handleAnnouncement(from string, transmit []byte, now time.Time) error {
+	if !bytes.HasPrefix(transmit, announcementPrefix) {
+		return ErrNotAnnouncement
+	}
+
+	var a announcement
+	if err := json.Unmarshal(transmit[len(announcementPrefix):], &a); err != nil {
+		return err
+	}
+
+	if a.ID == d.id {
+		return nil
+	}
+
+	p := Peer{
+		Service: Service{Name: a.Name, Address: a.Address, Port: a.Port, Metadata: a.Metadata},
+		ID:      a.ID,
+	}
+	if p.Address == "" {
+		p.Address = from
+	}
+
+	d.mu.Lock()
+	key := peerKey(p.Service)
+	existing, found := d.peers[key]
+	if found {
+		existing.ID = p.ID
+		existing.Metadata = p.Metadata
+		existing.LastSeen = now
+		d.mu.Unlock()
+		return nil
+	}
+
+	p.LastSeen = now
+	d.peers[key] = &p
+	hooks := d.hooks(p.Name, true)
+	d.mu.Unlock()
+
+	d.log().WithFields(logrus.Fields{
+		"prefix":  "tcf.discovery",
+		"service": p.Name,
+	}).Info("Discovered peer: ", p.Endpoint())
+
+	for _, hook := range hooks {
+		d.peerEvent(hook, copyPeer(&p))
+	}
+	return nil
+}
+
+// expire forgets the peers that stopped announcing
+func (d *Discovery) expire(now time.Time) {
+	var expired []Peer
+	var hooks [][]PeerHook
+
+	d.mu.Lock()
+	for key, p := range d.peers {
+		if now.Sub(p.LastSeen) > d.config.ExpireAfter {
+			delete(d.peers, key)
+			expired = append(expired, copyPeer(p))
+			hooks = append(hooks, d.hooks(p.Name, false))
+		}
+	}
+	d.mu.Unlock()
+
+	for i, p := range expired {
+		d.log().WithFields(logrus.Fields{
+			"prefix":  "tcf.discovery",
+			"service": p.Name,
+		}).Warning("Peer expired: ", p.Endpoint())
+
+		for _, hook := range hooks[i] {
+			d.peerEvent(hook, p)
+		}
+	}
+}
+
+// hooks returns the join or leave hooks of the watchers of a service, it must be called with the lock held
+func (d *Discovery) hooks(service string, join bool) []PeerHook {
+	var hooks []PeerHook
+	for _, w := range d.watchers {
+		if w.service != "" && w.service != service {
+			continue
+		}
+
+		hook := w.leave
+		if join {
+			hook = w.join
+		}
+		if hook != nil {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+func (d *Discovery) peerEvent(hook PeerHook, p Peer) {
+	if hook == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			d.log().WithFields(logrus.Fields{
+				"prefix": "tcf.discovery",
+			}).Error("Peer hook panicked: ", r)
+		}
+	}()
+
+	hook(p)
+}
+
+func copyPeer(p *Peer) Peer {
+	c := *p
+	c.Metadata = make(map[string]string, len(p.Metadata))
+	for k, v := range p.Metadata {
+		c.Metadata[k] = v
+	}
+	return c
+}
@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/bus"
+	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+)
+
+func TestDiscovery(t *testing.T) {
+	d := New(Config{Interval: time.Second})
+	d.SetLogger(logging.Discard())
+
+	other := New(Config{Services: []Service{{Name: "bus", Port: 9000}}})
+	announce := func(from string, s Service, now time.Time) {
+		transmit, err := other.encode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = d.handleAnnouncement(from, transmit, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := bus.NewBus("tcp://10.0.0.1:9000", "10.0.0.1:9000", false, encoding.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLogger(logging.Discard())
+	d.FeedBus(b, "bus")
+
+	var left []Peer
+	d.Watch("bus", nil, func(p Peer) {
+		left = append(left, p)
+	})
+
+	// The address defaults to the sender of the announcement
+	now := time.Now()
+	announce("10.0.0.2", Service{Name: "bus", Port: 9000}, now)
+	announce("10.0.0.3", Service{Name: "bus", Address: "10.0.0.4", Port: 9000, Metadata: map[string]string{"zone": "a"}}, now)
+	announce("10.0.0.5", Service{Name: "gateway", Port: 8080}, now)
+
+	peers := d.Peers("bus")
+	if len(peers) != 2 || peers[0].Endpoint() != "10.0.0.2:9000" || peers[1].Endpoint() != "10.0.0.4:9000" {
+		t.Fatalf("Unexpected peers: %v", peers)
+	}
+	if peers[1].Metadata["zone"] != "a" || peers[1].ID != other.id {
+		t.Fatalf("Unexpected peer: %+v", peers[1])
+	}
+	if all := d.Peers(""); len(all) != 3 {
+		t.Fatalf("Expected 3 peers, got: %v", all)
+	}
+
+	busPeers := b.Peers()
+	if len(busPeers) != 2 || busPeers[0].Addr != "10.0.0.2:9000" || busPeers[1].Addr != "10.0.0.4:9000" {
+		t.Fatalf("Unexpected bus peers: %v", busPeers)
+	}
+
+	// Our own announcements are ignored
+	own, _ := d.encode(Service{Name: "bus", Port: 9001})
+	if err = d.handleAnnouncement("10.0.0.1", own, now); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.handleAnnouncement("10.0.0.1", []byte("garbage"), now); err != ErrNotAnnouncement {
+		t.Fatalf("Expected ErrNotAnnouncement, got: %v", err)
+	}
+
+	// Peers that keep announcing stay, silent peers expire
+	announce("10.0.0.2", Service{Name: "bus", Port: 9000}, now.Add(4*time.Second))
+	d.expire(now.Add(6 * time.Second))
+
+	if peers = d.Peers("bus"); len(peers) != 1 || peers[0].Endpoint() != "10.0.0.2:9000" {
+		t.Fatalf("Unexpected peers: %v", peers)
+	}
+	if len(left) != 1 || left[0].Endpoint() != "10.0.0.4:9000" {
+		t.Fatalf("Expected 10.0.0.4 to leave, got: %v", left)
+	}
+	if busPeers = b.Peers(); len(busPeers) != 1 {
+		t.Fatalf("Expected the expired peer to be removed from the bus: %v", busPeers)
+	}
+
+	if _, err = d.Wait("gateway", 0); err != ErrNoPeers {
+		t.Fatalf("Expected ErrNoPeers, got: %v", err)
+	}
+
+	if _, err = d.encode(Service{Name: strings.Repeat("x", beaconMax)}); err != ErrAnnouncementTooLarge {
+		t.Fatalf("Expected ErrAnnouncementTooLarge, got: %v", err)
+	}
+}
@@ -1,17 +1,17 @@
 package tcf
 
 import (
+	"errors"
 	"fmt"
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-cluster-framework/client"
 	"github.com/TykTechnologies/tyk-cluster-framework/distributed_store/rafty"
 	"github.com/TykTechnologies/tyk-cluster-framework/distributed_store/rafty/http"
-	logger "github.com/TykTechnologies/tykcommon-logger"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
 	"github.com/nu7hatch/gouuid"
 	"os"
 )
 
-var log *logrus.Logger = logger.GetLogger()
 var DistributedStores map[string]chan os.Signal = make(map[string]chan os.Signal)
 
 // Distributed Store provides a distributed key/value store using the raft protocol (see the rafty sub-package), it
@@ -40,23 +40,56 @@ func NewDistributedStore(config *rafty.Config) (*DistributedStore, error) {
 	return &d, nil
 }
 
+// SetLogger sets the logger of the store and its HTTP API, it must be called before Start()
+func (d *DistributedStore) SetLogger(l logging.Logger) {
+	d.config.Logger = l
+}
+
+// SetErrorHandler sets a callback for errors that happen once the store is running, it must be called before Start()
+func (d *DistributedStore) SetErrorHandler(fn func(error)) {
+	d.config.OnError = fn
+}
+
+func (d *DistributedStore) log() logging.Logger {
+	return logging.OrDefault(d.config.Logger)
+}
+
 // Start will start the store, set joinAddress to force a connection to an existing cluster, and set broadcastWith to a
-// tcf Client to enable auto-discovery of a cluster when bootstrapping.
-func (d *DistributedStore) Start(joinAddress string, broadcastWith client.Client) {
+// tcf Client to enable auto-discovery of a cluster when bootstrapping. An error is returned if the store fails to start.
+func (d *DistributedStore) Start(joinAddress string, broadcastWith client.Client) error {
 	u, _ := uuid.NewV4()
 	serverID := u.String()
 	d.serverID = serverID
 	termChan := make(chan os.Signal, 1)
 	DistributedStores[serverID] = termChan
 	storageChan := make(chan *httpd.EmbeddedService)
-	go rafty.StartServer(joinAddress, d.config, termChan, broadcastWith, storageChan)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- rafty.StartServer(joinAddress, d.config, termChan, broadcastWith, storageChan)
+	}()
 
 	// We want to be able to use the server functions directly without calling the http API
-	d.StorageAPI = <-storageChan
+	select {
+	case d.StorageAPI = <-storageChan:
+	case err := <-errChan:
+		delete(DistributedStores, serverID)
+		if err == nil {
+			err = errors.New("Server stopped before it started")
+		}
+		return err
+	}
+
+	go func() {
+		if err := <-errChan; err != nil && d.config.OnError != nil {
+			d.config.OnError(err)
+		}
+	}()
 
-	log.WithFields(logrus.Fields{
+	d.log().WithFields(logrus.Fields{
 		"prefix": "distributed_store",
 	}).Info("Distrubuted storage engine started: ", serverID)
+
+	return nil
 }
 
 // Stop will shut down the store and leave the cluster. it;s recommend to stop the leader last.
@@ -66,7 +99,7 @@ func (d *DistributedStore) Stop() error {
 		return fmt.Errorf("Could not find server ID to stop: %v", d.serverID)
 	}
 
-	log.WithFields(logrus.Fields{
+	d.log().WithFields(logrus.Fields{
 		"prefix": "distributed_store",
 	}).Info("Stopping server: ", d.serverID)
 	killChan <- os.Interrupt
@@ -105,7 +105,7 @@ func (e *EmbeddedService) GetKey(key string) (*KeyValueAPIObject, error) {
 func (e *EmbeddedService) DeleteKey(key string) (*KeyValueAPIObject, error) {
 
 	if !e.storageAPI.store.IsLeader() {
-		e.forwardCommand(key, forward_delete, nil)
+		return e.forwardCommand(key, forward_delete, nil)
 	}
 	if _, err := e.storageAPI.DeleteKey(key); err != nil {
 		return nil, err
@@ -117,18 +117,33 @@ func (e *EmbeddedService) DeleteKey(key string) (*KeyValueAPIObject, error) {
 	return delResp, nil
 }
 
+// ListKeys returns the keys that start with the prefix from the local copy of the store, they may lag
+// behind the leader
+func (e *EmbeddedService) ListKeys(prefix string) []string {
+	return e.storageAPI.store.Keys(prefix)
+}
+
+// IsLeader returns whether this node is the leader of the cluster
+func (e *EmbeddedService) IsLeader() bool {
+	return e.storageAPI.store.IsLeader()
+}
+
 func (e *EmbeddedService) forwardCommand(key string, command forwardingCommand, value *rafty_objects.NodeValue) (*KeyValueAPIObject, error) {
 	trans := "http"
 	if e.TLS {
 		trans = "https"
 	}
 
-	apiHost := store.GetHttpAPIFromRaftURL(e.storageAPI.store.Leader())
+	apiHost, addrErr := store.GetHttpAPIFromRaftURL(e.storageAPI.store.Leader())
+	if addrErr != nil {
+		e.storageAPI.Log().Error("Failed to generate leader HTTP address: ", addrErr)
+		return nil, NewErrorResponse("/"+key, "Failed to forward to leader")
+	}
 	targetAddr := trans + "://" + apiHost
 
 	_, urlErr := url.Parse(targetAddr)
 	if urlErr != nil {
-		log.Error("Failed to generate leader HTTP address: ", urlErr, " was: ", targetAddr)
+		e.storageAPI.Log().Error("Failed to generate leader HTTP address: ", urlErr, " was: ", targetAddr)
 		return nil, NewErrorResponse("/"+key, "Failed to forward to leader")
 	}
 
@@ -22,12 +22,17 @@ func (s *Service) forwardRequest(w http.ResponseWriter, r *http.Request) {
 		trans = "https"
 	}
 
-	apiHost := store.GetHttpAPIFromRaftURL(s.store.Leader())
+	apiHost, addrErr := store.GetHttpAPIFromRaftURL(s.store.Leader())
+	if addrErr != nil {
+		s.Log().Error("Failed to generate leader HTTP address: ", addrErr)
+		s.writeToClient(w, r, NewErrorResponse(r.URL.Path, "Failed to forward to leader"), http.StatusInternalServerError)
+		return
+	}
 	targetAddr := trans + "://" + apiHost
 
 	asURL, urlErr := url.Parse(targetAddr)
 	if urlErr != nil {
-		log.Error("Failed to generate leader HTTP address: ", urlErr, " was: ", targetAddr)
+		s.Log().Error("Failed to generate leader HTTP address: ", urlErr, " was: ", targetAddr)
 		s.writeToClient(w, r, NewErrorResponse(r.URL.Path, "Failed to forward to leader"), http.StatusInternalServerError)
 		return
 	}
@@ -3,18 +3,20 @@
 package httpd
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/TykTechnologies/logrus"
 	rafty_objects "github.com/TykTechnologies/tyk-cluster-framework/distributed_store/rafty/objects"
-	logger "github.com/TykTechnologies/tykcommon-logger"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"gopkg.in/vmihailenco/msgpack.v2"
+	"net"
 	"net/http"
 )
 
-var log = logger.GetLogger()
+var log = logging.Default()
 
 // Store is the interface Raft-backed key-value stores must implement.
 type Store interface {
@@ -27,6 +29,9 @@ type Store interface {
 	// Delete removes the given key, via distributed consensus.
 	Delete(key string) error
 
+	// Keys returns the keys that start with the prefix.
+	Keys(prefix string) []string
+
 	// Join joins the node, reachable at addr, to the cluster.
 	Join(addr string) error
 
@@ -55,17 +60,22 @@ type Service struct {
 	store       Store
 	StorageAPI  *StorageAPI
 	EmbeddedAPI *EmbeddedService
+
+	logger logging.Logger
+	// OnError is called if the web server stops serving after it has started
+	OnError func(error)
 }
 
-// New returns an uninitialized HTTP service.
-func New(addr string, store Store, tlsConfig *TLSConfig) *Service {
-	var tls bool
+// New returns an uninitialized HTTP service, logger may be nil to use the default logger.
+func New(addr string, store Store, tlsConfig *TLSConfig, logger logging.Logger) *Service {
+	var useTLS bool
 	if tlsConfig != nil {
-		tls = true
+		useTLS = true
 	}
 
-	sAPI := NewStorageAPI(store)
-	eAPI := NewEmbeddedService(tls, sAPI)
+	logger = logging.OrDefault(logger)
+	sAPI := NewStorageAPI(store, logger)
+	eAPI := NewEmbeddedService(useTLS, sAPI)
 
 	return &Service{
 		addr:        addr,
@@ -73,9 +83,15 @@ func New(addr string, store Store, tlsConfig *TLSConfig) *Service {
 		StorageAPI:  sAPI,
 		EmbeddedAPI: eAPI,
 		tlsConfig:   tlsConfig,
+		logger:      logger,
 	}
 }
 
+// Log returns the logger of the service
+func (s *Service) Log() logging.Logger {
+	return s.logger
+}
+
 // Start starts the service.
 func (s *Service) Start() error {
 
@@ -89,26 +105,33 @@ func (s *Service) Start() error {
 	r.HandleFunc("/key/{name}", s.handleCreateKey).Methods("POST")
 	r.HandleFunc("/key/{name}", s.handleDeleteKey).Methods("DELETE")
 
-	go func() {
-		// Check TLS
-		if s.tlsConfig != nil {
-			//  Start HTTPS
-			err_https := http.ListenAndServeTLS(fmt.Sprintf("%s", s.addr), s.tlsConfig.CertFile, s.tlsConfig.KeyFile, r)
-			if err_https != nil {
-				log.WithFields(logrus.Fields{
-					"prefix": "tcf.rafty.http",
-				}).Fatal("Web server (HTTPS): ", err_https)
-			}
-			// Exit out of server loop on fail
-			return
+	// Bind before serving so that address and certificate errors are returned to the caller
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("Web server failed to listen: %s", err.Error())
+	}
+
+	scheme := "HTTP"
+	if s.tlsConfig != nil {
+		cert, certErr := tls.LoadX509KeyPair(s.tlsConfig.CertFile, s.tlsConfig.KeyFile)
+		if certErr != nil {
+			ln.Close()
+			return fmt.Errorf("Web server failed to load certificate: %s", certErr.Error())
 		}
 
-		// By default, run HTTP
-		err_http := http.ListenAndServe(fmt.Sprintf("%s", s.addr), r)
-		if err_http != nil {
-			log.WithFields(logrus.Fields{
+		scheme = "HTTPS"
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	go func() {
+		if serveErr := http.Serve(ln, r); serveErr != nil {
+			s.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.rafty.http",
-			}).Fatal("Web server (HTTP): ", err_http)
+			}).Error("Web server (", scheme, "): ", serveErr)
+
+			if s.OnError != nil {
+				s.OnError(serveErr)
+			}
 		}
 	}()
 
@@ -123,9 +146,9 @@ func (s *Service) Close() {
 func (s *Service) writeToClient(w http.ResponseWriter, r *http.Request, responseObject interface{}, code int) {
 	thisResponse, err := json.Marshal(responseObject)
 	if err != nil {
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.rafty.http",
-		}).Error("Response marshal error: %s", err)
+		}).Error("Response marshal error: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -144,7 +167,7 @@ func (s *Service) setPeers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := s.store.SetPeers(m); err != nil {
-		log.Error(err)
+		s.Log().Error(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -184,7 +207,7 @@ func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := s.store.Join(remoteAddr); err != nil {
-		log.Error(err)
+		s.Log().Error(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -196,7 +219,7 @@ func (s *Service) handleRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info("REMOVING PEER")
+	s.Log().Info("REMOVING PEER")
 	m := map[string]string{}
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -215,11 +238,11 @@ func (s *Service) handleRemove(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := s.store.RemovePeer(remoteAddr); err != nil {
-		log.Error("FAILED TO REMOVE PEER: ", err)
+		s.Log().Error("FAILED TO REMOVE PEER: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	log.Info("PEER REMOVED")
+	s.Log().Info("PEER REMOVED")
 }
 func (s *Service) handleGetKey(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -2,6 +2,8 @@ package httpd
 
 import (
 	rafty_objects "github.com/TykTechnologies/tyk-cluster-framework/distributed_store/rafty/objects"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
 	"github.com/foize/go.fifo"
 	"time"
 
@@ -63,17 +65,20 @@ type StorageAPI struct {
 	ttlIndex      *fifo.Queue
 	queueSnapshot *qSnapShot
 	TTLChunkSize  int
+	logger        logging.Logger
 }
 
-func NewStorageAPI(store Store) *StorageAPI {
+// NewStorageAPI creates the storage API and starts the TTL processor, logger may be nil
+func NewStorageAPI(store Store, logger logging.Logger) *StorageAPI {
 	thisSA := &StorageAPI{
 		store:         store,
+		logger:        logging.OrDefault(logger),
 		ttlIndex:      fifo.NewQueue(),
 		queueSnapshot: newQueueSnapShot(),
 		TTLChunkSize:  100,
 	}
 
-	log.WithFields(logrus.Fields{
+	thisSA.logger.WithFields(logrus.Fields{
 		"prefix": "tcf.rafty.storage-api",
 	}).Info("Starting TTL Processor")
 	go thisSA.processTTLs()
@@ -81,6 +86,11 @@ func NewStorageAPI(store Store) *StorageAPI {
 	return thisSA
 }
 
+// Log returns the logger of the storage API
+func (s *StorageAPI) Log() logging.Logger {
+	return s.logger
+}
+
 func (s *StorageAPI) GetKey(k string, evenIfExpired bool) (*KeyValueAPIObject, *ErrorResponse) {
 	// Get the existing value
 	v, errResp := s.getKeyFromStore(k)
@@ -96,7 +106,7 @@ func (s *StorageAPI) GetKey(k string, evenIfExpired bool) (*KeyValueAPIObject, *
 	}
 
 	if time.Now().After(returnValue.Node.Expiration) && returnValue.Node.TTL != 0 && evenIfExpired == false {
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.rafty.storage-api",
 		}).Debug("KEY EXISTS BUT HAS EXPIRED")
 		return nil, NewErrorNotFound("/" + k)
@@ -197,10 +207,10 @@ func (s *StorageAPI) addTTL(elem ttlIndexElement) {
 	// Store the change in our snapshot
 	elem.Index = s.ttlIndex.Len()
 
-	log.Debug("Storing: ", elem, " in queue snapshot")
+	s.Log().Debug("Storing: ", elem, " in queue snapshot")
 	s.queueSnapshot.SetElement(elem.Key, elem)
 
-	log.Debug("This snaphot contains: ", s.queueSnapshot.queueSnapshot)
+	s.Log().Debug("This snaphot contains: ", s.queueSnapshot.queueSnapshot)
 
 }
 
@@ -216,13 +226,13 @@ func (s *StorageAPI) processTTLElement() {
 	applyDeletes := make([]ttlIndexElement, max)
 	for i := 0; i < max; i++ {
 		var skip bool
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.rafty.storage-api",
 		}).Debug("Getting next element")
 		thisElem := s.ttlIndex.Next()
 
 		if thisElem == nil {
-			log.WithFields(logrus.Fields{
+			s.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.rafty.storage-api",
 			}).Debug("Element is empty - end of TTL queue")
 
@@ -238,7 +248,7 @@ func (s *StorageAPI) processTTLElement() {
 
 		if existingKey.Node.Expiration.Unix() != thisElem.(ttlIndexElement).TTL {
 			// Expiration has changed, so it must be in the queue again
-			log.WithFields(logrus.Fields{
+			s.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.rafty.storage-api",
 			}).Debug("Skipping eviction for key, TTL has changed")
 			skip = true
@@ -247,23 +257,24 @@ func (s *StorageAPI) processTTLElement() {
 		if skip == false {
 			// Check expiry
 			tn := time.Now().Unix()
-			log.WithFields(logrus.Fields{
+			s.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.rafty.storage-api",
 			}).Debug("Exp is: ", thisElem.(ttlIndexElement).TTL)
-			log.WithFields(logrus.Fields{
+			s.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.rafty.storage-api",
 			}).Debug("Now is: ", tn)
 
 			if tn > thisElem.(ttlIndexElement).TTL {
-				log.WithFields(logrus.Fields{
+				s.Log().WithFields(logrus.Fields{
 					"prefix": "tcf.rafty.storage-api",
 				}).Info("-> Removing key (", thisElem.(ttlIndexElement).Key, ") because expired")
 				s.DeleteKey(thisElem.(ttlIndexElement).Key)
+				metrics.IncrCounter(metrics.KeyTTLEvictions, 1)
 
 				// It's not in the queue, aso it shouldn't be in the snapshot
 				applyDeletes[i] = thisElem.(ttlIndexElement)
 			} else {
-				log.WithFields(logrus.Fields{
+				s.Log().WithFields(logrus.Fields{
 					"prefix": "tcf.rafty.storage-api",
 				}).Debug("Expiry not reached yet, adding back to stack")
 				s.addTTL(thisElem.(ttlIndexElement))
@@ -276,7 +287,7 @@ func (s *StorageAPI) processTTLElement() {
 	for _, elem := range applyDeletes {
 		s.queueSnapshot.qmu.Lock()
 		delete(s.queueSnapshot.queueSnapshot, elem.Key)
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.rafty.storage-api",
 		}).Debug("Updated queue snapshot in-mem, deleted: ", elem.Key)
 		s.queueSnapshot.qmu.Unlock()
@@ -288,7 +299,7 @@ func (s *StorageAPI) processTTLElement() {
 
 func (s *StorageAPI) rebuildFromSnapshot(intoFifoQ *fifo.Queue) SnapshotStatus {
 	if s.store.IsLeader() == false {
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.rafty.storage-api",
 		}).Error("Can't rebuild: Not leader")
 		return StatusSnapshotNotLeader
@@ -306,18 +317,18 @@ func (s *StorageAPI) rebuildFromSnapshot(intoFifoQ *fifo.Queue) SnapshotStatus {
 	var snapShotAsArray map[string]ttlIndexElement
 	decErr := json.Unmarshal([]byte(existingSnapShot.Node.Value), &snapShotAsArray)
 	if decErr != nil {
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.rafty.storage-api",
 		}).Error("Failed to decode snapshot backup")
 		return StatusSnapshotNotFound
 	}
 
-	log.WithFields(logrus.Fields{
+	s.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.rafty.storage-api",
 	}).Info("Found: ", len(snapShotAsArray), " elements in snapshot.")
 
 	for _, elem := range snapShotAsArray {
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.rafty.storage-api",
 		}).Debug("ADDING SNAPSHOT ELEMENT: ", elem.Key)
 		intoFifoQ.Add(elem)
@@ -329,7 +340,7 @@ func (s *StorageAPI) rebuildFromSnapshot(intoFifoQ *fifo.Queue) SnapshotStatus {
 
 func (s *StorageAPI) storeTTLSnapshot() {
 	if s.store.IsLeader() == false {
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.rafty.storage-api",
 		}).Error("Failed to store snapshot, not leader.")
 		return
@@ -340,7 +351,7 @@ func (s *StorageAPI) storeTTLSnapshot() {
 	newSnapShotAPIObject := NewKeyValueAPIObject()
 	newSnapShotAPIObject.Node.Key = TTLSNAPSHOT_KEY
 
-	log.Debug("STORING TTL SNAPSHOT: ", asStr)
+	s.Log().Debug("STORING TTL SNAPSHOT: ", asStr)
 	newSnapShotAPIObject.Node.Value = asStr
 	s.SetKey(TTLSNAPSHOT_KEY, newSnapShotAPIObject.Node, true)
 }
@@ -350,13 +361,13 @@ func (s *StorageAPI) processTTLs() {
 		if s.store.IsLeader() {
 			// No queue? try to rebuild or reset it
 			if s.queueSnapshot == nil {
-				log.WithFields(logrus.Fields{
+				s.Log().WithFields(logrus.Fields{
 					"prefix": "tcf.rafty.storage-api",
 				}).Info("TTL Queue is empty, attempting to rebuild")
 				s.queueSnapshot = newQueueSnapShot()
 				status := s.rebuildFromSnapshot(s.ttlIndex)
 				if status == StatusSnapshotNotFound {
-					log.WithFields(logrus.Fields{
+					s.Log().WithFields(logrus.Fields{
 						"prefix": "tcf.rafty.storage-api",
 					}).Info("No snapshot found, initialising a fresh queue")
 					s.storeTTLSnapshot()
@@ -364,7 +375,7 @@ func (s *StorageAPI) processTTLs() {
 			}
 
 			// Process the next TTL item (but store snapshot in case we fail)
-			log.WithFields(logrus.Fields{
+			s.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.rafty.storage-api",
 			}).Debug("Processing TTLs")
 			s.processTTLElement()
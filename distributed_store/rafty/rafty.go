@@ -1,7 +1,10 @@
 package rafty
 
 import (
+	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-cluster-framework/distributed_store/rafty/http"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"time"
 )
 
 // Config defaults
@@ -10,6 +13,8 @@ const (
 	DefaultRaftAddr = ":12000"
 )
 
+const broadcastRetryInterval = time.Second
+
 type Config struct {
 	HttpServerAddr        string
 	RaftServerAddress     string
@@ -18,6 +23,21 @@ type Config struct {
 	TLSConfig             *httpd.TLSConfig
 	RunInSingleServerMode bool
 	ResetPeersOnLoad      bool
+
+	// Logger is used by the store and the HTTP API, the default tykcommon logger is used if it is nil
+	Logger logging.Logger `json:"-"`
+	// OnError is called with errors that happen after the server has started
+	OnError func(error) `json:"-"`
+}
+
+func (c *Config) reportError(err error) {
+	logging.OrDefault(c.Logger).WithFields(logrus.Fields{
+		"prefix": logPrefix,
+	}).Error(err)
+
+	if c.OnError != nil {
+		c.OnError(err)
+	}
 }
 
 var tcfRaftyConfig Config = Config{
@@ -7,6 +7,7 @@ package rafty
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -15,7 +16,7 @@ import (
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-cluster-framework/distributed_store/rafty/http"
 	"github.com/TykTechnologies/tyk-cluster-framework/distributed_store/rafty/store"
-	logger "github.com/TykTechnologies/tykcommon-logger"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
 	"time"
 
 	"github.com/TykTechnologies/tyk-cluster-framework/client"
@@ -23,30 +24,32 @@ import (
 	"path/filepath"
 )
 
-var log = logger.GetLogger()
 var logPrefix string = "tcf.rafty"
 
 // StartServer will start a rafty server based on it's configuration. Most of this is handled by the distributed store parent library.
-func StartServer(JoinAddress string, raftyConfig *Config, killChan chan os.Signal, broadcastWith client.Client, serviceChan chan *httpd.EmbeddedService) {
-	log.Info("Log level: ", os.Getenv("TYK_LOGLEVEL"))
+// It blocks until the server is stopped through killChan, errors that stop the server from starting are returned, errors
+// that happen once it runs are passed to the OnError callback of the configuration.
+func StartServer(JoinAddress string, raftyConfig *Config, killChan chan os.Signal, broadcastWith client.Client, serviceChan chan *httpd.EmbeddedService) error {
 	if raftyConfig == nil {
-		log.WithFields(logrus.Fields{
+		logging.Default().WithFields(logrus.Fields{
 			"prefix": logPrefix,
 		}).Warning("No raft configuration found, using defaults")
-		raftyConfig = raftyConfig
+		defaults := tcfRaftyConfig
+		raftyConfig = &defaults
 	}
 
+	log := logging.OrDefault(raftyConfig.Logger)
+	log.Info("Log level: ", os.Getenv("TYK_LOGLEVEL"))
+
 	// Ensure Raft storage exists.
 	raftDir := raftyConfig.RaftDir
 	if raftDir == "" {
-		log.WithFields(logrus.Fields{
-			"prefix": logPrefix,
-		}).Error("No Raft storage directory specified")
-		os.Exit(1)
+		return errors.New("No Raft storage directory specified")
 	}
 	os.MkdirAll(raftDir, 0700)
 
 	s := store.New()
+	s.SetLogger(log)
 	s.RaftDir = raftyConfig.RaftDir
 	s.RaftBind = raftyConfig.RaftServerAddress
 
@@ -56,7 +59,7 @@ func StartServer(JoinAddress string, raftyConfig *Config, killChan chan os.Signa
 			"prefix": logPrefix,
 		}).Info("Starting master boradcaster")
 		go startBroadcast(broadcastWith, s, raftyConfig)
-		startListeningForMasterChange(broadcastWith, masterConfigChan)
+		startListeningForMasterChange(broadcastWith, masterConfigChan, log)
 
 		if raftyConfig.RunInSingleServerMode == false {
 			select {
@@ -74,7 +77,9 @@ func StartServer(JoinAddress string, raftyConfig *Config, killChan chan os.Signa
 
 				if raftyConfig.ResetPeersOnLoad {
 					thisPath := filepath.Join(s.RaftDir, "peers.json")
-					store.ResetPeersJSON(thisPath, raftyConfig.RaftServerAddress)
+					if err := store.ResetPeersJSON(thisPath, raftyConfig.RaftServerAddress); err != nil {
+						return err
+					}
 				}
 
 				log.WithFields(logrus.Fields{
@@ -90,16 +95,13 @@ func StartServer(JoinAddress string, raftyConfig *Config, killChan chan os.Signa
 	log.Info("Running in single server mode: ", raftyConfig.RunInSingleServerMode)
 
 	if err := s.Open(raftyConfig.RunInSingleServerMode); err != nil {
-		log.WithFields(logrus.Fields{
-			"prefix": logPrefix,
-		}).Fatal("Failed to open store: ", err)
+		return fmt.Errorf("Failed to open store: %s", err.Error())
 	}
 
-	h := httpd.New(raftyConfig.HttpServerAddr, s, raftyConfig.TLSConfig)
+	h := httpd.New(raftyConfig.HttpServerAddr, s, raftyConfig.TLSConfig, log)
+	h.OnError = raftyConfig.reportError
 	if err := h.Start(); err != nil {
-		log.WithFields(logrus.Fields{
-			"prefix": logPrefix,
-		}).Fatalf("Failed to start HTTP service: %v", err)
+		return fmt.Errorf("Failed to start HTTP service: %s", err.Error())
 	}
 
 	// If join was specified, make the join request.
@@ -108,9 +110,7 @@ func StartServer(JoinAddress string, raftyConfig *Config, killChan chan os.Signa
 			"prefix": logPrefix,
 		}).Info("Sending join request")
 		if err := join(JoinAddress, raftyConfig.RaftServerAddress, raftyConfig.TLSConfig != nil); err != nil {
-			log.WithFields(logrus.Fields{
-				"prefix": logPrefix,
-			}).Fatalf("Failed to join node at %s: %v", JoinAddress, err)
+			return fmt.Errorf("Failed to join node at %s: %s", JoinAddress, err.Error())
 		}
 
 	}
@@ -134,16 +134,17 @@ func StartServer(JoinAddress string, raftyConfig *Config, killChan chan os.Signa
 				"prefix": logPrefix,
 			}).Error("Raft server tried to leave, error: ", leaveErr)
 		}
-		return
+		return nil
 	}
 
 	log.WithFields(logrus.Fields{
 		"prefix": logPrefix,
 	}).Info("Leader leaving cluster")
-	s.RemovePeer(raftyConfig.RaftServerAddress)
+	return s.RemovePeer(raftyConfig.RaftServerAddress)
 }
 
 func masterListener(inBoundChan chan Config, raftyConfig *Config) {
+	log := logging.OrDefault(raftyConfig.Logger)
 	lastWrite := time.Now().Unix()
 	for {
 		masterConfig := <-inBoundChan
@@ -163,25 +164,25 @@ func masterListener(inBoundChan chan Config, raftyConfig *Config) {
 }
 
 func startBroadcast(msgClient client.Client, s *store.Store, raftyConfig *Config) {
+	log := logging.OrDefault(raftyConfig.Logger)
 	var isPublishing bool
 	for {
 		if !isPublishing {
 			if s.IsLeader() {
 				thisPayload, pErr := payloads.NewPayload(raftyConfig)
-
 				if pErr != nil {
-					log.WithFields(logrus.Fields{
-						"prefix": logPrefix,
-					}).Fatal(pErr)
+					raftyConfig.reportError(fmt.Errorf("Failed to create leader payload: %s", pErr.Error()))
+					time.Sleep(broadcastRetryInterval)
+					continue
 				}
 
 				log.WithFields(logrus.Fields{
 					"prefix": "tcf-exp",
-				}).Debug("Sending Broadcast: %v", raftyConfig.HttpServerAddr)
+				}).Debug("Sending Broadcast: ", raftyConfig.HttpServerAddr)
 				if bErr := msgClient.Broadcast("tcf.cluster.distributed_store.leader", thisPayload, 1); bErr != nil {
-					log.WithFields(logrus.Fields{
-						"prefix": logPrefix,
-					}).Fatal(bErr)
+					raftyConfig.reportError(fmt.Errorf("Failed to broadcast leader: %s", bErr.Error()))
+					time.Sleep(broadcastRetryInterval)
+					continue
 				}
 				isPublishing = true
 			} else {
@@ -193,7 +194,7 @@ func startBroadcast(msgClient client.Client, s *store.Store, raftyConfig *Config
 	}
 }
 
-func startListeningForMasterChange(msgClient client.Client, configChan chan Config) {
+func startListeningForMasterChange(msgClient client.Client, configChan chan Config, log logging.Logger) {
 	msgClient.Subscribe("tcf.cluster.distributed_store.leader", func(payload payloads.Payload) {
 		var d Config
 		decErr := payload.DecodeMessage(&d)
@@ -248,7 +249,10 @@ func leave(leaderAddr, raftAddr string, secure bool) error {
 		trans = "https"
 	}
 
-	apiAddr := store.GetHttpAPIFromRaftURL(leaderAddr)
+	apiAddr, err := store.GetHttpAPIFromRaftURL(leaderAddr)
+	if err != nil {
+		return err
+	}
 
 	resp, err := http.Post(
 		fmt.Sprintf(trans+"://%s/remove", apiAddr),
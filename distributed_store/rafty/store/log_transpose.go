@@ -2,11 +2,12 @@ package store
 
 import (
 	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
 	"strings"
 )
 
 type ConvertedLogrusLogger struct {
-	LogInstance *logrus.Logger
+	LogInstance logging.Logger
 	Prefix      string
 }
 
@@ -19,7 +19,8 @@ import (
 	"time"
 
 	"github.com/TykTechnologies/logrus"
-	logger "github.com/TykTechnologies/tykcommon-logger"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/raft-boltdb"
 	"gopkg.in/vmihailenco/msgpack.v2"
@@ -27,8 +28,6 @@ import (
 	"strings"
 )
 
-var log = logger.GetLogger()
-
 const (
 	retainSnapshotCount = 2
 	raftTimeout         = 10 * time.Second
@@ -50,23 +49,29 @@ type Store struct {
 
 	raft *raft.Raft // The consensus mechanism
 
-	logger *logrus.Logger
+	logger logging.Logger
 }
 
 // New returns a new Store.
 func New() *Store {
 	return &Store{
 		m:      make(map[string][]byte),
-		logger: log,
+		logger: logging.Default(),
 	}
 }
 
+// SetLogger sets the logger of the store, raft log output is forwarded to it. It must be called
+// before the store is opened.
+func (s *Store) SetLogger(l logging.Logger) {
+	s.logger = logging.OrDefault(l)
+}
+
 // Open opens the store. If enableSingle is set, and there are no existing peers,
 // then this node becomes the first node, and therefore leader, of the cluster.
 func (s *Store) Open(enableSingle bool) error {
 	// Setup Raft configuration with our custom writer to convert to logrus
 	config := raft.DefaultConfig()
-	convertedLogger := &ConvertedLogrusLogger{Prefix: "tcf.rafty.raft", LogInstance: log}
+	convertedLogger := &ConvertedLogrusLogger{Prefix: "tcf.rafty.raft", LogInstance: s.logger}
 	config.LogOutput = convertedLogger
 	config.ShutdownOnRemove = false
 
@@ -132,6 +137,20 @@ func (s *Store) Get(key string) ([]byte, error) {
 	return s.m[key], nil
 }
 
+// Keys returns the keys that start with the prefix, in no particular order.
+func (s *Store) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0)
+	for k := range s.m {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
 // Set sets the value for the given key.
 func (s *Store) Set(key string, value []byte) error {
 	if s.raft.State() != raft.Leader {
@@ -148,8 +167,7 @@ func (s *Store) Set(key string, value []byte) error {
 		return err
 	}
 
-	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	return s.apply(b)
 }
 
 // Delete deletes the given key.
@@ -167,8 +185,25 @@ func (s *Store) Delete(key string) error {
 		return err
 	}
 
+	return s.apply(b)
+}
+
+// apply applies a command through raft and records how long it took to commit
+func (s *Store) apply(b []byte) error {
+	start := time.Now()
 	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	err := f.Error()
+	metrics.MeasureSince(metrics.KeyRaftApply, start)
+	if err != nil {
+		return err
+	}
+
+	// The FSM returns an error as the response if the command could not be applied
+	if applyErr, ok := f.Response().(error); ok {
+		return applyErr
+	}
+
+	return nil
 }
 
 // Join joins a node, located at addr, to this store. The node must be ready to
@@ -228,7 +263,10 @@ type fsm Store
 func (f *fsm) Apply(l *raft.Log) interface{} {
 	var c command
 	if err := msgpack.Unmarshal(l.Data, &c); err != nil {
-		log.Fatalf(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
+		f.logger.WithFields(logrus.Fields{
+			"prefix": "tcf.rafty.store",
+		}).Error("Failed to unmarshal command: ", err)
+		return fmt.Errorf("failed to unmarshal command: %s", err.Error())
 	}
 
 	switch c.Op {
@@ -237,7 +275,10 @@ func (f *fsm) Apply(l *raft.Log) interface{} {
 	case "delete":
 		return f.applyDelete(c.Key)
 	default:
-		panic(fmt.Sprintf("unrecognized command op: %s", c.Op))
+		f.logger.WithFields(logrus.Fields{
+			"prefix": "tcf.rafty.store",
+		}).Error("Unrecognized command op: ", c.Op)
+		return fmt.Errorf("unrecognized command op: %s", c.Op)
 	}
 }
 
@@ -335,25 +376,29 @@ func ReadPeersJSON(path string) ([]string, error) {
 	return peers, nil
 }
 
-func ResetPeersJSON(path string, hostname string) {
+// ResetPeersJSON replaces the peers in the peers.json file with hostname if there is more than one
+func ResetPeersJSON(path string, hostname string) error {
 	peers, err := ReadPeersJSON(path)
 	if err != nil {
-		log.Fatal("Could not reset peers: ", err)
+		return fmt.Errorf("Could not reset peers: %s", err.Error())
 	}
 	newPeers := []string{hostname}
 	if len(peers) > 1 {
 		b, encErr := json.Marshal(newPeers)
 		if encErr != nil {
-			log.Fatal("Could not marshal peers: ", encErr)
+			return fmt.Errorf("Could not marshal peers: %s", encErr.Error())
 		}
 		wErr := ioutil.WriteFile(path, b, 0644)
 		if wErr != nil {
-			log.Fatal("Could not write peers: ", wErr)
+			return fmt.Errorf("Could not write peers: %s", wErr.Error())
 		}
 	}
+
+	return nil
 }
 
-func GetHttpAPIFromRaftURL(leaderAddr string) string {
+// GetHttpAPIFromRaftURL returns the address of the HTTP API of a node, it listens 100 ports below raft
+func GetHttpAPIFromRaftURL(leaderAddr string) (string, error) {
 	urlParts := strings.Split(leaderAddr, ":")
 	var host, portStr string
 	if len(urlParts) > 1 {
@@ -365,9 +410,9 @@ func GetHttpAPIFromRaftURL(leaderAddr string) string {
 
 	asInt, intErr := strconv.Atoi(portStr)
 	if intErr != nil {
-		log.Fatal(intErr, "was: ", portStr)
+		return "", fmt.Errorf("Invalid raft port %q: %s", portStr, intErr.Error())
 	}
 	apiAddr := host + ":" + strconv.Itoa(asInt-100)
 
-	return apiAddr
+	return apiAddr, nil
 }
@@ -0,0 +1,253 @@
+package tcf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/nu7hatch/gouuid"
+)
+
+// scheduleKeyPrefix is the prefix of the store keys that hold scheduled messages
+const scheduleKeyPrefix = "tcf.schedule."
+
+// schedulerInterval is how often the leader checks for messages that are due
+var schedulerInterval = time.Second
+
+var ErrStoreNotStarted = errors.New("Distributed store is not started")
+
+// Publisher is the part of a tcf Client the scheduler publishes with
+type Publisher interface {
+	Publish(string, payloads.Payload) error
+}
+
+// scheduledMessage is a message waiting in the store, Payload is in its wire format. Fired is set in the
+// store before the message is published, fired messages are only removed.
+type scheduledMessage struct {
+	ID      string
+	Topic   string
+	At      time.Time
+	Payload []byte
+	Fired   bool `json:",omitempty"`
+}
+
+// Scheduler publishes messages at a later time. The schedule is kept in the distributed store so it
+// survives restarts, and only the leader of the store publishes. A message is marked as fired in the store
+// before it is published and is never published again once it is marked, so a message is lost if its
+// leader fails between marking and publishing it. Each message carries its schedule ID as message ID.
+type Scheduler struct {
+	store     *DistributedStore
+	publisher Publisher
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// NewScheduler creates a scheduler on a started store, scheduled messages are published with the publisher
+// of the node that is the leader when they are due.
+func NewScheduler(store *DistributedStore, publisher Publisher) *Scheduler {
+	return &Scheduler{
+		store:     store,
+		publisher: publisher,
+	}
+}
+
+// PublishAt schedules a payload to be published on the topic at the given time, it returns the ID of the
+// scheduled message. Messages that are already due are published on the next check. The payload is not
+// changed, it can be published again.
+func (s *Scheduler) PublishAt(topic string, payload payloads.Payload, at time.Time) (string, error) {
+	if s.store.StorageAPI == nil {
+		return "", ErrStoreNotStarted
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	msg := scheduledMessage{
+		ID:    u.String(),
+		Topic: topic,
+		At:    at,
+	}
+
+	payload = payload.Copy()
+	payload.SetHeader(payloads.HeaderMessageID, msg.ID)
+	wire, err := payloads.Marshal(payload, encoding.JSON)
+	if err != nil {
+		return "", fmt.Errorf("Failed to encode payload: %s", err.Error())
+	}
+	msg.Payload = wire.([]byte)
+
+	asJSON, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = s.store.StorageAPI.CreateKey(scheduleKeyPrefix+msg.ID, string(asJSON), 0); err != nil {
+		return "", fmt.Errorf("Failed to store scheduled message: %s", err.Error())
+	}
+
+	return msg.ID, nil
+}
+
+// PublishAfter schedules a payload to be published on the topic once the delay has passed
+func (s *Scheduler) PublishAfter(topic string, payload payloads.Payload, delay time.Duration) (string, error) {
+	return s.PublishAt(topic, payload, time.Now().Add(delay))
+}
+
+// Cancel removes a scheduled message that has not been published yet
+func (s *Scheduler) Cancel(id string) error {
+	if s.store.StorageAPI == nil {
+		return ErrStoreNotStarted
+	}
+
+	_, err := s.store.StorageAPI.DeleteKey(scheduleKeyPrefix + id)
+	return err
+}
+
+// Start checks for due messages in the background until Stop() is called, it should be called on every node
+// so the schedule keeps running when the leader changes.
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				s.publishDue(now)
+			}
+		}
+	}(s.stop)
+}
+
+// Stop stops checking for due messages
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// publishDue publishes the messages that are due in the order they were scheduled for and removes them from
+// the store, it does nothing unless this node is the leader. Fired messages that could not be removed are
+// removed on a later check.
+func (s *Scheduler) publishDue(now time.Time) {
+	api := s.store.StorageAPI
+	if api == nil || !api.IsLeader() {
+		return
+	}
+
+	var due []scheduledMessage
+	for _, key := range api.ListKeys(scheduleKeyPrefix) {
+		kv, err := api.GetKey(key)
+		if err != nil {
+			continue
+		}
+
+		var msg scheduledMessage
+		if err = json.Unmarshal([]byte(kv.Node.Value), &msg); err != nil {
+			s.store.log().WithFields(logrus.Fields{
+				"prefix": "distributed_store.scheduler",
+				"key":    key,
+			}).Error("Failed to decode scheduled message: ", err)
+			continue
+		}
+
+		if !msg.At.After(now) {
+			due = append(due, msg)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].At.Before(due[j].At)
+	})
+
+	for _, msg := range due {
+		if !msg.Fired && !s.fire(msg) {
+			continue
+		}
+
+		if _, err := api.DeleteKey(scheduleKeyPrefix + msg.ID); err != nil {
+			s.store.log().WithFields(logrus.Fields{
+				"prefix": "distributed_store.scheduler",
+				"topic":  msg.Topic,
+			}).Error("Failed to remove published message from schedule: ", err)
+		}
+	}
+}
+
+// fire marks the message as fired in the store and publishes it, the mark is removed again if the publish
+// fails so the message is retried. It returns false if the message is not fired.
+func (s *Scheduler) fire(msg scheduledMessage) bool {
+	if err := s.setFired(msg, true); err != nil {
+		s.store.log().WithFields(logrus.Fields{
+			"prefix": "distributed_store.scheduler",
+			"topic":  msg.Topic,
+		}).Error("Failed to mark scheduled message as fired, will retry: ", err)
+		return false
+	}
+
+	err := s.publish(msg)
+	if err == nil {
+		return true
+	}
+
+	s.store.log().WithFields(logrus.Fields{
+		"prefix": "distributed_store.scheduler",
+		"topic":  msg.Topic,
+	}).Error("Failed to publish scheduled message, will retry: ", err)
+
+	if err = s.setFired(msg, false); err != nil {
+		s.store.log().WithFields(logrus.Fields{
+			"prefix": "distributed_store.scheduler",
+			"topic":  msg.Topic,
+		}).Error("Failed to unmark scheduled message, it will not be published: ", err)
+		return true
+	}
+	return false
+}
+
+func (s *Scheduler) setFired(msg scheduledMessage, fired bool) error {
+	msg.Fired = fired
+	asJSON, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.store.StorageAPI.UpdateKey(scheduleKeyPrefix+msg.ID, string(asJSON), 0)
+	return err
+}
+
+func (s *Scheduler) publish(msg scheduledMessage) error {
+	payload, err := payloads.NewPayload(struct{}{})
+	if err != nil {
+		return err
+	}
+
+	if err = payloads.Unmarshal(payload, msg.Payload, encoding.JSON); err != nil {
+		return err
+	}
+
+	return s.publisher.Publish(msg.Topic, payload)
+}
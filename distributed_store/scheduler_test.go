@@ -0,0 +1,132 @@
+package tcf
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/distributed_store/rafty"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+type testPublisher struct {
+	mu        sync.Mutex
+	published []payloads.Payload
+}
+
+func (p *testPublisher) Publish(topic string, payload payloads.Payload) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payload.SetTopic(topic)
+	p.published = append(p.published, payload)
+	return nil
+}
+
+func (p *testPublisher) Published() []payloads.Payload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]payloads.Payload{}, p.published...)
+}
+
+func TestScheduler(t *testing.T) {
+	os.RemoveAll("raft-test-scheduler")
+	defer os.RemoveAll("raft-test-scheduler")
+
+	ds, err := NewDistributedStore(&rafty.Config{
+		HttpServerAddr:        "127.0.0.1:11110",
+		RaftServerAddress:     "127.0.0.1:11210",
+		RaftDir:               "./raft-test-scheduler",
+		RunInSingleServerMode: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.SetLogger(logging.Discard())
+
+	if err = ds.Start("", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Stop()
+
+	for i := 0; !ds.StorageAPI.IsLeader(); i++ {
+		if i == 100 {
+			t.Fatal("Store did not become leader")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	schedulerInterval = 50 * time.Millisecond
+	publisher := &testPublisher{}
+	s := NewScheduler(ds, publisher)
+
+	newPayload := func(msg string) payloads.Payload {
+		p, err := payloads.NewPayload(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	later, err := s.PublishAfter("tcf.test.schedule", newPayload("later"), 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := newPayload("now")
+	if _, err = s.PublishAt("tcf.test.schedule", now, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if now.GetHeader(payloads.HeaderMessageID) != "" {
+		t.Fatal("Scheduling should not change the payload")
+	}
+
+	cancelled, err := s.PublishAfter("tcf.test.schedule", newPayload("cancelled"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Cancel(cancelled); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message that was fired by an earlier leader is only removed
+	fired, err := json.Marshal(scheduledMessage{ID: "fired", Topic: "tcf.test.schedule", At: time.Now(), Fired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ds.StorageAPI.CreateKey(scheduleKeyPrefix+"fired", string(fired), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	defer s.Stop()
+
+	time.Sleep(time.Second)
+
+	published := publisher.Published()
+	if len(published) != 2 {
+		t.Fatalf("Expected 2 published messages, got: %v", len(published))
+	}
+
+	for i, expect := range []string{"now", "later"} {
+		var msg string
+		if err = published[i].DecodeMessage(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg != expect || published[i].GetTopic() != "tcf.test.schedule" {
+			t.Fatalf("Expected %v on the topic, got: %v on %v", expect, msg, published[i].GetTopic())
+		}
+	}
+
+	if id := published[1].GetHeader(payloads.HeaderMessageID); id != later {
+		t.Fatalf("Expected the schedule ID as message ID, got: %v", id)
+	}
+
+	if keys := ds.StorageAPI.ListKeys(scheduleKeyPrefix); len(keys) != 0 {
+		t.Fatalf("Expected the schedule to be empty, got: %v", keys)
+	}
+}
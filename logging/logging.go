@@ -0,0 +1,77 @@
+// Package logging defines the logger interface accepted by TCF clients, servers, the bus and the
+// distributed store. The interface deliberately has no Fatal or Panic methods: TCF is embedded in
+// host processes such as the gateway and must report failures instead of terminating them.
+package logging
+
+import (
+	"github.com/TykTechnologies/logrus"
+	logger "github.com/TykTechnologies/tykcommon-logger"
+)
+
+// Logger is a structured logger, use FromLogrus to adapt a logrus logger or entry
+type Logger interface {
+	WithFields(fields map[string]interface{}) Logger
+
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warning(args ...interface{})
+	Warningf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// FromLogrus adapts a *logrus.Logger or *logrus.Entry to a Logger
+func FromLogrus(l logrus.FieldLogger) Logger {
+	return logrusLogger{l}
+}
+
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+func (l logrusLogger) WithFields(fields map[string]interface{}) Logger {
+	return logrusLogger{l.l.WithFields(logrus.Fields(fields))}
+}
+
+func (l logrusLogger) Debug(args ...interface{})                   { l.l.Debug(args...) }
+func (l logrusLogger) Debugf(format string, args ...interface{})   { l.l.Debugf(format, args...) }
+func (l logrusLogger) Info(args ...interface{})                    { l.l.Info(args...) }
+func (l logrusLogger) Infof(format string, args ...interface{})    { l.l.Infof(format, args...) }
+func (l logrusLogger) Warning(args ...interface{})                 { l.l.Warning(args...) }
+func (l logrusLogger) Warningf(format string, args ...interface{}) { l.l.Warningf(format, args...) }
+func (l logrusLogger) Error(args ...interface{})                   { l.l.Error(args...) }
+func (l logrusLogger) Errorf(format string, args ...interface{})   { l.l.Errorf(format, args...) }
+
+var defaultLogger = FromLogrus(logger.GetLogger())
+
+// Default returns the shared tykcommon logger, it is used by components that have no logger set
+func Default() Logger {
+	return defaultLogger
+}
+
+// OrDefault returns l, or the default logger if l is nil
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
+
+// Discard returns a logger that drops everything
+func Discard() Logger {
+	return discard{}
+}
+
+type discard struct{}
+
+func (d discard) WithFields(fields map[string]interface{}) Logger { return d }
+func (discard) Debug(args ...interface{})                         {}
+func (discard) Debugf(format string, args ...interface{})         {}
+func (discard) Info(args ...interface{})                          {}
+func (discard) Infof(format string, args ...interface{})          {}
+func (discard) Warning(args ...interface{})                       {}
+func (discard) Warningf(format string, args ...interface{})       {}
+func (discard) Error(args ...interface{})                         {}
+func (discard) Errorf(format string, args ...interface{})         {}
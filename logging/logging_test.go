@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/logrus"
+)
+
+func TestFromLogrus(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.Out = &buf
+	l.Formatter = &logrus.TextFormatter{DisableColors: true}
+
+	FromLogrus(l).WithFields(logrus.Fields{
+		"prefix": "tcf.test",
+	}).Error("Something failed: ", "reason")
+
+	out := buf.String()
+	if !strings.Contains(out, "prefix=tcf.test") || !strings.Contains(out, "Something failed: reason") {
+		t.Fatalf("Unexpected log output: %v", out)
+	}
+}
+
+func TestOrDefault(t *testing.T) {
+	if OrDefault(nil) != Default() {
+		t.Fatal("Expected the default logger for nil")
+	}
+
+	d := Discard()
+	if OrDefault(d) != d {
+		t.Fatal("Expected the logger that was passed in")
+	}
+
+	// Must not panic
+	d.WithFields(map[string]interface{}{"prefix": "tcf.test"}).Error("dropped")
+}
@@ -0,0 +1,417 @@
+// Package membership keeps a table of the live nodes of a cluster. Every node announces itself on a
+// topic of a tcf client, nodes that stop announcing are first suspected and then declared dead.
+package membership
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/client"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// DefaultTopic is the topic members announce themselves on
+const DefaultTopic = "tcf.cluster.members"
+
+var ErrAlreadyStarted = errors.New("Membership already started")
+
+// State is the health of a member as seen by this node
+type State int
+
+const (
+	// Alive members announced themselves within the suspect timeout
+	Alive State = iota
+	// Suspect members missed their announcements for longer than the suspect timeout
+	Suspect
+	// Dead members missed their announcements for longer than the dead timeout, or left
+	Dead
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+// Member is a node of the cluster
+type Member struct {
+	ID       string
+	Address  string
+	Role     string
+	Metadata map[string]string
+	State    State
+	// Joined is when this node first heard of the member, LastSeen when it last announced itself
+	Joined   time.Time
+	LastSeen time.Time
+}
+
+// MemberHook is called when a member joins or leaves
+type MemberHook func(Member)
+
+// Config describes the local node and the failure detection timeouts
+type Config struct {
+	// Topic defaults to DefaultTopic
+	Topic string
+	// ID defaults to the ID of the client
+	ID       string
+	Address  string
+	Role     string
+	Metadata map[string]string
+
+	// Interval is the time between announcements, it defaults to one second
+	Interval time.Duration
+	// Jitter delays each announcement by a random duration up to it
+	Jitter time.Duration
+	// SuspectAfter defaults to three intervals, DeadAfter to ten and at least SuspectAfter
+	SuspectAfter time.Duration
+	DeadAfter    time.Duration
+}
+
+// announcement is what members publish, Leaving is set when a member stops
+type announcement struct {
+	ID       string
+	Address  string
+	Role     string
+	Metadata map[string]string
+	Leaving  bool
+}
+
+// Membership announces the local node and tracks the other members of the cluster
+type Membership struct {
+	client client.Client
+	config Config
+	logger logging.Logger
+
+	mu       sync.Mutex
+	self     Member
+	members  map[string]*Member
+	onJoin   MemberHook
+	onLeave  MemberHook
+	stopChan chan struct{}
+}
+
+// New creates the membership of a connected client, call Start() to join the cluster
+func New(c client.Client, config Config) *Membership {
+	if config.Topic == "" {
+		config.Topic = DefaultTopic
+	}
+	if config.ID == "" {
+		config.ID = c.GetID()
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.SuspectAfter <= 0 {
+		config.SuspectAfter = 3 * config.Interval
+	}
+	if config.DeadAfter <= 0 {
+		config.DeadAfter = 10 * config.Interval
+	}
+	if config.DeadAfter < config.SuspectAfter {
+		config.DeadAfter = config.SuspectAfter
+	}
+
+	metadata := make(map[string]string, len(config.Metadata))
+	for k, v := range config.Metadata {
+		metadata[k] = v
+	}
+
+	now := time.Now()
+	return &Membership{
+		client: c,
+		config: config,
+		self: Member{
+			ID:       config.ID,
+			Address:  config.Address,
+			Role:     config.Role,
+			Metadata: metadata,
+			Joined:   now,
+			LastSeen: now,
+		},
+		members: make(map[string]*Member),
+	}
+}
+
+// SetOnJoin sets a hook that is called when a member is first seen
+func (m *Membership) SetOnJoin(hook MemberHook) {
+	m.mu.Lock()
+	m.onJoin = hook
+	m.mu.Unlock()
+}
+
+// SetOnLeave sets a hook that is called when a member leaves or is declared dead
+func (m *Membership) SetOnLeave(hook MemberHook) {
+	m.mu.Lock()
+	m.onLeave = hook
+	m.mu.Unlock()
+}
+
+// SetMetadata sets a metadata value of the local node, it is sent with the next announcement
+func (m *Membership) SetMetadata(key, value string) {
+	m.mu.Lock()
+	m.self.Metadata[key] = value
+	m.mu.Unlock()
+}
+
+// Start subscribes to the announcements of the other members and starts announcing the local node, the
+// client must support broadcast options
+func (m *Membership) Start() error {
+	m.mu.Lock()
+	if m.stopChan != nil {
+		m.mu.Unlock()
+		return ErrAlreadyStarted
+	}
+	m.stopChan = make(chan struct{})
+	stop := m.stopChan
+	m.mu.Unlock()
+
+	_, err := m.client.Subscribe(m.config.Topic, m.handleAnnouncement)
+	if err == nil {
+		err = m.client.BroadcastWithOptions(m.config.Topic, nil, client.BroadcastOptions{
+			Interval: m.config.Interval,
+			Jitter:   m.config.Jitter,
+			Generate: func() (payloads.Payload, error) {
+				return m.announcement(false)
+			},
+		})
+	}
+
+	if err != nil {
+		m.mu.Lock()
+		m.stopChan = nil
+		m.mu.Unlock()
+		return err
+	}
+
+	go m.detectFailures(stop)
+	return nil
+}
+
+// Stop stops announcing the local node and tells the other members it is leaving
+func (m *Membership) Stop() error {
+	m.mu.Lock()
+	if m.stopChan == nil {
+		m.mu.Unlock()
+		return nil
+	}
+	close(m.stopChan)
+	m.stopChan = nil
+	m.mu.Unlock()
+
+	if err := m.client.StopBroadcast(m.config.Topic); err != nil {
+		return err
+	}
+
+	p, err := m.announcement(true)
+	if err != nil {
+		return err
+	}
+	return m.client.Publish(m.config.Topic, p)
+}
+
+// Self returns the local node
+func (m *Membership) Self() Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return copyMember(&m.self)
+}
+
+// Member returns a member by ID, the local node included
+func (m *Membership) Member(id string) (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id == m.self.ID {
+		return copyMember(&m.self), true
+	}
+
+	member, found := m.members[id]
+	if !found {
+		return Member{}, false
+	}
+	return copyMember(member), true
+}
+
+// Members returns the alive and suspect members, the local node included, whose metadata has all the
+// given values. They are ordered by ID.
+func (m *Membership) Members(metadata map[string]string) []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]Member, 0, len(m.members)+1)
+	if matches(&m.self, metadata) {
+		members = append(members, copyMember(&m.self))
+	}
+
+	for _, member := range m.members {
+		if matches(member, metadata) {
+			members = append(members, copyMember(member))
+		}
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+func matches(member *Member, metadata map[string]string) bool {
+	for k, v := range metadata {
+		if member.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func copyMember(member *Member) Member {
+	c := *member
+	c.Metadata = make(map[string]string, len(member.Metadata))
+	for k, v := range member.Metadata {
+		c.Metadata[k] = v
+	}
+	return c
+}
+
+// SetLogger sets the logger of the membership, it should be called before Start()
+func (m *Membership) SetLogger(l logging.Logger) {
+	m.logger = l
+}
+
+func (m *Membership) log() logging.Logger {
+	return logging.OrDefault(m.logger)
+}
+
+func (m *Membership) announcement(leaving bool) (payloads.Payload, error) {
+	m.mu.Lock()
+	a := announcement{
+		ID:       m.self.ID,
+		Address:  m.self.Address,
+		Role:     m.self.Role,
+		Metadata: copyMember(&m.self).Metadata,
+		Leaving:  leaving,
+	}
+	m.mu.Unlock()
+
+	return payloads.NewPayload(a)
+}
+
+func (m *Membership) handleAnnouncement(payload payloads.Payload) {
+	var a announcement
+	if err := payload.DecodeMessage(&a); err != nil {
+		m.log().WithFields(logrus.Fields{
+			"prefix": "tcf.membership",
+		}).Error("Failed to decode announcement: ", err)
+		return
+	}
+
+	if a.ID == "" || a.ID == m.config.ID {
+		return
+	}
+
+	now := time.Now()
+	var hook MemberHook
+	var event Member
+
+	m.mu.Lock()
+	member, found := m.members[a.ID]
+	switch {
+	case a.Leaving:
+		if found {
+			delete(m.members, a.ID)
+			member.State = Dead
+			hook, event = m.onLeave, copyMember(member)
+		}
+	case !found:
+		member = &Member{ID: a.ID, Joined: now}
+		m.members[a.ID] = member
+		hook = m.onJoin
+		fallthrough
+	default:
+		if member.State == Suspect {
+			m.log().WithFields(logrus.Fields{
+				"prefix": "tcf.membership",
+			}).Info("Member is alive again: ", a.ID)
+		}
+		member.Address = a.Address
+		member.Role = a.Role
+		member.Metadata = a.Metadata
+		member.State = Alive
+		member.LastSeen = now
+		event = copyMember(member)
+	}
+	m.mu.Unlock()
+
+	m.memberEvent(hook, event)
+}
+
+// detectFailures checks the members for missed announcements until stop is closed
+func (m *Membership) detectFailures(stop chan struct{}) {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			m.checkMembers(now)
+		}
+	}
+}
+
+// checkMembers suspects members that missed announcements and removes the dead ones
+func (m *Membership) checkMembers(now time.Time) {
+	var dead []Member
+
+	m.mu.Lock()
+	hook := m.onLeave
+	for id, member := range m.members {
+		silent := now.Sub(member.LastSeen)
+		switch {
+		case silent > m.config.DeadAfter:
+			delete(m.members, id)
+			member.State = Dead
+			dead = append(dead, copyMember(member))
+		case silent > m.config.SuspectAfter && member.State == Alive:
+			member.State = Suspect
+			m.log().WithFields(logrus.Fields{
+				"prefix": "tcf.membership",
+			}).Warning("Member is suspect: ", id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, member := range dead {
+		m.log().WithFields(logrus.Fields{
+			"prefix": "tcf.membership",
+		}).Warning("Member is dead: ", member.ID)
+		m.memberEvent(hook, member)
+	}
+}
+
+func (m *Membership) memberEvent(hook MemberHook, member Member) {
+	if hook == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			m.log().WithFields(logrus.Fields{
+				"prefix": "tcf.membership",
+			}).Error("Member hook panicked: ", r)
+		}
+	}()
+
+	hook(member)
+}
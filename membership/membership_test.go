@@ -0,0 +1,195 @@
+package membership
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/client"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// testClient delivers published payloads to the handlers of every client on the same network, only the
+// methods the membership uses are implemented
+type testClient struct {
+	client.Client
+	id      string
+	network *testNetwork
+	stops   map[string]chan struct{}
+}
+
+type testNetwork struct {
+	mu       sync.Mutex
+	handlers map[string][]client.PayloadHandler
+}
+
+func (n *testNetwork) client(id string) *testClient {
+	return &testClient{id: id, network: n, stops: make(map[string]chan struct{})}
+}
+
+func (c *testClient) GetID() string {
+	return c.id
+}
+
+func (c *testClient) Subscribe(topic string, handler client.PayloadHandler) (chan string, error) {
+	c.network.mu.Lock()
+	c.network.handlers[topic] = append(c.network.handlers[topic], handler)
+	c.network.mu.Unlock()
+	return nil, nil
+}
+
+func (c *testClient) Publish(topic string, p payloads.Payload) error {
+	wire, err := payloads.Marshal(p, p.(*payloads.DefaultPayload).Encoding)
+	if err != nil {
+		return err
+	}
+
+	c.network.mu.Lock()
+	handlers := c.network.handlers[topic]
+	c.network.mu.Unlock()
+
+	for _, h := range handlers {
+		received, _ := payloads.NewPayload(struct{}{})
+		if err = payloads.Unmarshal(received, wire, p.(*payloads.DefaultPayload).Encoding); err != nil {
+			return err
+		}
+		h(received)
+	}
+	return nil
+}
+
+func (c *testClient) BroadcastWithOptions(topic string, _ payloads.Payload, opts client.BroadcastOptions) error {
+	stop := make(chan struct{})
+	c.stops[topic] = stop
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(opts.Interval):
+				p, err := opts.Generate()
+				if err == nil {
+					c.Publish(topic, p)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *testClient) StopBroadcast(topic string) error {
+	close(c.stops[topic])
+	return nil
+}
+
+func TestMembership(t *testing.T) {
+	network := &testNetwork{handlers: make(map[string][]client.PayloadHandler)}
+	config := Config{Interval: 10 * time.Millisecond, SuspectAfter: time.Hour, DeadAfter: time.Hour}
+
+	var mu sync.Mutex
+	var joined, left []string
+
+	newMember := func(id, region string) *Membership {
+		config.Role = "gateway"
+		config.Metadata = map[string]string{"region": region}
+		m := New(network.client(id), config)
+		m.SetLogger(logging.Discard())
+		m.SetOnJoin(func(member Member) {
+			mu.Lock()
+			joined = append(joined, id+"<-"+member.ID)
+			mu.Unlock()
+		})
+		m.SetOnLeave(func(member Member) {
+			mu.Lock()
+			left = append(left, id+"<-"+member.ID)
+			mu.Unlock()
+		})
+		return m
+	}
+
+	a := newMember("a", "eu")
+	b := newMember("b", "us")
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	if err := a.Start(); err != ErrAlreadyStarted {
+		t.Fatalf("Expected ErrAlreadyStarted, got: %v", err)
+	}
+
+	b.SetMetadata("version", "2")
+	time.Sleep(100 * time.Millisecond)
+
+	members := a.Members(nil)
+	if len(members) != 2 || members[0].ID != "a" || members[1].ID != "b" {
+		t.Fatalf("Unexpected members: %v", members)
+	}
+	if members[1].Role != "gateway" || members[1].State != Alive || members[1].Metadata["version"] != "2" {
+		t.Fatalf("Unexpected member: %+v", members[1])
+	}
+
+	if us := a.Members(map[string]string{"region": "us"}); len(us) != 1 || us[0].ID != "b" {
+		t.Fatalf("Unexpected members in us: %v", us)
+	}
+
+	if err := b.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := a.Member("b"); found {
+		t.Fatal("Member should be removed when it leaves")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(joined, []string{"a<-b", "b<-a"}) && !reflect.DeepEqual(joined, []string{"b<-a", "a<-b"}) {
+		t.Fatalf("Unexpected joins: %v", joined)
+	}
+	if !reflect.DeepEqual(left, []string{"a<-b"}) {
+		t.Fatalf("Unexpected leaves: %v", left)
+	}
+}
+
+func TestFailureDetection(t *testing.T) {
+	network := &testNetwork{handlers: make(map[string][]client.PayloadHandler)}
+	m := New(network.client("a"), Config{SuspectAfter: time.Second, DeadAfter: 5 * time.Second})
+	m.SetLogger(logging.Discard())
+
+	var left []Member
+	m.SetOnLeave(func(member Member) {
+		left = append(left, member)
+	})
+
+	p, err := payloads.NewPayload(announcement{ID: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.handleAnnouncement(p)
+
+	now := time.Now()
+	m.checkMembers(now.Add(2 * time.Second))
+	if b, _ := m.Member("b"); b.State != Suspect {
+		t.Fatalf("Expected member to be suspect, got: %v", b.State)
+	}
+
+	// An announcement makes a suspect member alive again
+	m.handleAnnouncement(p)
+	if b, _ := m.Member("b"); b.State != Alive {
+		t.Fatalf("Expected member to be alive, got: %v", b.State)
+	}
+
+	m.checkMembers(time.Now().Add(6 * time.Second))
+	if _, found := m.Member("b"); found {
+		t.Fatal("Dead member should be removed")
+	}
+	if len(left) != 1 || left[0].ID != "b" || left[0].State != Dead {
+		t.Fatalf("Unexpected leaves: %v", left)
+	}
+}
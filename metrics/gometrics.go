@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	gometrics "github.com/armon/go-metrics"
+)
+
+// GoMetricsSink sends TCF metrics to a go-metrics sink (statsd, statsite, inmem...), since
+// go-metrics has no notion of labels the label values are appended to the key.
+type GoMetricsSink struct {
+	sink gometrics.MetricSink
+}
+
+// NewGoMetricsSink wraps a go-metrics sink
+func NewGoMetricsSink(s gometrics.MetricSink) *GoMetricsSink {
+	return &GoMetricsSink{sink: s}
+}
+
+func (g *GoMetricsSink) SetGauge(key []string, val float32, labels []Label) {
+	g.sink.SetGauge(flattenLabels(key, labels), val)
+}
+
+func (g *GoMetricsSink) IncrCounter(key []string, val float32, labels []Label) {
+	g.sink.IncrCounter(flattenLabels(key, labels), val)
+}
+
+func (g *GoMetricsSink) AddSample(key []string, val float32, labels []Label) {
+	g.sink.AddSample(flattenLabels(key, labels), val)
+}
+
+func flattenLabels(key []string, labels []Label) []string {
+	flat := make([]string, 0, len(key)+len(labels))
+	flat = append(flat, key...)
+	for _, l := range labels {
+		flat = append(flat, l.Value)
+	}
+
+	return flat
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+)
+
+// Series is the aggregated value of a metric for a set of labels
+type Series struct {
+	Key    []string
+	Labels []Label
+	// Value holds the total of a counter or the last value of a gauge
+	Value float64
+	// Count, Sum, Min and Max aggregate samples
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+// InmemSink aggregates metrics in memory, it is useful in tests and backs the Prometheus handler
+type InmemSink struct {
+	mu       sync.RWMutex
+	counters map[string]*Series
+	gauges   map[string]*Series
+	samples  map[string]*Series
+}
+
+// NewInmemSink returns an empty in-memory sink
+func NewInmemSink() *InmemSink {
+	i := &InmemSink{}
+	i.Reset()
+	return i
+}
+
+// Reset clears all the aggregated metrics
+func (i *InmemSink) Reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.counters = make(map[string]*Series)
+	i.gauges = make(map[string]*Series)
+	i.samples = make(map[string]*Series)
+}
+
+func (i *InmemSink) SetGauge(key []string, val float32, labels []Label) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	getSeries(i.gauges, key, labels).Value = float64(val)
+}
+
+func (i *InmemSink) IncrCounter(key []string, val float32, labels []Label) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	getSeries(i.counters, key, labels).Value += float64(val)
+}
+
+func (i *InmemSink) AddSample(key []string, val float32, labels []Label) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	s := getSeries(i.samples, key, labels)
+	v := float64(val)
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+}
+
+// Counter returns the total of a counter
+func (i *InmemSink) Counter(key []string, labels ...Label) float64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if s, found := i.counters[seriesID(key, labels)]; found {
+		return s.Value
+	}
+	return 0
+}
+
+// Gauge returns the last value of a gauge
+func (i *InmemSink) Gauge(key []string, labels ...Label) float64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if s, found := i.gauges[seriesID(key, labels)]; found {
+		return s.Value
+	}
+	return 0
+}
+
+// Sample returns the aggregated samples
+func (i *InmemSink) Sample(key []string, labels ...Label) Series {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if s, found := i.samples[seriesID(key, labels)]; found {
+		return *s
+	}
+	return Series{Key: key, Labels: labels}
+}
+
+// snapshot returns a copy of all series for each metric type
+func (i *InmemSink) snapshot() (counters, gauges, samples []Series) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return copySeries(i.counters), copySeries(i.gauges), copySeries(i.samples)
+}
+
+func copySeries(m map[string]*Series) []Series {
+	out := make([]Series, 0, len(m))
+	for _, s := range m {
+		out = append(out, *s)
+	}
+	return out
+}
+
+func getSeries(m map[string]*Series, key []string, labels []Label) *Series {
+	id := seriesID(key, labels)
+	s, found := m[id]
+	if !found {
+		s = &Series{
+			Key:    append([]string{}, key...),
+			Labels: append([]Label{}, labels...),
+		}
+		m[id] = s
+	}
+
+	return s
+}
+
+func seriesID(key []string, labels []Label) string {
+	parts := make([]string, 0, len(labels)+1)
+	parts = append(parts, strings.Join(key, "."))
+	for _, l := range labels {
+		parts = append(parts, l.Name+"="+l.Value)
+	}
+
+	return strings.Join(parts, "|")
+}
@@ -0,0 +1,138 @@
+// Package metrics instruments TCF transports, servers and the distributed store. Metrics are
+// labelled by transport and topic and are sent to a pluggable Sink, any go-metrics sink can be
+// used through `NewGoMetricsSink()`, an in-memory sink is provided for tests and can be exposed
+// in the Prometheus text format with `PrometheusHandler()`. Nothing is recorded until a sink is set.
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Label is a name/value pair attached to a metric
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sink receives labelled metrics
+type Sink interface {
+	// SetGauge should retain the last value it is set to
+	SetGauge(key []string, val float32, labels []Label)
+	// IncrCounter should accumulate values
+	IncrCounter(key []string, val float32, labels []Label)
+	// AddSample records timing information
+	AddSample(key []string, val float32, labels []Label)
+}
+
+// Metric keys emitted by TCF
+var (
+	KeyPublished           = []string{"tcf", "messages", "published"}
+	KeyPublishFailed       = []string{"tcf", "messages", "publish_failed"}
+	KeyReceived            = []string{"tcf", "messages", "received"}
+	KeyDecodeFailed        = []string{"tcf", "messages", "decode_failed"}
+	KeyVerifyFailed        = []string{"tcf", "messages", "verify_failed"}
+	KeyHandlerLatency      = []string{"tcf", "handler", "latency_ms"}
+	KeyRelayed             = []string{"tcf", "relay", "messages"}
+	KeyRelayedBytes        = []string{"tcf", "relay", "bytes"}
+	KeyConnectedClients    = []string{"tcf", "server", "connected_clients"}
+	KeyRaftApply           = []string{"tcf", "raft", "apply_ms"}
+	KeyTTLEvictions        = []string{"tcf", "store", "ttl_evictions"}
+	KeyACLDenied           = []string{"tcf", "relay", "acl_denied"}
+	KeyRateLimited         = []string{"tcf", "relay", "rate_limited"}
+	KeyFederationForwarded = []string{"tcf", "federation", "forwarded"}
+	KeyFederationReceived  = []string{"tcf", "federation", "received"}
+	KeyDeadLettered        = []string{"tcf", "messages", "dead_lettered"}
+	KeyDuplicateDropped    = []string{"tcf", "messages", "duplicate_dropped"}
+)
+
+// BlackholeSink discards all metrics, it is the default sink
+type BlackholeSink struct{}
+
+func (BlackholeSink) SetGauge(key []string, val float32, labels []Label)    {}
+func (BlackholeSink) IncrCounter(key []string, val float32, labels []Label) {}
+func (BlackholeSink) AddSample(key []string, val float32, labels []Label)   {}
+
+// FanoutSink sends metrics to multiple sinks
+type FanoutSink []Sink
+
+func (f FanoutSink) SetGauge(key []string, val float32, labels []Label) {
+	for _, s := range f {
+		s.SetGauge(key, val, labels)
+	}
+}
+
+func (f FanoutSink) IncrCounter(key []string, val float32, labels []Label) {
+	for _, s := range f {
+		s.IncrCounter(key, val, labels)
+	}
+}
+
+func (f FanoutSink) AddSample(key []string, val float32, labels []Label) {
+	for _, s := range f {
+		s.AddSample(key, val, labels)
+	}
+}
+
+var (
+	sinkMu     sync.RWMutex
+	globalSink Sink = BlackholeSink{}
+)
+
+// SetSink sets the sink all TCF metrics are sent to, set it to nil to disable metrics
+func SetSink(s Sink) {
+	if s == nil {
+		s = BlackholeSink{}
+	}
+
+	sinkMu.Lock()
+	globalSink = s
+	sinkMu.Unlock()
+}
+
+func sink() Sink {
+	sinkMu.RLock()
+	defer sinkMu.RUnlock()
+	return globalSink
+}
+
+// Transport returns the transport label
+func Transport(name string) Label {
+	return Label{Name: "transport", Value: name}
+}
+
+// Topic returns the topic label
+func Topic(name string) Label {
+	return Label{Name: "topic", Value: name}
+}
+
+// Action returns the label of the operation a metric refers to, e.g. publish or subscribe
+func Action(name string) Label {
+	return Label{Name: "action", Value: name}
+}
+
+// Limit returns the label of the rate limit that applied, e.g. client or topic
+func Limit(name string) Label {
+	return Label{Name: "limit", Value: name}
+}
+
+// SetGauge sets a gauge on the global sink
+func SetGauge(key []string, val float32, labels ...Label) {
+	sink().SetGauge(key, val, labels)
+}
+
+// IncrCounter increments a counter on the global sink
+func IncrCounter(key []string, val float32, labels ...Label) {
+	sink().IncrCounter(key, val, labels)
+}
+
+// AddSample adds a sample on the global sink
+func AddSample(key []string, val float32, labels ...Label) {
+	sink().AddSample(key, val, labels)
+}
+
+// MeasureSince adds a sample of the milliseconds elapsed since start on the global sink
+func MeasureSince(key []string, start time.Time, labels ...Label) {
+	elapsed := time.Since(start)
+	sink().AddSample(key, float32(elapsed)/float32(time.Millisecond), labels)
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+)
+
+func TestInmemSink(t *testing.T) {
+	s := NewInmemSink()
+	SetSink(s)
+	defer SetSink(nil)
+
+	IncrCounter(KeyPublished, 1, Transport("redis"), Topic("foo"))
+	IncrCounter(KeyPublished, 2, Transport("redis"), Topic("foo"))
+	IncrCounter(KeyPublished, 1, Transport("redis"), Topic("bar"))
+	SetGauge(KeyConnectedClients, 3, Transport("mangos"))
+	SetGauge(KeyConnectedClients, 2, Transport("mangos"))
+	AddSample(KeyHandlerLatency, 10, Transport("redis"))
+	AddSample(KeyHandlerLatency, 30, Transport("redis"))
+	MeasureSince(KeyRaftApply, time.Now().Add(-time.Second))
+
+	if v := s.Counter(KeyPublished, Transport("redis"), Topic("foo")); v != 3 {
+		t.Fatalf("Counter incorrect: %v", v)
+	}
+
+	if v := s.Gauge(KeyConnectedClients, Transport("mangos")); v != 2 {
+		t.Fatalf("Gauge incorrect: %v", v)
+	}
+
+	sample := s.Sample(KeyHandlerLatency, Transport("redis"))
+	if sample.Count != 2 || sample.Sum != 40 || sample.Min != 10 || sample.Max != 30 {
+		t.Fatalf("Sample incorrect: %+v", sample)
+	}
+
+	if v := s.Sample(KeyRaftApply).Min; v < 1000 {
+		t.Fatalf("MeasureSince should be in milliseconds, got: %v", v)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	s := NewInmemSink()
+	s.IncrCounter(KeyPublished, 2, []Label{Transport("redis"), Topic(`tcf."quoted"`)})
+	s.SetGauge(KeyConnectedClients, 4, []Label{Transport("mangos")})
+	s.AddSample(KeyHandlerLatency, 1.5, nil)
+
+	rec := httptest.NewRecorder()
+	PrometheusHandler(s).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	expected := []string{
+		"# TYPE tcf_messages_published_total counter",
+		`tcf_messages_published_total{transport="redis",topic="tcf.\"quoted\""} 2`,
+		"# TYPE tcf_server_connected_clients gauge",
+		`tcf_server_connected_clients{transport="mangos"} 4`,
+		"# TYPE tcf_handler_latency_ms summary",
+		"tcf_handler_latency_ms_sum 1.5",
+		"tcf_handler_latency_ms_count 1",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("Missing line: %v\nGot:\n%v", line, body)
+		}
+	}
+}
+
+func TestGoMetricsSink(t *testing.T) {
+	inm := gometrics.NewInmemSink(time.Minute, time.Minute)
+	s := NewGoMetricsSink(inm)
+	s.IncrCounter(KeyReceived, 1, []Label{Transport("bus"), Topic("foo")})
+
+	data := inm.Data()
+	if len(data) == 0 {
+		t.Fatal("No data in go-metrics sink")
+	}
+
+	if _, found := data[0].Counters["tcf.messages.received.bus.foo"]; !found {
+		t.Fatalf("Labels not flattened into the key: %v", data[0].Counters)
+	}
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrometheusHandler exposes the metrics aggregated by an InmemSink in the Prometheus text
+// exposition format. Counters get a `_total` suffix and samples are exposed as summaries.
+func PrometheusHandler(s *InmemSink) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(RenderPrometheus(s))
+	})
+}
+
+// RenderPrometheus renders the metrics aggregated by an InmemSink in the Prometheus text format
+func RenderPrometheus(s *InmemSink) []byte {
+	counters, gauges, samples := s.snapshot()
+	var buf bytes.Buffer
+
+	writeFamilies(&buf, counters, "counter", func(name string, series Series) {
+		fmt.Fprintf(&buf, "%s_total%s %s\n", name, renderLabels(series.Labels), formatFloat(series.Value))
+	})
+	writeFamilies(&buf, gauges, "gauge", func(name string, series Series) {
+		fmt.Fprintf(&buf, "%s%s %s\n", name, renderLabels(series.Labels), formatFloat(series.Value))
+	})
+	writeFamilies(&buf, samples, "summary", func(name string, series Series) {
+		labels := renderLabels(series.Labels)
+		fmt.Fprintf(&buf, "%s_sum%s %s\n", name, labels, formatFloat(series.Sum))
+		fmt.Fprintf(&buf, "%s_count%s %d\n", name, labels, series.Count)
+	})
+
+	return buf.Bytes()
+}
+
+// writeFamilies groups series by metric name so the TYPE line is only written once per name
+func writeFamilies(buf *bytes.Buffer, series []Series, metricType string, write func(string, Series)) {
+	families := make(map[string][]Series)
+	for _, s := range series {
+		name := metricName(s.Key)
+		families[name] = append(families[name], s)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		members := families[name]
+		sort.Sort(byLabels(members))
+
+		typeName := name
+		if metricType == "counter" {
+			typeName = name + "_total"
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", typeName, metricType)
+		for _, s := range members {
+			write(name, s)
+		}
+	}
+}
+
+type byLabels []Series
+
+func (b byLabels) Len() int           { return len(b) }
+func (b byLabels) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLabels) Less(i, j int) bool { return renderLabels(b[i].Labels) < renderLabels(b[j].Labels) }
+
+func metricName(key []string) string {
+	return sanitize(strings.Join(key, "_"), false)
+}
+
+func renderLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = sanitize(l.Name, true) + "=\"" + labelEscaper.Replace(l.Value) + "\""
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// sanitize replaces characters that are not allowed in prometheus metric (or label) names
+func sanitize(name string, isLabel bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r == ':' && !isLabel:
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
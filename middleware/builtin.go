@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// PanicHandler is called by the recovery middleware with the topic and recovered value
+type PanicHandler func(topic string, recovered interface{})
+
+// HandlerFailure is implemented by the panic values handlers report their errors with, the recovery
+// middleware passes them on so the client can retry and dead letter the message
+type HandlerFailure interface {
+	error
+	HandlerFailure()
+}
+
+// TimingHandler is called by the timing middleware with the topic and the time taken
+type TimingHandler func(topic string, took time.Duration)
+
+// InboundLogger logs every inbound payload at debug level
+func InboundLogger(l logrus.FieldLogger) InboundMiddleware {
+	return func(next InboundHandler) InboundHandler {
+		return func(payload payloads.Payload) {
+			l.WithFields(logrus.Fields{
+				"prefix": "tcf.middleware",
+				"topic":  payload.GetTopic(),
+				"from":   payload.From(),
+			}).Debug("Inbound payload")
+			next(payload)
+		}
+	}
+}
+
+// OutboundLogger logs every outbound payload at debug level, and any send error
+func OutboundLogger(l logrus.FieldLogger) OutboundMiddleware {
+	return func(next OutboundHandler) OutboundHandler {
+		return func(topic string, payload payloads.Payload) error {
+			fields := logrus.Fields{
+				"prefix": "tcf.middleware",
+				"topic":  topic,
+			}
+			l.WithFields(fields).Debug("Outbound payload")
+
+			err := next(topic, payload)
+			if err != nil {
+				l.WithFields(fields).Error("Outbound payload failed: ", err)
+			}
+			return err
+		}
+	}
+}
+
+// InboundRecovery recovers from panics in the handlers further down the chain, the
+// PanicHandler may be nil. Handler failures are not recovered.
+func InboundRecovery(onPanic PanicHandler) InboundMiddleware {
+	return func(next InboundHandler) InboundHandler {
+		return func(payload payloads.Payload) {
+			defer func() {
+				r := recover()
+				if _, failed := r.(HandlerFailure); failed {
+					panic(r)
+				}
+				if r != nil && onPanic != nil {
+					onPanic(payload.GetTopic(), r)
+				}
+			}()
+			next(payload)
+		}
+	}
+}
+
+// OutboundRecovery recovers from panics further down the chain and returns them as an error,
+// the PanicHandler may be nil.
+func OutboundRecovery(onPanic PanicHandler) OutboundMiddleware {
+	return func(next OutboundHandler) OutboundHandler {
+		return func(topic string, payload payloads.Payload) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					if onPanic != nil {
+						onPanic(topic, r)
+					}
+					err = fmt.Errorf("Recovered from panic: %v", r)
+				}
+			}()
+			return next(topic, payload)
+		}
+	}
+}
+
+// InboundTimer reports how long the rest of the chain took to handle a payload
+func InboundTimer(report TimingHandler) InboundMiddleware {
+	return func(next InboundHandler) InboundHandler {
+		return func(payload payloads.Payload) {
+			start := time.Now()
+			next(payload)
+			report(payload.GetTopic(), time.Since(start))
+		}
+	}
+}
+
+// OutboundTimer reports how long the rest of the chain took to send a payload
+func OutboundTimer(report TimingHandler) OutboundMiddleware {
+	return func(next OutboundHandler) OutboundHandler {
+		return func(topic string, payload payloads.Payload) error {
+			start := time.Now()
+			err := next(topic, payload)
+			report(topic, time.Since(start))
+			return err
+		}
+	}
+}
+
+// HeaderInjector sets the headers on every outbound payload, existing values are overwritten.
+func HeaderInjector(headers map[string]string) OutboundMiddleware {
+	return func(next OutboundHandler) OutboundHandler {
+		return func(topic string, payload payloads.Payload) error {
+			if payload != nil {
+				for k, v := range headers {
+					payload.SetHeader(k, v)
+				}
+			}
+			return next(topic, payload)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Package middleware provides composable interceptors for inbound and outbound payloads, so that
+// cross-cutting behaviour (logging, recovery, timing, header injection) does not need to be
+// duplicated in every handler. Clients, the bus and the mangos server all expose `Use()` and
+// `UseOutbound()` to register middleware against their message flow.
+package middleware
+
+import (
+	"sync"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// InboundHandler handles a decoded payload, it has the same signature as client.PayloadHandler
+type InboundHandler func(payload payloads.Payload)
+
+// OutboundHandler sends a payload to a topic
+type OutboundHandler func(topic string, payload payloads.Payload) error
+
+// InboundMiddleware wraps an InboundHandler, a middleware can drop a message by not calling next
+type InboundMiddleware func(next InboundHandler) InboundHandler
+
+// OutboundMiddleware wraps an OutboundHandler, a middleware can drop a message by not calling next
+type OutboundMiddleware func(next OutboundHandler) OutboundHandler
+
+// Chain holds the registered inbound and outbound middleware for a transport, the first middleware
+// registered is the outermost one and will be called first.
+type Chain struct {
+	mu       sync.RWMutex
+	inbound  []InboundMiddleware
+	outbound []OutboundMiddleware
+}
+
+// NewChain returns an empty middleware chain
+func NewChain() *Chain {
+	return &Chain{}
+}
+
+// Use adds inbound middleware to the chain
+func (c *Chain) Use(m ...InboundMiddleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inbound = append(c.inbound, m...)
+}
+
+// UseOutbound adds outbound middleware to the chain
+func (c *Chain) UseOutbound(m ...OutboundMiddleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outbound = append(c.outbound, m...)
+}
+
+// HasInbound returns true if any inbound middleware is registered
+func (c *Chain) HasInbound() bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.inbound) > 0
+}
+
+// WrapInbound wraps the handler with all the registered inbound middleware, it is safe to call
+// on a nil chain.
+func (c *Chain) WrapInbound(h InboundHandler) InboundHandler {
+	if c == nil {
+		return h
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i := len(c.inbound) - 1; i >= 0; i-- {
+		h = c.inbound[i](h)
+	}
+
+	return h
+}
+
+// WrapOutbound wraps the handler with all the registered outbound middleware, it is safe to call
+// on a nil chain.
+func (c *Chain) WrapOutbound(h OutboundHandler) OutboundHandler {
+	if c == nil {
+		return h
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i := len(c.outbound) - 1; i >= 0; i-- {
+		h = c.outbound[i](h)
+	}
+
+	return h
+}
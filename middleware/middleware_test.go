@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+func TestChain(t *testing.T) {
+	t.Run("Nil chain", func(t *testing.T) {
+		var c *Chain
+		var called bool
+		c.WrapInbound(func(p payloads.Payload) { called = true })(nil)
+		if !called {
+			t.Fatal("Handler should be called on a nil chain")
+		}
+	})
+
+	t.Run("Inbound order", func(t *testing.T) {
+		var order []string
+		mw := func(name string) InboundMiddleware {
+			return func(next InboundHandler) InboundHandler {
+				return func(p payloads.Payload) {
+					order = append(order, name)
+					next(p)
+				}
+			}
+		}
+
+		c := NewChain()
+		c.Use(mw("a"), mw("b"))
+		c.WrapInbound(func(p payloads.Payload) { order = append(order, "handler") })(nil)
+
+		if len(order) != 3 || order[0] != "a" || order[1] != "b" || order[2] != "handler" {
+			t.Fatalf("Incorrect call order: %v", order)
+		}
+	})
+
+	t.Run("Outbound drop", func(t *testing.T) {
+		c := NewChain()
+		c.UseOutbound(func(next OutboundHandler) OutboundHandler {
+			return func(topic string, p payloads.Payload) error {
+				return errors.New("dropped")
+			}
+		})
+
+		var called bool
+		err := c.WrapOutbound(func(topic string, p payloads.Payload) error {
+			called = true
+			return nil
+		})("foo", nil)
+
+		if err == nil || called {
+			t.Fatal("Outbound middleware should have dropped the message")
+		}
+	})
+}
+
+type testFailure struct{}
+
+func (testFailure) Error() string   { return "failed" }
+func (testFailure) HandlerFailure() {}
+
+func TestBuiltins(t *testing.T) {
+	p, err := payloads.NewPayload("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetTopic("tcf.test.middleware")
+
+	t.Run("Inbound recovery", func(t *testing.T) {
+		var recovered interface{}
+		h := InboundRecovery(func(topic string, r interface{}) {
+			recovered = r
+		})(func(p payloads.Payload) {
+			panic("boom")
+		})
+
+		h(p)
+		if recovered != "boom" {
+			t.Fatalf("Panic not recovered: %v", recovered)
+		}
+	})
+
+	t.Run("Inbound recovery passes handler failures", func(t *testing.T) {
+		failure := testFailure{}
+		defer func() {
+			if r := recover(); r != failure {
+				t.Fatalf("Handler failure should not be recovered, got: %v", r)
+			}
+		}()
+
+		InboundRecovery(nil)(func(p payloads.Payload) {
+			panic(failure)
+		})(p)
+	})
+
+	t.Run("Outbound recovery", func(t *testing.T) {
+		err := OutboundRecovery(nil)(func(topic string, p payloads.Payload) error {
+			panic("boom")
+		})("foo", p)
+
+		if err == nil {
+			t.Fatal("Panic should be returned as an error")
+		}
+	})
+
+	t.Run("Timer", func(t *testing.T) {
+		var took time.Duration
+		var onTopic string
+		InboundTimer(func(topic string, d time.Duration) {
+			onTopic = topic
+			took = d
+		})(func(p payloads.Payload) {
+			time.Sleep(10 * time.Millisecond)
+		})(p)
+
+		if onTopic != "tcf.test.middleware" || took < 10*time.Millisecond {
+			t.Fatalf("Timing incorrect: %v %v", onTopic, took)
+		}
+	})
+
+	t.Run("Header injection", func(t *testing.T) {
+		err := HeaderInjector(map[string]string{"x-node": "foo"})(func(topic string, p payloads.Payload) error {
+			if p.GetHeader("x-node") != "foo" {
+				t.Fatalf("Header not set: %v", p.GetHeaders())
+			}
+			return nil
+		})("foo", p)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
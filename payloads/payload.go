@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	tykenc "github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,6 +22,9 @@ type Payload interface {
 	TimeStamp() time.Time
 	From() string
 	SetFrom(string)
+	SetHeader(string, string)
+	GetHeader(string) string
+	GetHeaders() map[string]string
 }
 
 // DefaultPayload is the default payload that is used by TCF
@@ -31,6 +36,7 @@ type DefaultPayload struct {
 	Time       int64
 	Topic      string
 	FromID     string
+	Headers    map[string]string `json:",omitempty"`
 }
 
 // TimeStamp will set the TS of the payload
@@ -54,6 +60,133 @@ func (p *DefaultPayload) GetTopic() string {
 	return p.Topic
 }
 
+// SetHeader will set a header value on the payload envelope, headers are not signed
+func (p *DefaultPayload) SetHeader(key, value string) {
+	if p.Headers == nil {
+		p.Headers = make(map[string]string)
+	}
+	p.Headers[key] = value
+}
+
+// GetHeader will return a header value from the payload envelope, or an empty string
+func (p *DefaultPayload) GetHeader(key string) string {
+	return p.Headers[key]
+}
+
+// GetHeaders returns all the headers set on the payload envelope
+func (p *DefaultPayload) GetHeaders() map[string]string {
+	return p.Headers
+}
+
+// HeaderRetain marks a payload as retained, servers keep the last retained payload of a topic and
+// deliver it to new subscribers
+const HeaderRetain = "tcf-retain"
+
+// SetRetained sets or removes the retained flag of a payload
+func SetRetained(p Payload, retained bool) {
+	if retained {
+		p.SetHeader(HeaderRetain, "1")
+		return
+	}
+
+	if p.GetHeader(HeaderRetain) != "" {
+		p.SetHeader(HeaderRetain, "")
+	}
+}
+
+// IsRetained returns true if the retained flag is set on the payload
+func IsRetained(p Payload) bool {
+	return p != nil && p.GetHeader(HeaderRetain) != ""
+}
+
+// HeaderOrigin carries the ID of the server a federated message entered the network on, servers use
+// it to drop messages that loop back to them
+const HeaderOrigin = "tcf-origin"
+
+// SetOrigin sets the ID of the server a payload entered the network on
+func SetOrigin(p Payload, serverID string) {
+	p.SetHeader(HeaderOrigin, serverID)
+}
+
+// Origin returns the ID of the server a payload entered the network on
+func Origin(p Payload) string {
+	if p == nil {
+		return ""
+	}
+	return p.GetHeader(HeaderOrigin)
+}
+
+// HeaderSequence carries the position of a payload in the message log of a server as `log-id:seq`
+const HeaderSequence = "tcf-seq"
+
+// SetSequence stamps a payload with its sequence number in a message log
+func SetSequence(p Payload, logID string, seq uint64) {
+	p.SetHeader(HeaderSequence, logID+":"+strconv.FormatUint(seq, 10))
+}
+
+// Sequence returns the message log and sequence number of a payload, found is false if the payload
+// was not logged
+func Sequence(p Payload) (logID string, seq uint64, found bool) {
+	if p == nil {
+		return "", 0, false
+	}
+
+	h := p.GetHeader(HeaderSequence)
+	i := strings.LastIndex(h, ":")
+	if i < 0 {
+		return "", 0, false
+	}
+
+	seq, err := strconv.ParseUint(h[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return h[:i], seq, true
+}
+
+// HeaderMessageID and HeaderAckTo mark a payload that must be acknowledged, subscribers publish an ack
+// with the message ID to the HeaderAckTo topic once they handled it. With HeaderAckOnReceipt set they
+// acknowledge it as soon as they receive it instead.
+const (
+	HeaderMessageID    = "tcf-msg-id"
+	HeaderAckTo        = "tcf-ack-to"
+	HeaderAckOnReceipt = "tcf-ack-receipt"
+)
+
+// HeaderRelayID and HeaderHops carry the ID of a message relayed across a bus mesh and the number of
+// times it may still be forwarded
+const (
+	HeaderRelayID = "tcf-relay-id"
+	HeaderHops    = "tcf-hops"
+)
+
+// SetRelay stamps a payload with its relay ID and the hops it has left
+func SetRelay(p Payload, id string, hops int) {
+	p.SetHeader(HeaderRelayID, id)
+	p.SetHeader(HeaderHops, strconv.Itoa(hops))
+}
+
+// Relay returns the relay ID of a payload and the hops it has left, found is false if the payload is
+// not relayed
+func Relay(p Payload) (id string, hops int, found bool) {
+	if p == nil {
+		return "", 0, false
+	}
+
+	id = p.GetHeader(HeaderRelayID)
+	if id == "" {
+		return "", 0, false
+	}
+
+	hops, err := strconv.Atoi(p.GetHeader(HeaderHops))
+	if err != nil {
+		return "", 0, false
+	}
+
+	return id, hops, true
+}
+
 // Verify will check the signature if enabled
 func (p *DefaultPayload) Verify() error {
 	if p.Message == nil {
@@ -76,6 +209,10 @@ func (p *DefaultPayload) Verify() error {
 func (p *DefaultPayload) Encode() error {
 	switch p.Encoding {
 	case tykenc.JSON:
+		if p.rawMessage == nil && p.Message != nil {
+			// Decoded payloads only carry the (already signed) wire message, keep it
+			return nil
+		}
 		j, err := json.Marshal(p.rawMessage)
 		if err != nil {
 			return err
@@ -148,5 +285,12 @@ func (p *DefaultPayload) Copy() Payload {
 		FromID:     p.From(),
 	}
 
+	if p.Headers != nil {
+		np.Headers = make(map[string]string, len(p.Headers))
+		for k, v := range p.Headers {
+			np.Headers[k] = v
+		}
+	}
+
 	return np
 }
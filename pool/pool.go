@@ -0,0 +1,187 @@
+// Package pool provides bounded worker pools to run payload handlers, so that a slow or panicking
+// handler cannot block a transport listener or take down the process.
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// BackpressurePolicy defines what happens when a task is submitted to a full queue
+type BackpressurePolicy int
+
+const (
+	// Block will wait until there is space in the queue
+	Block BackpressurePolicy = iota
+	// DropOldest will discard the oldest queued task to make space for the new one
+	DropOldest
+	// DropNewest will discard the task that is being submitted
+	DropNewest
+)
+
+const defaultQueueSize = 1000
+
+var (
+	ErrDropped = errors.New("Queue full, task dropped")
+	ErrStopped = errors.New("Pool is stopped")
+)
+
+// ErrorHook is called when a task panics or is dropped because of backpressure
+type ErrorHook func(err error)
+
+// PanicError wraps a value recovered from a panicking task
+type PanicError struct {
+	Recovered interface{}
+	Stack     []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("Recovered from panic in handler: %v", p.Recovered)
+}
+
+// Options configures a WorkerPool
+type Options struct {
+	// Concurrency is the number of workers, defaults to 1
+	Concurrency int
+	// QueueSize is the number of tasks that can wait for a worker, defaults to 1000
+	QueueSize int
+	// Ordered delivers tasks one at a time in the order they were submitted, this overrides Concurrency
+	Ordered bool
+	// Backpressure sets the policy to apply when the queue is full
+	Backpressure BackpressurePolicy
+	// OnError is called with a *PanicError when a task panics, and with ErrDropped when a task is dropped
+	OnError ErrorHook
+}
+
+// WorkerPool runs submitted tasks on a fixed number of goroutines
+type WorkerPool struct {
+	opts     Options
+	queue    chan func()
+	mu       sync.RWMutex
+	dropMu   sync.Mutex
+	stopped  bool
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New creates a WorkerPool and starts its workers
+func New(opts Options) *WorkerPool {
+	if opts.Concurrency < 1 || opts.Ordered {
+		opts.Concurrency = 1
+	}
+	if opts.QueueSize < 1 {
+		opts.QueueSize = defaultQueueSize
+	}
+
+	p := &WorkerPool{
+		opts:     opts,
+		queue:    make(chan func(), opts.QueueSize),
+		stopChan: make(chan struct{}),
+	}
+
+	for i := 0; i < opts.Concurrency; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+
+	return p
+}
+
+// Submit queues a task, depending on the backpressure policy it may block or drop a task when the
+// queue is full. ErrDropped is returned if the submitted task was dropped.
+func (p *WorkerPool) Submit(task func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stopped {
+		return ErrStopped
+	}
+
+	switch p.opts.Backpressure {
+	case DropNewest:
+		select {
+		case p.queue <- task:
+			return nil
+		default:
+			p.reportError(ErrDropped)
+			return ErrDropped
+		}
+	case DropOldest:
+		p.dropMu.Lock()
+		defer p.dropMu.Unlock()
+		for {
+			select {
+			case p.queue <- task:
+				return nil
+			default:
+			}
+
+			// Make space by discarding the head of the queue
+			select {
+			case <-p.queue:
+				p.reportError(ErrDropped)
+			default:
+			}
+		}
+	default:
+		select {
+		case p.queue <- task:
+			return nil
+		case <-p.stopChan:
+			return ErrStopped
+		}
+	}
+}
+
+// Stop stops accepting tasks, lets the workers drain the queue and waits for them to finish
+func (p *WorkerPool) Stop() {
+	// Unblock any submitters waiting on a full queue before taking the write lock
+	p.dropMu.Lock()
+	select {
+	case <-p.stopChan:
+		p.dropMu.Unlock()
+		return
+	default:
+		close(p.stopChan)
+	}
+	p.dropMu.Unlock()
+
+	p.mu.Lock()
+	p.stopped = true
+	close(p.queue)
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// Len returns the number of tasks waiting in the queue
+func (p *WorkerPool) Len() int {
+	return len(p.queue)
+}
+
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	for task := range p.queue {
+		p.run(task)
+	}
+}
+
+func (p *WorkerPool) run(task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := make([]byte, 4096)
+			stack = stack[:runtime.Stack(stack, false)]
+			p.reportError(&PanicError{Recovered: r, Stack: stack})
+		}
+	}()
+
+	task()
+}
+
+func (p *WorkerPool) reportError(err error) {
+	if p.opts.OnError != nil {
+		p.opts.OnError(err)
+	}
+}
@@ -0,0 +1,109 @@
+package pool
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	t.Run("Ordered delivery", func(t *testing.T) {
+		p := New(Options{Ordered: true, Concurrency: 10})
+		var got []int
+		for i := 0; i < 100; i++ {
+			i := i
+			p.Submit(func() { got = append(got, i) })
+		}
+		p.Stop()
+
+		if len(got) != 100 {
+			t.Fatalf("Expected 100 tasks, got: %v", len(got))
+		}
+		for i, v := range got {
+			if i != v {
+				t.Fatalf("Tasks out of order at %v: %v", i, v)
+			}
+		}
+	})
+
+	t.Run("Panic recovery", func(t *testing.T) {
+		errChan := make(chan error, 1)
+		p := New(Options{OnError: func(err error) { errChan <- err }})
+		p.Submit(func() { panic("boom") })
+
+		select {
+		case err := <-errChan:
+			if pe, ok := err.(*PanicError); !ok || pe.Recovered != "boom" {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Panic was not reported")
+		}
+
+		// The worker must survive the panic
+		done := make(chan struct{})
+		p.Submit(func() { close(done) })
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Worker did not survive panic")
+		}
+		p.Stop()
+	})
+
+	t.Run("Drop newest", func(t *testing.T) {
+		block := make(chan struct{})
+		p := New(Options{QueueSize: 1, Backpressure: DropNewest})
+		p.Submit(func() { <-block })
+		// Give the worker time to pick up the first task
+		time.Sleep(50 * time.Millisecond)
+
+		if err := p.Submit(func() {}); err != nil {
+			t.Fatal("Queue should have space: ", err)
+		}
+		if err := p.Submit(func() {}); err != ErrDropped {
+			t.Fatal("Expected task to be dropped, got: ", err)
+		}
+		close(block)
+		p.Stop()
+	})
+
+	t.Run("Drop oldest", func(t *testing.T) {
+		block := make(chan struct{})
+		var mu sync.Mutex
+		var ran []int
+		dropped := 0
+		p := New(Options{QueueSize: 2, Backpressure: DropOldest, OnError: func(err error) {
+			if err == ErrDropped {
+				dropped++
+			}
+		}})
+		p.Submit(func() { <-block })
+		time.Sleep(50 * time.Millisecond)
+
+		for i := 0; i < 4; i++ {
+			i := i
+			if err := p.Submit(func() {
+				mu.Lock()
+				ran = append(ran, i)
+				mu.Unlock()
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		close(block)
+		p.Stop()
+
+		if dropped != 2 || len(ran) != 2 || ran[0] != 2 || ran[1] != 3 {
+			t.Fatalf("Expected the oldest tasks to be dropped, dropped: %v ran: %v", dropped, ran)
+		}
+	})
+
+	t.Run("Submit after stop", func(t *testing.T) {
+		p := New(Options{})
+		p.Stop()
+		if err := p.Submit(func() {}); err != ErrStopped {
+			t.Fatal("Expected ErrStopped, got: ", err)
+		}
+	})
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/acl"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/transport/tcp"
+	"github.com/go-mangos/mangos/transport/tlstcp"
+)
+
+// ErrNoClientCertificate is returned when a client publisher presents no certificate to the relay
+var ErrNoClientCertificate = errors.New("The client presented no certificate")
+
+// clientAccess tracks the relay connections that carry the subscriptions of clients
+type clientAccess struct {
+	mu    sync.RWMutex
+	ports map[string]mangos.Port
+}
+
+func newClientAccess() *clientAccess {
+	return &clientAccess{
+		ports: make(map[string]mangos.Port),
+	}
+}
+
+func (c *clientAccess) AddPort(remoteAddr string, port mangos.Port) {
+	c.mu.Lock()
+	c.ports[remoteAddr] = port
+	c.mu.Unlock()
+}
+
+func (c *clientAccess) RemovePort(remoteAddr string) {
+	c.mu.Lock()
+	delete(c.ports, remoteAddr)
+	c.mu.Unlock()
+}
+
+// HasPort returns true if the relay connection with the remote address belongs to the host
+func (c *clientAccess) HasPort(host, remoteAddr string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if _, found := c.ports[remoteAddr]; !found {
+		return false
+	}
+
+	h, _, err := net.SplitHostPort(remoteAddr)
+	return err == nil && h == host
+}
+
+// HostPorts returns the relay connections of a client host
+func (c *clientAccess) HostPorts(host string) []mangos.Port {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ports := []mangos.Port{}
+	for remoteAddr, port := range c.ports {
+		if h, _, err := net.SplitHostPort(remoteAddr); err == nil && h == host {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// CommonName returns the TLS identity of a host, it is only set if every relay connection of the host
+// presents a certificate with the same common name, so clients on a host never share an identity
+func (c *clientAccess) CommonName(host string) string {
+	var cn string
+	for _, port := range c.HostPorts(host) {
+		portCN := tlsCommonName(port)
+		if portCN == "" || (cn != "" && portCN != cn) {
+			return ""
+		}
+		cn = portCN
+	}
+	return cn
+}
+
+// SetACL enables access control on the relay, clients may only publish to the topics the policy allows
+// for their identity. Topics that every identity may subscribe to are relayed to all clients, other
+// topics, their retained messages and message log replays only go to the announced subscriptions of
+// clients that may subscribe to them, so they arrive once the server confirmed the subscription. The
+// relay is a single pub socket that filters on the subscriber side, run separate servers for topics
+// that must not cross the network of other clients. The topic of a message is only known if the
+// server uses JSON, with other encodings every publish is denied.
+func (s *MangosServer) SetACL(policy *acl.Policy) {
+	s.acl = policy
+}
+
+// SetTLSConfig makes the relay listen with TLS, the common name of a client certificate is used as the
+// identity of the client. The relay dials client publishers with TLS too and verifies their certificate
+// against the client CAs of the config. It must be called before Listen().
+func (s *MangosServer) SetTLSConfig(cfg *tls.Config) {
+	s.conf.TLSConfig = cfg
+}
+
+// prepareClientSocket adds the transport to a socket that dials back to the publisher of a client,
+// with TLS the client certificate is verified against the CAs the relay accepts client certificates from
+func (s *MangosServer) prepareClientSocket(sock mangos.Socket) error {
+	if s.conf.TLSConfig == nil {
+		sock.AddTransport(tcp.NewTransport())
+		return nil
+	}
+
+	sock.AddTransport(tlstcp.NewTransport())
+	return sock.SetOption(mangos.OptionTLSConfig, s.clientTLSConfig())
+}
+
+// clientTLSConfig verifies the chain of the client certificate without a host name, clients are
+// dialed on their remote address rather than the name in their certificate
+func (s *MangosServer) clientTLSConfig() *tls.Config {
+	cfg := s.conf.TLSConfig.Clone()
+	roots := cfg.ClientCAs
+	if roots == nil {
+		roots = cfg.RootCAs
+	}
+
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return ErrNoClientCertificate
+		}
+
+		certs := make([]*x509.Certificate, len(raw))
+		for i, r := range raw {
+			cert, err := x509.ParseCertificate(r)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+	return cfg
+}
+
+// trackPort records the relay connections of clients
+func (s *MangosServer) trackPort(action mangos.PortAction, port mangos.Port) {
+	remote, err := port.GetProp(mangos.PropRemoteAddr)
+	if err != nil {
+		return
+	}
+
+	addr, ok := remote.(net.Addr)
+	if !ok {
+		return
+	}
+
+	if action == mangos.PortActionRemove {
+		s.access.RemovePort(addr.String())
+		return
+	}
+
+	s.access.AddPort(addr.String(), port)
+}
+
+// identity returns the identity of the client on host, a token identity belongs to the publisher
+// connection it was presented on and is forgotten when that connection closes
+func (s *MangosServer) identity(host string) string {
+	if conn, found := s.connections.Get(host); found {
+		if identity := conn.getIdentity(); identity != "" {
+			return identity
+		}
+	}
+
+	if cn := s.access.CommonName(host); cn != "" {
+		return cn
+	}
+	return acl.Anonymous
+}
+
+func tlsCommonName(port mangos.Port) string {
+	state, err := port.GetProp(mangos.PropTLSConnState)
+	if err != nil {
+		return ""
+	}
+
+	connState, ok := state.(tls.ConnectionState)
+	if !ok || len(connState.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return connState.PeerCertificates[0].Subject.CommonName
+}
+
+func hostOf(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// handleControl processes a control message sent by the client on host
+func (s *MangosServer) handleControl(host, topic string, msg []byte) {
+	_, pl, err := s.decodeRelayMessage(msg)
+	if err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+		}).Error("Failed to decode control message: ", err)
+		return
+	}
+
+	switch topic {
+	case control.HelloTopic:
+		var hello control.Hello
+		if err = pl.DecodeMessage(&hello); err != nil {
+			break
+		}
+		s.handleHello(host, hello)
+
+	case control.SubscribeTopic:
+		var sub control.Subscribe
+		if err = pl.DecodeMessage(&sub); err != nil {
+			break
+		}
+		s.handleSubscribe(host, sub)
+
+	case control.CatchUpTopic:
+		var req control.CatchUp
+		if err = pl.DecodeMessage(&req); err != nil {
+			break
+		}
+		s.handleCatchUp(host, req)
+	}
+
+	if err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+			"topic":  topic,
+		}).Error("Invalid control message: ", err)
+	}
+}
+
+func (s *MangosServer) handleHello(host string, hello control.Hello) {
+	conn, found := s.connections.Get(host)
+	if !found {
+		return
+	}
+	conn.setClientID(hello.ClientID)
+
+	// The hello comes from the current publisher of the host, it replaces the identity of any earlier one
+	conn.setIdentity("")
+	if s.acl != nil && hello.Token != "" {
+		if s.conf.TLSConfig == nil {
+			s.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.MangosServer",
+				"host":   host,
+			}).Warning("Client presented a token without TLS")
+		}
+		s.identify(host, conn, hello.Token)
+	}
+
+	// The hello arrives on the publisher, it is confirmed on the relay connections of the host and other
+	// clients on the host ignore the confirmation for another ID
+	confirm := control.Confirm{Topic: control.HelloTopic, ClientID: hello.ClientID}
+	for _, addr := range conn.portAddrs() {
+		s.confirm(addr, confirm)
+	}
+}
+
+// identify exchanges the token of the client on host for its identity
+func (s *MangosServer) identify(host string, conn *socketMap, token string) {
+	identity, found := s.acl.Identify(token)
+	if !found {
+		metrics.IncrCounter(metrics.KeyACLDenied, 1, metrics.Transport("mangos"), metrics.Action("identify"))
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+			"host":   host,
+		}).Warning("Client presented an unknown token")
+		return
+	}
+
+	conn.setIdentity(identity)
+	s.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.MangosServer",
+		"host":   host,
+	}).Info("Client identified as: ", identity)
+}
+
+func (s *MangosServer) handleSubscribe(host string, sub control.Subscribe) {
+	// Clients can only announce subscriptions for their own connections
+	if !s.access.HasPort(host, sub.LocalAddr) {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+			"host":   host,
+		}).Warning("Ignored subscription announced for an unknown connection: ", sub.LocalAddr)
+		return
+	}
+
+	conn, found := s.connections.Get(host)
+	if !found {
+		return
+	}
+	conn.subscribe(sub.LocalAddr, sub)
+	s.confirm(sub.LocalAddr, control.Confirm{Topic: control.SubscribeTopic, LocalAddr: sub.LocalAddr})
+
+	// New subscribers learn the current state of retained topics straight away
+	s.deliverRetained(host, sub)
+}
+
+// distribute sends a message on the relay. With access control, topics that not every identity may
+// subscribe to are only sent directly to the matching subscriptions of clients that may receive them.
+func (s *MangosServer) distribute(msg []byte) error {
+	if s.acl == nil || !s.decodable() {
+		return s.relay.Send(msg)
+	}
+
+	topic, _ := splitTopic(msg)
+	checked := subscribeTopic(topic)
+	if s.acl.PublicTopic(checked) {
+		return s.relay.Send(msg)
+	}
+
+	for _, conn := range s.connections.All() {
+		addrs := conn.subscribedAddrs(topic)
+		if len(addrs) == 0 {
+			continue
+		}
+
+		identity := s.identity(conn.Host)
+		if !s.acl.CanSubscribe(identity, checked) {
+			s.denied(identity, acl.Subscribe, topic)
+			continue
+		}
+
+		for _, addr := range addrs {
+			if err := s.relay.Send(append([]byte(control.DirectTopic(addr)), msg...)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subscribeTopic is the topic subscribe rules are checked against, directed messages are checked
+// against the topic of the inbox
+func subscribeTopic(topic string) string {
+	if _, inner, ok := control.ParseInbox(topic); ok {
+		return inner
+	}
+	return topic
+}
+
+// confirm sends a confirmation to the relay connection with the remote address
+func (s *MangosServer) confirm(remoteAddr string, c control.Confirm) {
+	pl, err := payloads.NewPayload(c)
+	if err == nil {
+		var msg []byte
+		if msg, err = s.encodeForWire(control.ConfirmTopic, pl); err == nil {
+			err = s.relay.Send(append([]byte(control.DirectTopic(remoteAddr)), msg...))
+		}
+	}
+
+	if err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+			"topic":  c.Topic,
+		}).Error("Failed to confirm control message: ", err)
+	}
+}
+
+// allowRelay checks if the client on host may publish to the topic
+func (s *MangosServer) allowRelay(host, topic string) bool {
+	if s.acl == nil {
+		return true
+	}
+
+	identity := s.identity(host)
+	if s.acl.CanPublish(identity, topic) {
+		return true
+	}
+
+	s.denied(identity, acl.Publish, topic)
+	return false
+}
+
+func (s *MangosServer) denied(identity string, action acl.Action, topic string) {
+	metrics.IncrCounter(metrics.KeyACLDenied, 1, metrics.Transport("mangos"), metrics.Topic(topic), metrics.Action(string(action)))
+	s.Log().WithFields(logrus.Fields{
+		"prefix":   "tcf.MangosServer",
+		"identity": identity,
+		"topic":    topic,
+	}).Warning("Denied ", action)
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
+	"github.com/go-mangos/mangos"
+)
+
+// socketMap is the return connection to the publisher of a client, a client is keyed by its host
+// because the server dials back to one publisher per host.
+type socketMap struct {
+	KillChan chan struct{}
+	Sock     mangos.Socket
+	// Host is the host of the client, it identifies the client for access control
+	Host string
+	// RemoteAddr is the remote address of the first relay connection of the client
+	RemoteAddr string
+	usage      *connectionUsage
+
+	mu       sync.Mutex
+	clientID string
+	// identity was established by the token of the client, it belongs to the current publisher connection
+	identity string
+	// subscriptions maps the remote address of each relay connection to its announced subscription
+	subscriptions map[string]control.Subscribe
+	ports         map[string]struct{}
+}
+
+func newSocketMap(host, remoteAddr string, sock mangos.Socket, usage *connectionUsage) *socketMap {
+	return &socketMap{
+		KillChan:      make(chan struct{}),
+		Sock:          sock,
+		Host:          host,
+		RemoteAddr:    remoteAddr,
+		usage:         usage,
+		subscriptions: make(map[string]control.Subscribe),
+		ports:         map[string]struct{}{remoteAddr: {}},
+	}
+}
+
+func (c *socketMap) addPort(remoteAddr string) {
+	c.mu.Lock()
+	c.ports[remoteAddr] = struct{}{}
+	c.mu.Unlock()
+}
+
+// removePort forgets a relay connection and its subscription, it returns the number of connections left
+func (c *socketMap) removePort(remoteAddr string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.ports, remoteAddr)
+	delete(c.subscriptions, remoteAddr)
+	return len(c.ports)
+}
+
+// portAddrs returns the remote addresses of the relay connections of the client, ordered
+func (c *socketMap) portAddrs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addrs := make([]string, 0, len(c.ports))
+	for addr := range c.ports {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (c *socketMap) setClientID(id string) {
+	c.mu.Lock()
+	c.clientID = id
+	c.mu.Unlock()
+}
+
+func (c *socketMap) setIdentity(identity string) {
+	c.mu.Lock()
+	c.identity = identity
+	c.mu.Unlock()
+}
+
+func (c *socketMap) getIdentity() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.identity
+}
+
+func (c *socketMap) subscribe(remoteAddr string, sub control.Subscribe) {
+	c.mu.Lock()
+	c.subscriptions[remoteAddr] = sub
+	c.mu.Unlock()
+}
+
+// subscriberID returns the ID of the client of a subscription, subscriptions announced without one
+// belong to the client that said hello
+func (c *socketMap) subscriberID(sub control.Subscribe) string {
+	if sub.ClientID != "" {
+		return sub.ClientID
+	}
+	return c.clientID
+}
+
+// inbox returns true if the client knows the node, and whether the node subscribes to the inbox topic
+func (c *socketMap) inbox(nodeID, topic string) (known, subscribed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	known = c.clientID == nodeID
+	for _, sub := range c.subscriptions {
+		if c.subscriberID(sub) != nodeID {
+			continue
+		}
+		known = true
+		if strings.HasPrefix(topic, control.InboxTopic(nodeID, sub.Filter)) {
+			return true, true
+		}
+	}
+	return known, false
+}
+
+// subscribedAddrs returns the remote addresses of the relay connections whose filter matches the topic,
+// directly or through the inbox of the client
+func (c *socketMap) subscribedAddrs(topic string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var addrs []string
+	for addr, sub := range c.subscriptions {
+		id := c.subscriberID(sub)
+		if strings.HasPrefix(topic, sub.Filter) ||
+			(id != "" && strings.HasPrefix(topic, control.InboxTopic(id, sub.Filter))) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (c *socketMap) info(now time.Time) ConnectionInfo {
+	info := c.usage.Info(now)
+	info.RemoteAddr = c.RemoteAddr
+	info.Host = c.Host
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info.ClientID = c.clientID
+	seen := make(map[string]bool)
+	for _, sub := range c.subscriptions {
+		if !seen[sub.Filter] {
+			seen[sub.Filter] = true
+			info.Subscriptions = append(info.Subscriptions, sub.Filter)
+		}
+	}
+	sort.Strings(info.Subscriptions)
+
+	return info
+}
+
+// connectionRegistry holds the connected clients by host, it is safe for concurrent use
+type connectionRegistry struct {
+	mu    sync.RWMutex
+	conns map[string]*socketMap
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{conns: make(map[string]*socketMap)}
+}
+
+func (r *connectionRegistry) Get(host string) (*socketMap, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, found := r.conns[host]
+	return c, found
+}
+
+func (r *connectionRegistry) Add(c *socketMap) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[c.Host] = c
+	return len(r.conns)
+}
+
+func (r *connectionRegistry) Remove(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, host)
+	return len(r.conns)
+}
+
+// All returns the connections ordered by host
+func (r *connectionRegistry) All() []*socketMap {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make([]*socketMap, 0, len(r.conns))
+	for _, c := range r.conns {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Host < all[j].Host })
+
+	return all
+}
+
+// Connections returns the connected clients ordered by host
+func (s *MangosServer) Connections() []ConnectionInfo {
+	now := time.Now()
+	all := s.connections.All()
+	conns := make([]ConnectionInfo, len(all))
+	for i, c := range all {
+		conns[i] = c.info(now)
+	}
+
+	return conns
+}
+
+// SetOnConnect sets a hook that is called when a client connects, hooks are called in order and
+// should not block
+func (s *MangosServer) SetOnConnect(hook ConnectionHook) {
+	s.onConnect = hook
+}
+
+// SetOnDisconnect sets a hook that is called when the last connection of a client closes
+func (s *MangosServer) SetOnDisconnect(hook ConnectionHook) {
+	s.onDisconnect = hook
+}
+
+func (s *MangosServer) connectionEvent(hook ConnectionHook, c *socketMap) {
+	if hook == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.MangosServer",
+			}).Error("Connection hook panicked: ", r)
+		}
+	}()
+
+	hook(c.info(time.Now()))
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/protocol/pub"
+	"github.com/go-mangos/mangos/protocol/sub"
+	"github.com/go-mangos/mangos/transport/tcp"
+	"github.com/go-mangos/mangos/transport/tlstcp"
+)
+
+// federation holds the sockets that connect a server to its peers, messages that enter the network on
+// this server are sent to the peers over out and messages from the peers arrive on the in sockets.
+type federation struct {
+	listenOn string
+	peers    []string
+	out      mangos.Socket
+	in       []mangos.Socket
+}
+
+// SetFederation makes the server part of a federation, it listens for peers on listenOn and connects to
+// the federation address of each peer. Messages relayed by a server are forwarded to its peers once, so
+// every server must be a peer of all other servers. It must be called before Listen().
+func (s *MangosServer) SetFederation(listenOn string, peers ...string) {
+	s.conf.FederationAddr = listenOn
+	s.conf.Peers = peers
+}
+
+// Peers returns the federation addresses of the peers of the server
+func (s *MangosServer) Peers() []string {
+	if s.federation == nil {
+		return []string{}
+	}
+	return s.federation.peers
+}
+
+func (s *MangosServer) transportURL(addr string, sock mangos.Socket) (string, error) {
+	if s.conf.TLSConfig == nil {
+		sock.AddTransport(tcp.NewTransport())
+		return addr, nil
+	}
+
+	sock.AddTransport(tlstcp.NewTransport())
+	if err := sock.SetOption(mangos.OptionTLSConfig, s.conf.TLSConfig); err != nil {
+		return "", fmt.Errorf("can't set TLS config: %s", err.Error())
+	}
+	return strings.Replace(addr, "tcp://", "tls+tcp://", 1), nil
+}
+
+func (s *MangosServer) startFederation() error {
+	if s.conf.FederationAddr == "" {
+		return nil
+	}
+	if !s.decodable() {
+		return ErrUnsupportedEncoding
+	}
+
+	f := &federation{listenOn: s.conf.FederationAddr, peers: s.conf.Peers}
+
+	var err error
+	if f.out, err = pub.NewSocket(); err != nil {
+		return fmt.Errorf("can't get new federation socket: %s", err.Error())
+	}
+
+	listenOn, err := s.transportURL(f.listenOn, f.out)
+	if err != nil {
+		return err
+	}
+
+	if err = f.out.Listen(listenOn); err != nil {
+		return fmt.Errorf("can't listen on federation socket: %s", err.Error())
+	}
+
+	for _, peer := range f.peers {
+		in, err := s.connectToPeer(peer)
+		if err != nil {
+			f.close()
+			return err
+		}
+		f.in = append(f.in, in)
+		go s.receiveFromPeer(peer, in)
+	}
+
+	s.federation = f
+	s.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.MangosServer",
+	}).Info("Federation listening on: ", f.listenOn)
+	return nil
+}
+
+func (s *MangosServer) connectToPeer(peer string) (mangos.Socket, error) {
+	sock, err := sub.NewSocket()
+	if err != nil {
+		return nil, fmt.Errorf("can't get new peer socket: %s", err.Error())
+	}
+
+	addr, err := s.transportURL(peer, sock)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = sock.SetOption(mangos.OptionSubscribe, []byte("")); err != nil {
+		return nil, err
+	}
+
+	// Peers may start in any order, keep dialing in the background until they are up
+	if err = sock.DialOptions(addr, map[string]interface{}{mangos.OptionDialAsynch: true}); err != nil {
+		return nil, fmt.Errorf("can't dial peer %s: %s", peer, err.Error())
+	}
+
+	return sock, nil
+}
+
+func (s *MangosServer) receiveFromPeer(peer string, sock mangos.Socket) {
+	for {
+		msg, err := sock.Recv()
+		if err != nil {
+			if err != mangos.ErrClosed {
+				s.Log().WithFields(logrus.Fields{
+					"prefix": "tcf.MangosServer",
+					"peer":   peer,
+				}).Error("Cannot recv from peer: ", err.Error())
+			}
+			return
+		}
+
+		_, pl, err := s.decodeRelayMessage(msg)
+		if err != nil {
+			s.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.MangosServer",
+				"peer":   peer,
+			}).Error("Failed to decode federated message: ", err)
+			continue
+		}
+
+		// A message that entered the network here has looped back
+		if payloads.Origin(pl) == s.GetID() {
+			continue
+		}
+
+		metrics.IncrCounter(metrics.KeyFederationReceived, 1, metrics.Transport("mangos"))
+		s.relayLocal(msg)
+	}
+}
+
+// forwardToPeers sends a message that entered the network on this server to the federation
+func (s *MangosServer) forwardToPeers(msg []byte) {
+	if s.federation == nil {
+		return
+	}
+
+	topic, pl, err := s.decodeRelayMessage(msg)
+	if err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+		}).Error("Failed to decode message for federation: ", err)
+		return
+	}
+
+	payloads.SetOrigin(pl, s.GetID())
+	data, err := s.encodeForWire(topic, pl)
+	if err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+		}).Error("Failed to encode message for federation: ", err)
+		return
+	}
+
+	if err = s.federation.out.Send(data); err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+		}).Error("Failed to forward to peers: ", err)
+		return
+	}
+	metrics.IncrCounter(metrics.KeyFederationForwarded, 1, metrics.Transport("mangos"))
+}
+
+func (f *federation) close() {
+	for _, sock := range f.in {
+		sock.Close()
+	}
+	if f.out != nil {
+		f.out.Close()
+	}
+}
+
+// stopFederation disconnects the server from its peers
+func (s *MangosServer) stopFederation() {
+	if s.federation == nil {
+		return
+	}
+
+	s.federation.close()
+	s.federation = nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// undeliverable returns true for a directed message to a node that is not connected to this server or
+// does not subscribe to the topic, the publisher is told on the ack topic of the message. Servers in a
+// federation cannot tell where a node is connected, they relay every directed message.
+func (s *MangosServer) undeliverable(topic string, msg []byte) bool {
+	nodeID, _, ok := control.ParseInbox(topic)
+	if !ok || s.conf.FederationAddr != "" {
+		return false
+	}
+
+	reason := control.ReasonUnknownNode
+	for _, conn := range s.connections.All() {
+		known, subscribed := conn.inbox(nodeID, topic)
+		if subscribed {
+			return false
+		}
+		if known {
+			reason = control.ReasonNotSubscribed
+		}
+	}
+
+	s.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.MangosServer",
+		"topic":  topic,
+	}).Debug("Dropped directed message: ", reason)
+
+	_, pl, err := s.decodeRelayMessage(msg)
+	if err != nil {
+		return true
+	}
+
+	ackTo := pl.GetHeader(payloads.HeaderAckTo)
+	id := pl.GetHeader(payloads.HeaderMessageID)
+	if ackTo == "" || id == "" {
+		return true
+	}
+
+	if err = s.sendUndeliverable(ackTo, control.Undeliverable{MessageID: id, SubscriberID: nodeID, Reason: reason}); err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+			"topic":  ackTo,
+		}).Error("Failed to report undeliverable message: ", err)
+	}
+	return true
+}
+
+func (s *MangosServer) sendUndeliverable(ackTo string, u control.Undeliverable) error {
+	pl, err := payloads.NewPayload(u)
+	if err != nil {
+		return err
+	}
+	pl.SetTopic(ackTo)
+
+	msg, err := s.encodeForWire(ackTo, pl)
+	if err != nil {
+		return err
+	}
+	return s.distribute(msg)
+}
@@ -1,29 +1,32 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/acl"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
 	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
 	"github.com/TykTechnologies/tyk-cluster-framework/helpers"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+	"github.com/TykTechnologies/tyk-cluster-framework/middleware"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/TykTechnologies/tyk-cluster-framework/tracing"
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/pub"
 	"github.com/go-mangos/mangos/protocol/sub"
-	"github.com/go-mangos/mangos/transport/tcp"
 	"net"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"github.com/satori/go.uuid"
 )
 
-type socketMap struct {
-	KillChan chan struct{}
-	Sock     mangos.Socket
-}
-
 // MangosServer provides a server implementation to provide as an anchor for a Mangos-based pub/sub network. It
 // will open a return connection to each connected client to enable two-way publishing and relay published
 // messages from clients to the rest of the network so it behaves in a similar way to a redis pub/sub system.
@@ -31,11 +34,23 @@ type socketMap struct {
 type MangosServer struct {
 	listening             bool
 	relay                 mangos.Socket
-	inboundMessageClients map[string]*socketMap
+	connections           *connectionRegistry
+	connectMu             sync.Mutex
+	onConnect             ConnectionHook
+	onDisconnect          ConnectionHook
 	conf                  *MangosServerConf
 	encoding              encoding.Encoding
 	id                    string
 	onPublishHook 	      PublishHook
+	middleware            *middleware.Chain
+	logger                logging.Logger
+	retained              *retainedMessages
+	acl                   *acl.Policy
+	access                *clientAccess
+	limits                RateLimits
+	topicLimits           *topicLimiters
+	federation            *federation
+	msgLog                *messageLog
 }
 
 // MangosServerConf provides the configuration details for a MangosServer
@@ -43,6 +58,12 @@ type MangosServerConf struct {
 	Encoding                   encoding.Encoding
 	listenOn                   string
 	disableConnectionsFromSelf bool
+	// TLSConfig makes the relay listen with TLS when it is set
+	TLSConfig *tls.Config
+	// FederationAddr is where the server listens for peers, federation is disabled when it is empty
+	FederationAddr string
+	// Peers are the federation addresses of the other servers
+	Peers []string
 }
 
 func newMangoConfig(listenOn string, disableConnectionsFromSelf bool) *MangosServerConf {
@@ -56,9 +77,15 @@ func newMangoConfig(listenOn string, disableConnectionsFromSelf bool) *MangosSer
 // init will set up the initial state of the server
 func (s *MangosServer) Init(config interface{}) error {
 	s.conf = config.(*MangosServerConf)
-	s.inboundMessageClients = make(map[string]*socketMap)
-	s.SetEncoding(s.conf.Encoding)
+	s.connections = newConnectionRegistry()
+	if err := s.SetEncoding(s.conf.Encoding); err != nil {
+		return err
+	}
 	s.id = uuid.NewV4().String()
+	s.middleware = middleware.NewChain()
+	s.retained = newRetainedMessages()
+	s.access = newClientAccess()
+	s.topicLimits = newTopicLimiters(RateLimit{})
 
 	return nil
 }
@@ -67,33 +94,25 @@ func (s *MangosServer)  GetID() string {
 	return s.id
 }
 
-// Connections returns a list of connected clients, used mainly in testing
-func (s *MangosServer) Connections() []string {
-	conns := make([]string, len(s.inboundMessageClients))
-	c := 0
-	for addr, _ := range s.inboundMessageClients {
-		conns[c] = addr
-		c += 1
-	}
-
-	return conns
-}
-
 func (s *MangosServer) startListening() error {
 	var err error
 	if s.relay, err = pub.NewSocket(); err != nil {
 		return fmt.Errorf("can't get new pub socket: %s", err)
 	}
 
-	s.relay.AddTransport(tcp.NewTransport())
-	if err = s.relay.Listen(s.conf.listenOn); err != nil {
+	listenOn, err := s.transportURL(s.conf.listenOn, s.relay)
+	if err != nil {
+		return err
+	}
+
+	if err = s.relay.Listen(listenOn); err != nil {
 		return fmt.Errorf("can't listen on pub socket: %s", err.Error())
 	}
 
 	// on connect we need to set up relay
 	s.relay.SetPortHook(s.onPortAction)
 
-	log.WithFields(logrus.Fields{
+	s.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.MangosServer",
 	}).Info("Server listening on: ", s.conf.listenOn)
 	return nil
@@ -102,20 +121,22 @@ func (s *MangosServer) startListening() error {
 func (s *MangosServer) onPortAction(action mangos.PortAction, data mangos.Port) bool {
 	var err error
 
+	s.trackPort(action, data)
+
 	switch action {
 	case mangos.PortActionAdd:
 		if err = s.handleNewConnection(data); err != nil {
-			log.WithFields(logrus.Fields{
+			s.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.MangosServer",
 			}).Error("Could not handle conneciton add: ", err)
 			return false
 		}
 	case mangos.PortActionRemove:
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.MangosServer",
 		}).Debug("Closed inbound connection: ", data.Address())
 		if err = s.handleRemoveConnection(data); err != nil {
-			log.WithFields(logrus.Fields{
+			s.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.MangosServer",
 			}).Error("Could not handle conneciton remove: ", err)
 			return false
@@ -129,7 +150,7 @@ func (s *MangosServer) receiveAndRelay(sock *socketMap) {
 	var err error
 	var msg []byte
 
-	log.WithFields(logrus.Fields{
+	s.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.MangosServer",
 	}).Info("Ready to relay...")
 
@@ -137,58 +158,182 @@ func (s *MangosServer) receiveAndRelay(sock *socketMap) {
 		msg, err = sock.Sock.Recv()
 
 		if err != nil {
-			log.WithFields(logrus.Fields{
+			s.Log().WithFields(logrus.Fields{
 				"prefix": "tcf.MangosServer",
 			}).Error("Cannot recv: ", err.Error())
 			break
 		}
 
-		if pubErr := s.relay.Send(msg); pubErr != nil {
-			log.WithFields(logrus.Fields{
-				"prefix": "tcf.MangosServer",
-			}).Errorf("Failed relay: ", pubErr.Error())
+		if !s.decodable() {
+			s.relayOpaque(sock, msg)
+			continue
 		}
-		log.Debug("[SERVER] Relayed: ", string(msg))
 
-		if s.onPublishHook != nil {
-			s.onPublishHook([]byte{}, msg)
+		topic, _ := splitTopic(msg)
+		if control.IsControlTopic(topic) {
+			s.handleControl(sock.Host, topic, msg)
+			continue
 		}
 
+		// Only the server sends to single connections
+		if strings.HasPrefix(topic, control.DirectPrefix) {
+			s.denied(s.identity(sock.Host), acl.Publish, topic)
+			continue
+		}
+
+		if !s.withinLimits(sock, topic, len(msg)) {
+			continue
+		}
+
+		if !s.allowRelay(sock.Host, topic) {
+			continue
+		}
+
+		if s.undeliverable(topic, msg) {
+			continue
+		}
+
+		if s.middleware.HasInbound() {
+			s.relayThroughMiddleware(msg)
+			continue
+		}
+
+		s.relayRaw(msg)
 	}
 }
 
-func (s *MangosServer) listenForMessagesToRelayForAddress(address string, killChan chan struct{}) error {
-	sock, f := s.inboundMessageClients[address]
-	if !f {
-		return fmt.Errorf("Address not found: %v", address)
+// relayOpaque relays a message the server cannot decode unchanged, only the rate limits of the client
+// apply. The topic is unknown, so access control denies it.
+func (s *MangosServer) relayOpaque(sock *socketMap, msg []byte) {
+	if !s.withinLimits(sock, "", len(msg)) {
+		return
+	}
+
+	if s.acl != nil {
+		s.denied(s.identity(sock.Host), acl.Publish, "")
+		return
+	}
+
+	s.relayLocal(msg)
+}
+
+// relayRaw relays a message from a client and forwards it to the federation
+func (s *MangosServer) relayRaw(msg []byte) {
+	if s.relayLocal(msg) {
+		s.forwardToPeers(msg)
+	}
+}
+
+// relayLocal sends a message to the clients of this server, it returns false if the send failed
+func (s *MangosServer) relayLocal(msg []byte) bool {
+	var topic string
+	if s.decodable() {
+		topic, _ = splitTopic(msg)
+	}
+	labels := []metrics.Label{metrics.Transport("mangos"), metrics.Topic(topic)}
+
+	msg, pubErr := s.sendLogged(msg)
+	if pubErr != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+		}).Error("Failed relay: ", pubErr.Error())
+		metrics.IncrCounter(metrics.KeyPublishFailed, 1, labels...)
+		return false
+	}
+
+	metrics.IncrCounter(metrics.KeyRelayed, 1, labels...)
+	metrics.IncrCounter(metrics.KeyRelayedBytes, float32(len(msg)), labels...)
+	s.observeRetained(msg)
+
+	s.Log().Debug("[SERVER] Relayed: ", string(msg))
+
+	if s.onPublishHook != nil {
+		s.onPublishHook([]byte{}, msg)
+	}
+
+	return true
+}
+
+// relayThroughMiddleware decodes the message so the inbound middleware can inspect it, the payload
+// is re-encoded and relayed once the chain completes.
+func (s *MangosServer) relayThroughMiddleware(msg []byte) {
+	topic, pl, err := s.decodeRelayMessage(msg)
+	if err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+		}).Error("Failed to decode message for middleware, relaying as-is: ", err)
+		s.relayRaw(msg)
+		return
+	}
+
+	s.middleware.WrapInbound(func(p payloads.Payload) {
+		data, err := s.encodeForWire(topic, p)
+		if err != nil {
+			s.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.MangosServer",
+			}).Error("Failed to encode message after middleware: ", err)
+			return
+		}
+		s.relayRaw(data)
+	})(pl)
+}
+
+// ErrUnsupportedEncoding is returned by the features that decode relayed messages, the federation and the
+// message log, when the server does not use JSON
+var ErrUnsupportedEncoding = errors.New("The relay only decodes JSON encoded payloads")
+
+// wirePayloadStart is how every JSON encoded payload begins, it marks the end of the topic prefix
+var wirePayloadStart = []byte(`{"Message":`)
+
+// decodable returns true if the server can decode relayed messages. Messages of other encodings are
+// relayed unchanged, without control messages, middleware, topic limits or retained messages.
+func (s *MangosServer) decodable() bool {
+	return s.encoding == encoding.JSON
+}
+
+// splitTopic separates the topic prefix from the encoded payload of a message on the wire
+func splitTopic(msg []byte) (string, []byte) {
+	i := bytes.Index(msg, wirePayloadStart)
+	if i < 0 {
+		return "", msg
 	}
 
+	return string(msg[:i]), msg[i:]
+}
+
+func (s *MangosServer) decodeRelayMessage(msg []byte) (string, payloads.Payload, error) {
+	topic, data := splitTopic(msg)
+	pl, err := payloads.NewPayload(struct{}{})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err = payloads.Unmarshal(pl, data, s.encoding); err != nil {
+		return "", nil, err
+	}
+
+	return topic, pl, nil
+}
+
+func (s *MangosServer) listenForMessagesToRelay(sock *socketMap) {
 	// Create and listen on the socket, make sure we can kill it
 	go s.receiveAndRelay(sock)
 
-	for {
-		select {
-		case <-killChan:
-			log.WithFields(logrus.Fields{
-				"prefix": "tcf.MangosServerClient",
-			}).Debug("Stopping relay listener for ", address)
-			if err := sock.Sock.Close(); err != nil {
-				log.WithFields(logrus.Fields{
-					"prefix": "tcf.MangosServerClient",
-				}).Warning("Failed to close socket: ", err)
-			}
-			break
-		default:
-			continue
-		}
+	<-sock.KillChan
+	s.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.MangosServerClient",
+	}).Debug("Stopping relay listener for ", sock.Host)
+	if err := sock.Sock.Close(); err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServerClient",
+		}).Warning("Failed to close socket: ", err)
 	}
-	return nil
 }
 
 var ConnectToSelf error = errors.New("Connect to self. Void.")
 
 func (s *MangosServer) connectToClientForMessages(address string) (mangos.Socket, error) {
-	log.WithFields(logrus.Fields{
+	s.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.MangosServer",
 	}).Info("New inbound connection from: ", address)
 
@@ -216,7 +361,7 @@ func (s *MangosServer) connectToClientForMessages(address string) (mangos.Socket
 				}
 
 				if strings.Contains(address, ip.String()) {
-					log.WithFields(logrus.Fields{
+					s.Log().WithFields(logrus.Fields{
 						"prefix": "tcf.MangosServer",
 					}).Info("Connection is from self! skipping.")
 					return nil, ConnectToSelf
@@ -229,7 +374,9 @@ func (s *MangosServer) connectToClientForMessages(address string) (mangos.Socket
 	if cSock, err = sub.NewSocket(); err != nil {
 		return nil, fmt.Errorf("can't get new socket: %s", err.Error())
 	}
-	cSock.AddTransport(tcp.NewTransport())
+	if err = s.prepareClientSocket(cSock); err != nil {
+		return nil, err
+	}
 
 	var e *url.URL
 	if e, err = url.Parse(address); err != nil {
@@ -250,6 +397,9 @@ func (s *MangosServer) connectToClientForMessages(address string) (mangos.Socket
 
 	// The return address must always be inbound port+1 in order to find the correct publisher
 	returnAddress := fmt.Sprintf("%v://%v:%v", u.URL.Scheme, u.Hostname(), strconv.Itoa(p))
+	if s.conf.TLSConfig != nil {
+		returnAddress = strings.Replace(returnAddress, "tcp://", "tls+tcp://", 1)
+	}
 	if err = cSock.Dial(returnAddress); err != nil {
 		return nil, fmt.Errorf("can't dial out on socket: %s", err.Error())
 	}
@@ -259,7 +409,7 @@ func (s *MangosServer) connectToClientForMessages(address string) (mangos.Socket
 		return nil, err
 	}
 
-	log.WithFields(logrus.Fields{
+	s.Log().WithFields(logrus.Fields{
 		"prefix": "tcf.MangosServer",
 	}).Debug("Connecting relay to inbound client: ", returnAddress)
 
@@ -267,19 +417,26 @@ func (s *MangosServer) connectToClientForMessages(address string) (mangos.Socket
 }
 
 func (s *MangosServer) handleNewConnection(data mangos.Port) error {
-	killChan := make(chan struct{})
-	tcpAddr, err := data.GetProp("REMOTE-ADDR")
+	tcpAddr, err := data.GetProp(mangos.PropRemoteAddr)
 	if err != nil {
-		log.Error("Cannot get remote address: ", err)
+		s.Log().Error("Cannot get remote address: ", err)
 		return err
 	}
 
-	addr := fmt.Sprintf("tcp://%v", tcpAddr.(*net.TCPAddr).String())
-	_, f := s.inboundMessageClients[addr]
-	if f {
+	remoteAddr := tcpAddr.(*net.TCPAddr)
+	host := hostOf(remoteAddr)
+
+	s.connectMu.Lock()
+	defer s.connectMu.Unlock()
+
+	// Every subscription of a client opens a connection, but there is only one publisher to relay from
+	if conn, f := s.connections.Get(host); f {
+		conn.addPort(remoteAddr.String())
 		return nil
 	}
 
+	addr := fmt.Sprintf("tcp://%v", remoteAddr.String())
+
 	cSock, err := s.connectToClientForMessages(addr)
 	if err != nil {
 		// TODO: This should be a special case!
@@ -289,44 +446,67 @@ func (s *MangosServer) handleNewConnection(data mangos.Port) error {
 
 		return nil
 	}
-	s.inboundMessageClients[data.Address()] = &socketMap{KillChan: killChan, Sock: cSock}
-	go s.listenForMessagesToRelayForAddress(data.Address(), killChan)
+	conn := newSocketMap(host, remoteAddr.String(), cSock, newConnectionUsage(s.limits.PerClient, time.Now()))
 
+	// Another process can take over the publisher address, it has to present its own token
+	cSock.SetPortHook(func(action mangos.PortAction, port mangos.Port) bool {
+		if action == mangos.PortActionRemove {
+			conn.setIdentity("")
+		}
+		return true
+	})
+
+	count := s.connections.Add(conn)
+	metrics.SetGauge(metrics.KeyConnectedClients, float32(count), metrics.Transport("mangos"))
+	go s.listenForMessagesToRelay(conn)
+
+	s.connectionEvent(s.onConnect, conn)
 	return nil
 }
 
 func (s *MangosServer) handleRemoveConnection(data mangos.Port) error {
-	tcpAddr, err := data.GetProp("REMOTE-ADDR")
+	tcpAddr, err := data.GetProp(mangos.PropRemoteAddr)
 	if err != nil {
-		log.Error("Cannot get remote address: ", err)
+		s.Log().Error("Cannot get remote address: ", err)
 		return err
 	}
 
-	addr := fmt.Sprintf("tcp://%v", tcpAddr.(*net.TCPAddr).String())
-	cSock, f := s.inboundMessageClients[addr]
+	remoteAddr := tcpAddr.(*net.TCPAddr)
+
+	s.connectMu.Lock()
+	defer s.connectMu.Unlock()
 
+	conn, f := s.connections.Get(hostOf(remoteAddr))
 	if !f {
 		return nil
 	}
 
+	// The client is connected until its last subscription closes
+	if conn.removePort(remoteAddr.String()) > 0 {
+		return nil
+	}
+
 	// Don't block on send
 	select {
-	case cSock.KillChan <- struct{}{}:
-		delete(s.inboundMessageClients, data.Address())
+	case conn.KillChan <- struct{}{}:
+		count := s.connections.Remove(conn.Host)
+		metrics.SetGauge(metrics.KeyConnectedClients, float32(count), metrics.Transport("mangos"))
 	case <-time.After(time.Millisecond * 500):
 		return errors.New("Failed to stop listener for leaving client")
 	}
 
+	s.connectionEvent(s.onDisconnect, conn)
 	return nil
 }
 
 func (s *MangosServer) Listen() error {
 	if s.listening == false {
-		err := s.startListening()
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"prefix": "tcf.MangosServer",
-			}).Fatal(err)
+		if err := s.startListening(); err != nil {
+			return fmt.Errorf("Failed to start listening: %s", err.Error())
+		}
+		if err := s.startFederation(); err != nil {
+			s.relay.Close()
+			return fmt.Errorf("Failed to start federation: %s", err.Error())
 		}
 		s.listening = true
 		return nil
@@ -340,7 +520,7 @@ func (s *MangosServer) EnableBroadcast(enabled bool) {
 	// no op
 }
 
-// SetEncoding will set the encoding to use on published payloads
+// SetEncoding will set the encoding to use on published payloads, the relay only decodes JSON payloads
 func (s *MangosServer) SetEncoding(enc encoding.Encoding) error {
 	s.encoding = enc
 	return nil
@@ -349,34 +529,51 @@ func (s *MangosServer) SetEncoding(enc encoding.Encoding) error {
 // Stop will stop the server
 func (s *MangosServer) Stop() error {
 	if s.listening {
+		s.stopFederation()
+		if s.msgLog != nil {
+			s.msgLog.Close()
+		}
 		return s.relay.Close()
 	}
 	return errors.New("Already stopped")
 }
 
 func (s *MangosServer) Publish(filter string, payload payloads.Payload) error {
-	return s.doPublish(filter, payload, true)
+	return tracing.Outbound("mangos")(s.middleware.WrapOutbound(func(filter string, payload payloads.Payload) error {
+		return s.doPublish(filter, payload, true)
+	}))(filter, payload)
 }
 
 func (s *MangosServer) Relay(filter string, payload payloads.Payload) error {
-	return s.doPublish(filter, payload, false)
+	return tracing.Outbound("mangos")(s.middleware.WrapOutbound(func(filter string, payload payloads.Payload) error {
+		return s.doPublish(filter, payload, false)
+	}))(filter, payload)
 }
 
-// Publish will send a Payload from the server to connected clients on the specified topic
-func (s *MangosServer) doPublish(filter string, payload payloads.Payload, withHook bool) error {
-	if payload == nil {
-		return nil
-	}
+// Use adds inbound middleware, it is called for every message relayed by the server
+func (s *MangosServer) Use(m ...middleware.InboundMiddleware) {
+	s.middleware.Use(m...)
+}
 
-	payload.SetTopic(filter)
+// SetLogger sets the logger of the server, it should be called before the server starts listening
+func (s *MangosServer) SetLogger(l logging.Logger) {
+	s.logger = l
+}
 
-	if payload.From() == "" {
-		payload.SetFrom(s.GetID())
-	}
+// Log returns the logger of the server, or the default logger if none was set
+func (s *MangosServer) Log() logging.Logger {
+	return logging.OrDefault(s.logger)
+}
+
+// UseOutbound adds outbound middleware, it is called for every Publish and Relay by the server
+func (s *MangosServer) UseOutbound(m ...middleware.OutboundMiddleware) {
+	s.middleware.UseOutbound(m...)
+}
 
+func (s *MangosServer) encodeForWire(filter string, payload payloads.Payload) ([]byte, error) {
 	data, encErr := payloads.Marshal(payload, s.encoding)
 	if encErr != nil {
-		return encErr
+		return nil, encErr
 	}
 
 	var encodedPayload []byte
@@ -388,21 +585,47 @@ func (s *MangosServer) doPublish(filter string, payload payloads.Payload, withHo
 		encodedPayload = []byte(data.(string))
 		break
 	default:
-		return errors.New("Encoded data is not supported")
+		return nil, errors.New("Encoded data is not supported")
 	}
 
-	asPayload := append([]byte(filter), encodedPayload...)
+	return append([]byte(filter), encodedPayload...), nil
+}
+
+// Publish will send a Payload from the server to connected clients on the specified topic
+func (s *MangosServer) doPublish(filter string, payload payloads.Payload, withHook bool) error {
+	if payload == nil {
+		return nil
+	}
+
+	payload.SetTopic(filter)
+
+	if payload.From() == "" {
+		payload.SetFrom(s.GetID())
+	}
+
+	asPayload, encErr := s.encodeForWire(filter, payload)
+	if encErr != nil {
+		return encErr
+	}
 
 	if len(asPayload) == 0 {
-		log.WithFields(logrus.Fields{
+		s.Log().WithFields(logrus.Fields{
 			"prefix": "tcf.MangosClient",
 		}).Error("No data to send, not sending")
 		return nil
 	}
 
-	if pubErr := s.relay.Send(asPayload); pubErr != nil {
+	asPayload, pubErr := s.sendLogged(asPayload)
+	if pubErr != nil {
+		metrics.IncrCounter(metrics.KeyPublishFailed, 1, metrics.Transport("mangos"), metrics.Topic(filter))
 		return fmt.Errorf("Failed publishing: %s", pubErr.Error())
 	}
+	metrics.IncrCounter(metrics.KeyPublished, 1, metrics.Transport("mangos"), metrics.Topic(filter))
+	s.forwardToPeers(asPayload)
+
+	if s.decodable() && payloads.IsRetained(payload) {
+		s.retained.Set(filter, asPayload)
+	}
 
 	if withHook {
 		if s.onPublishHook != nil {
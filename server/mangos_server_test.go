@@ -1,9 +1,27 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/TykTechnologies/tyk-cluster-framework/acl"
 	"github.com/TykTechnologies/tyk-cluster-framework/client"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
 	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/go-mangos/mangos"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -12,6 +30,35 @@ type testPayloadData struct {
 	FullName string
 }
 
+// testPort is a relay connection without properties
+type testPort struct {
+	mangos.Port
+}
+
+func (testPort) GetProp(name string) (interface{}, error) {
+	return nil, errors.New("No properties")
+}
+
+// recordingSocket records the messages sent on the relay
+type recordingSocket struct {
+	mangos.Socket
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func (r *recordingSocket) Send(msg []byte) error {
+	r.mu.Lock()
+	r.sent = append(r.sent, msg)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *recordingSocket) Sent() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte{}, r.sent...)
+}
+
 func TestMangosServer(t *testing.T) {
 	var s Server
 	var err error
@@ -129,9 +176,828 @@ func TestMangosServer(t *testing.T) {
 		close(resultChan)
 	})
 
+	t.Run("Retained Publish", func(t *testing.T) {
+		var err error
+		var c client.Client
+		resultChan := make(chan testPayloadData, 1)
+		ch := "tcf.test.mangos-server.retained"
+		msg := "Tyk Cluster Framework: Retained"
+
+		// Publish before anyone subscribes, the server must keep the payload
+		var dp payloads.Payload
+		if dp, err = payloads.NewPayload(testPayloadData{msg}); err != nil {
+			t.Fatal(err)
+		}
+		payloads.SetRetained(dp, true)
+
+		if err = s.Publish(ch, dp); err != nil {
+			t.Fatal(err)
+		}
+
+		if c, err = client.NewClient("mangos://127.0.0.1:9100", encoding.JSON); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = c.Subscribe(ch, func(payload payloads.Payload) {
+			var d testPayloadData
+			if err := payload.DecodeMessage(&d); err != nil {
+				t.Fatalf("Decode payload failed: %v", err)
+			}
+
+			select {
+			case resultChan <- d:
+			default:
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case v := <-resultChan:
+			if v.FullName != msg {
+				t.Fatalf("Unexpected return value: %v", v)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Retained payload not delivered")
+		}
+
+		c.Stop()
+	})
+
 	// Test stop
 	if err = s.Stop(); err != nil {
 		t.Fatal(err)
 	}
 
 }
+
+func TestObserveRetained(t *testing.T) {
+	s := &MangosServer{}
+	s.Init(newMangoConfig("tcp://127.0.0.1:9101", false))
+
+	plain, _ := payloads.NewPayload(testPayloadData{"plain"})
+	retained, _ := payloads.NewPayload(testPayloadData{"retained"})
+	payloads.SetRetained(retained, true)
+
+	for topic, p := range map[string]payloads.Payload{"tcf.plain": plain, "tcf.retained": retained} {
+		msg, err := s.encodeForWire(topic, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.observeRetained(msg)
+	}
+
+	if _, found := s.Retained("tcf.plain"); found {
+		t.Fatal("Payload without the retained flag should not be kept")
+	}
+
+	msg, found := s.Retained("tcf.retained")
+	if !found {
+		t.Fatal("Retained payload not kept")
+	}
+
+	_, p, err := s.decodeRelayMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d testPayloadData
+	if err = p.DecodeMessage(&d); err != nil || d.FullName != "retained" {
+		t.Fatalf("Unexpected retained payload: %v %v", d, err)
+	}
+
+	s.ClearRetained("tcf.retained")
+	if _, found = s.Retained("tcf.retained"); found {
+		t.Fatal("Retained payload not cleared")
+	}
+}
+
+func TestDeliverRetained(t *testing.T) {
+	s := &MangosServer{}
+	s.Init(newMangoConfig("tcp://127.0.0.1:9108", false))
+	relay := &recordingSocket{}
+	s.relay = relay
+
+	for _, topic := range []string{"tcf.a.one", "tcf.a.two", "tcf.b"} {
+		p, _ := payloads.NewPayload(testPayloadData{topic})
+		msg, err := s.encodeForWire(topic, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.retained.Set(topic, msg)
+	}
+
+	s.deliverRetained("127.0.0.1", control.Subscribe{Filter: "tcf.a", LocalAddr: "127.0.0.1:5000"})
+
+	sent := relay.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("Expected the 2 matching retained messages, got: %v", len(sent))
+	}
+
+	direct := control.DirectTopic("127.0.0.1:5000")
+	for i, topic := range []string{"tcf.a.one", "tcf.a.two"} {
+		msg, ok := control.StripDirect(sent[i])
+		if !ok || !strings.HasPrefix(string(sent[i]), direct) {
+			t.Fatalf("Retained message not sent to the connection: %s", sent[i])
+		}
+
+		if got, _ := splitTopic(msg); got != topic {
+			t.Fatalf("Expected %v, got: %v", topic, got)
+		}
+	}
+}
+
+func TestSplitTopic(t *testing.T) {
+	s := &MangosServer{}
+	if err := s.Init(newMangoConfig("tcp://127.0.0.1:9107", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ := payloads.NewPayload(testPayloadData{"split"})
+	msg, err := s.encodeForWire("tcf.{braces}", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic, pl, err := s.decodeRelayMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic != "tcf.{braces}" {
+		t.Fatalf("Unexpected topic: %v", topic)
+	}
+
+	var d testPayloadData
+	if err = pl.DecodeMessage(&d); err != nil || d.FullName != "split" {
+		t.Fatalf("Unexpected payload: %v %v", d, err)
+	}
+
+}
+
+func TestRelayOpaque(t *testing.T) {
+	s := &MangosServer{}
+	conf := newMangoConfig("tcp://127.0.0.1:9108", false)
+	conf.Encoding = encoding.NONE
+	if err := s.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	relay := &recordingSocket{}
+	s.relay = relay
+	sock := newSocketMap("10.0.0.1", "10.0.0.1:4000", nil, newConnectionUsage(RateLimit{}, time.Now()))
+
+	// Messages the server cannot decode are relayed unchanged
+	msg := []byte(`tcf.test{"Message":"not json`)
+	s.relayOpaque(sock, msg)
+	if sent := relay.Sent(); len(sent) != 1 || !bytes.Equal(sent[0], msg) {
+		t.Fatalf("Expected the message to be relayed unchanged, got: %q", sent)
+	}
+
+	// Features that decode messages need JSON
+	if err := s.EnableMessageLog(filepath.Join(os.TempDir(), "tcf-opaque.db"), 10); err != ErrUnsupportedEncoding {
+		t.Fatalf("Expected ErrUnsupportedEncoding, got: %v", err)
+	}
+
+	// The topic is unknown, access control denies every message
+	s.SetACL(acl.NewPolicy(&acl.Rules{}))
+	s.relayOpaque(sock, msg)
+	if sent := relay.Sent(); len(sent) != 1 {
+		t.Fatalf("Expected the message to be denied, sent: %v", len(sent))
+	}
+}
+
+func TestRelayAccessControl(t *testing.T) {
+	s := &MangosServer{}
+	s.Init(newMangoConfig("tcp://127.0.0.1:9102", false))
+	relay := &recordingSocket{}
+	s.relay = relay
+
+	s.SetACL(acl.NewPolicy(&acl.Rules{
+		Tokens: map[string]string{"secret": "gateway"},
+		Identities: map[string]acl.Permissions{
+			"gateway": {Publish: acl.TopicRules{Allow: []string{"tcf.gateway.*"}}},
+		},
+	}))
+
+	host := "10.0.0.1"
+	connect := func() *socketMap {
+		conn := newSocketMap(host, host+":5000", nil, newConnectionUsage(RateLimit{}, time.Now()))
+		s.connections.Add(conn)
+		return conn
+	}
+	hello := func(token string) {
+		p, _ := payloads.NewPayload(control.Hello{ClientID: "client-1", Token: token})
+		msg, err := s.encodeForWire(control.HelloTopic, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handleControl(host, control.HelloTopic, msg)
+	}
+
+	conn := connect()
+	if s.allowRelay(host, "tcf.gateway.reload") {
+		t.Fatal("Anonymous clients should be denied")
+	}
+
+	hello("secret")
+
+	// The hello is confirmed on the relay connections of the host
+	confirmed := func(remoteAddr string) control.Confirm {
+		sent := relay.Sent()
+		if len(sent) == 0 {
+			t.Fatal("Expected a confirmation")
+		}
+		last := sent[len(sent)-1]
+		msg, ok := control.StripDirect(last)
+		if !ok || !strings.HasPrefix(string(last), control.DirectTopic(remoteAddr)) {
+			t.Fatalf("Confirmation not sent to %v: %s", remoteAddr, last)
+		}
+		topic, pl, err := s.decodeRelayMessage(msg)
+		var c control.Confirm
+		if err == nil {
+			err = pl.DecodeMessage(&c)
+		}
+		if err != nil || topic != control.ConfirmTopic {
+			t.Fatalf("Unexpected confirmation on %v: %v", topic, err)
+		}
+		return c
+	}
+	if c := confirmed(host + ":5000"); c.Topic != control.HelloTopic || c.ClientID != "client-1" {
+		t.Fatalf("Unexpected confirmation: %+v", c)
+	}
+
+	if !s.allowRelay(host, "tcf.gateway.reload") {
+		t.Fatal("Identified client should be allowed")
+	}
+
+	if s.allowRelay(host, "tcf.cluster.distributed_store.leader") {
+		t.Fatal("Topic outside of the rules should be denied")
+	}
+
+	if s.allowRelay("10.0.0.2", "tcf.gateway.reload") {
+		t.Fatal("Identity must not leak to other hosts")
+	}
+
+	// A new publisher on the host must present its own token
+	hello("")
+	if s.allowRelay(host, "tcf.gateway.reload") {
+		t.Fatal("Identity must not pass to the next publisher of the host")
+	}
+
+	hello("secret")
+	s.connections.Remove(host)
+	connect()
+	if s.allowRelay(host, "tcf.gateway.reload") {
+		t.Fatal("Identity must be forgotten when the client disconnects")
+	}
+
+	// Subscriptions can only be announced for connections of the announcing host
+	s.access.AddPort(host+":5001", testPort{})
+	s.access.AddPort("10.0.0.2:5002", testPort{})
+	s.handleSubscribe(host, control.Subscribe{Filter: "tcf.a", LocalAddr: "10.0.0.2:5002"})
+	s.handleSubscribe(host, control.Subscribe{Filter: "tcf.b", LocalAddr: host + ":5001"})
+	if c := confirmed(host + ":5001"); c.Topic != control.SubscribeTopic || c.LocalAddr != host+":5001" {
+		t.Fatalf("Unexpected confirmation: %+v", c)
+	}
+
+	conn, _ = s.connections.Get(host)
+	if subs := conn.info(time.Now()).Subscriptions; len(subs) != 1 || subs[0] != "tcf.b" {
+		t.Fatalf("Unexpected subscriptions: %v", subs)
+	}
+}
+
+func TestSubscribeAccessControl(t *testing.T) {
+	s := &MangosServer{}
+	s.Init(newMangoConfig("tcp://127.0.0.1:9109", false))
+	relay := &recordingSocket{}
+	s.relay = relay
+
+	s.SetACL(acl.NewPolicy(&acl.Rules{
+		Tokens: map[string]string{"secret": "gateway"},
+		Identities: map[string]acl.Permissions{
+			"gateway":       {Subscribe: acl.TopicRules{Allow: []string{"tcf.gateway.*"}}},
+			acl.AnyIdentity: {Subscribe: acl.TopicRules{Allow: []string{"tcf.shared.*"}}},
+		},
+	}))
+
+	usage := newConnectionUsage(RateLimit{}, time.Now())
+	gateway := newSocketMap("10.0.0.1", "10.0.0.1:5000", nil, usage)
+	gateway.setClientID("gw")
+	gateway.setIdentity("gateway")
+	gateway.subscribe("10.0.0.1:5000", control.Subscribe{Filter: "tcf.gateway"})
+	gateway.subscribe("10.0.0.1:5001", control.Subscribe{Filter: "tcf.shared"})
+	other := newSocketMap("10.0.0.2", "10.0.0.2:5000", nil, usage)
+	other.subscribe("10.0.0.2:5000", control.Subscribe{Filter: "tcf.gateway"})
+	s.connections.Add(gateway)
+	s.connections.Add(other)
+
+	encode := func(topic string) []byte {
+		p, _ := payloads.NewPayload(testPayloadData{topic})
+		msg, err := s.encodeForWire(topic, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// Public topics go to every client on the shared relay
+	if err := s.distribute(encode("tcf.shared.state")); err != nil {
+		t.Fatal(err)
+	}
+	if sent := relay.Sent(); len(sent) != 1 || !strings.HasPrefix(string(sent[0]), "tcf.shared.state") {
+		t.Fatalf("Public topic should be relayed to all: %s", sent)
+	}
+
+	// Restricted topics only go to the subscriptions of clients that may receive them
+	for _, topic := range []string{"tcf.gateway.reload", control.InboxTopic("gw", "tcf.gateway.reload")} {
+		relay.sent = nil
+		if err := s.distribute(encode(topic)); err != nil {
+			t.Fatal(err)
+		}
+		sent := relay.Sent()
+		if len(sent) != 1 || !strings.HasPrefix(string(sent[0]), control.DirectTopic("10.0.0.1:5000")+topic) {
+			t.Fatalf("Restricted topic should only reach the gateway subscription: %s", sent)
+		}
+	}
+
+	relay.sent = nil
+	s.retained.Set("tcf.gateway.reload", encode("tcf.gateway.reload"))
+	s.deliverRetained("10.0.0.2", control.Subscribe{Filter: "tcf.gateway", LocalAddr: "10.0.0.2:5000"})
+	if len(relay.Sent()) != 0 {
+		t.Fatal("Retained messages of restricted topics should be denied")
+	}
+
+	s.deliverRetained("10.0.0.1", control.Subscribe{Filter: "tcf.gateway", LocalAddr: "10.0.0.1:5000"})
+	if len(relay.Sent()) != 1 {
+		t.Fatal("Retained messages should reach clients that may subscribe")
+	}
+}
+
+func TestUndeliverable(t *testing.T) {
+	s := &MangosServer{}
+	s.Init(newMangoConfig("tcp://127.0.0.1:9110", false))
+	relay := &recordingSocket{}
+	s.relay = relay
+
+	// Two clients on one host are told apart by their subscriptions
+	conn := newSocketMap("10.0.0.1", "10.0.0.1:5000", nil, newConnectionUsage(RateLimit{}, time.Now()))
+	conn.setClientID("other")
+	conn.subscribe("10.0.0.1:5000", control.Subscribe{Filter: "tcf.a", ClientID: "node"})
+	s.connections.Add(conn)
+
+	send := func(nodeID, topic string) (bool, *control.Undeliverable) {
+		relay.sent = nil
+		inbox := control.InboxTopic(nodeID, topic)
+		p, _ := payloads.NewPayload(testPayloadData{inbox})
+		p.SetHeader(payloads.HeaderMessageID, "msg-1")
+		p.SetHeader(payloads.HeaderAckTo, "tcf.ack.sender")
+		msg, err := s.encodeForWire(inbox, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dropped := s.undeliverable(inbox, msg)
+		sent := relay.Sent()
+		if len(sent) == 0 {
+			return dropped, nil
+		}
+
+		topic, pl, err := s.decodeRelayMessage(sent[0])
+		var u control.Undeliverable
+		if err == nil {
+			err = pl.DecodeMessage(&u)
+		}
+		if err != nil || topic != "tcf.ack.sender" {
+			t.Fatalf("Unexpected report on %v: %v", topic, err)
+		}
+		return dropped, &u
+	}
+
+	if dropped, u := send("node", "tcf.a.b"); dropped || u != nil {
+		t.Fatal("Message for a subscribed node should be relayed")
+	}
+
+	if dropped, u := send("node", "tcf.b"); !dropped || u == nil || u.Reason != control.ReasonNotSubscribed ||
+		u.MessageID != "msg-1" || u.SubscriberID != "node" {
+		t.Fatalf("Expected the node to be reported as not subscribed: %+v", u)
+	}
+
+	if dropped, u := send("gone", "tcf.a"); !dropped || u == nil || u.Reason != control.ReasonUnknownNode {
+		t.Fatalf("Expected the node to be reported as unknown: %+v", u)
+	}
+
+	// Federated servers cannot tell where a node is connected
+	s.conf.FederationAddr = "tcp://127.0.0.1:9111"
+	if dropped, _ := send("gone", "tcf.a"); dropped {
+		t.Fatal("Federated servers should relay every directed message")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(RateLimit{MessagesPerSecond: 2}, now)
+
+	if !l.Allow(10, now) || !l.Allow(10, now) {
+		t.Fatal("Burst within the limit should be allowed")
+	}
+
+	if l.Allow(10, now) {
+		t.Fatal("Message over the message limit should be dropped")
+	}
+
+	if !l.Allow(10, now.Add(500*time.Millisecond)) {
+		t.Fatal("Bucket should refill over time")
+	}
+
+	l = newLimiter(RateLimit{BytesPerSecond: 100}, now)
+	if !l.Allow(60, now) {
+		t.Fatal("Message within the byte limit should be allowed")
+	}
+
+	if l.Allow(60, now) {
+		t.Fatal("Message over the byte limit should be dropped")
+	}
+
+	if !l.Allow(60, now.Add(500*time.Millisecond)) {
+		t.Fatal("Byte bucket should refill over time")
+	}
+
+	// Limits below one message or a message size still let traffic through at the average rate
+	l = newLimiter(RateLimit{MessagesPerSecond: 0.5, BytesPerSecond: 10}, now)
+	if !l.Allow(60, now) {
+		t.Fatal("Full bucket should allow a message larger than its capacity")
+	}
+
+	if l.Allow(60, now.Add(2*time.Second)) {
+		t.Fatal("Bucket should refill for the large message first")
+	}
+
+	if !l.Allow(60, now.Add(7*time.Second)) {
+		t.Fatal("Refilled bucket should allow the next message")
+	}
+
+	l = newLimiter(RateLimit{MessagesPerSecond: 1, MessageBurst: 3}, now)
+	for i := 0; i < 3; i++ {
+		if !l.Allow(10, now) {
+			t.Fatal("Messages within the burst should be allowed")
+		}
+	}
+	if l.Allow(10, now) {
+		t.Fatal("Message over the burst should be dropped")
+	}
+
+	topics := newTopicLimiters(RateLimit{MessagesPerSecond: 1})
+	for i := 0; i < 10; i++ {
+		topics.Allow("tcf.topic."+strconv.Itoa(i), 10, now)
+	}
+	topics.Allow("tcf.topic.0", 10, now.Add(topicLimiterSweep))
+	if len(topics.limiters) != 1 {
+		t.Fatalf("Limiters of idle topics should be removed, got %v", len(topics.limiters))
+	}
+
+	s := &MangosServer{}
+	s.Init(newMangoConfig("tcp://127.0.0.1:9103", false))
+	s.SetRateLimits(RateLimits{
+		PerClient: RateLimit{MessagesPerSecond: 10},
+		PerTopic:  RateLimit{MessagesPerSecond: 1},
+	})
+
+	sock := newSocketMap("10.0.0.1", "10.0.0.1:4000", nil, newConnectionUsage(s.limits.PerClient, now))
+	s.connections.Add(sock)
+
+	if !s.withinLimits(sock, "tcf.a", 10) {
+		t.Fatal("First message should be relayed")
+	}
+
+	if s.withinLimits(sock, "tcf.a", 10) {
+		t.Fatal("Second message on the topic should be dropped")
+	}
+
+	if !s.withinLimits(sock, "tcf.b", 10) {
+		t.Fatal("Topics should be limited independently")
+	}
+
+	usage := s.Connections()
+	if len(usage) != 1 {
+		t.Fatalf("Expected one connection, got %v", len(usage))
+	}
+
+	u := usage[0]
+	if u.Messages != 3 || u.Bytes != 30 || u.Dropped != 1 || u.Host != "10.0.0.1" {
+		t.Fatalf("Unexpected usage: %+v", u)
+	}
+
+	if u.BytesAvailable != -1 || u.MessagesAvailable < 7 || u.MessagesAvailable > 8 {
+		t.Fatalf("Unexpected allowance: %+v", u)
+	}
+}
+
+func TestConnectionRegistry(t *testing.T) {
+	s := &MangosServer{}
+	s.Init(newMangoConfig("tcp://127.0.0.1:9104", false))
+	s.relay = &recordingSocket{}
+
+	connected := make(chan ConnectionInfo, 1)
+	s.SetOnConnect(func(info ConnectionInfo) {
+		connected <- info
+	})
+
+	conn := newSocketMap("10.0.0.1", "10.0.0.1:4000", nil, newConnectionUsage(RateLimit{}, time.Now()))
+	conn.addPort("10.0.0.1:4001")
+	s.connections.Add(conn)
+	s.access.AddPort("10.0.0.1:4000", testPort{})
+	s.connectionEvent(s.onConnect, conn)
+
+	select {
+	case info := <-connected:
+		if info.Host != "10.0.0.1" || info.RemoteAddr != "10.0.0.1:4000" {
+			t.Fatalf("Unexpected connection: %+v", info)
+		}
+	default:
+		t.Fatal("Connect hook was not called")
+	}
+
+	for topic, msg := range map[string]interface{}{
+		control.HelloTopic:     control.Hello{ClientID: "client-1"},
+		control.SubscribeTopic: control.Subscribe{Filter: "tcf.b.", LocalAddr: "10.0.0.1:4000"},
+	} {
+		p, _ := payloads.NewPayload(msg)
+		data, err := s.encodeForWire(topic, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handleControl("10.0.0.1", topic, data)
+	}
+	conn.subscribe("10.0.0.1:4001", control.Subscribe{Filter: "tcf.a."})
+	s.withinLimits(conn, "tcf.a.test", 12)
+
+	conns := s.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("Expected one connection, got %v", len(conns))
+	}
+
+	info := conns[0]
+	if info.ClientID != "client-1" || info.Messages != 1 || info.Bytes != 12 || info.LastActivity.IsZero() {
+		t.Fatalf("Unexpected connection info: %+v", info)
+	}
+
+	if len(info.Subscriptions) != 2 || info.Subscriptions[0] != "tcf.a." || info.Subscriptions[1] != "tcf.b." {
+		t.Fatalf("Unexpected subscriptions: %v", info.Subscriptions)
+	}
+
+	if conn.removePort("10.0.0.1:4001") != 1 {
+		t.Fatal("Client should stay connected while it has a subscription")
+	}
+
+	if subs := s.Connections()[0].Subscriptions; len(subs) != 1 || subs[0] != "tcf.b." {
+		t.Fatalf("Closed subscription should be removed: %v", subs)
+	}
+}
+
+// selfSigned returns the DER encoded certificate of a self signed CA with the common name
+func selfSigned(t *testing.T, name string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	trusted := selfSigned(t, "client")
+	cert, err := x509.ParseCertificate(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	s := &MangosServer{conf: &MangosServerConf{TLSConfig: &tls.Config{ClientCAs: pool}}}
+	cfg := s.clientTLSConfig()
+
+	if s.conf.TLSConfig.VerifyPeerCertificate != nil {
+		t.Fatal("The TLS config of the relay must not be changed")
+	}
+	if err := cfg.VerifyPeerCertificate([][]byte{trusted}, nil); err != nil {
+		t.Fatal("A client certificate from the client CAs must be accepted, got: ", err)
+	}
+	if err := cfg.VerifyPeerCertificate([][]byte{selfSigned(t, "other")}, nil); err == nil {
+		t.Fatal("A client certificate from another CA must be refused")
+	}
+	if err := cfg.VerifyPeerCertificate(nil, nil); err != ErrNoClientCertificate {
+		t.Fatal("Expected ErrNoClientCertificate, got: ", err)
+	}
+}
+
+func TestFederation(t *testing.T) {
+	var err error
+	var a, b Server
+
+	if a, err = NewServer("mangos://127.0.0.1:9110?federation=tcp://127.0.0.1:9210&peers=tcp://127.0.0.1:9220", encoding.JSON); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = NewServer("mangos://127.0.0.1:9120?federation=tcp://127.0.0.1:9220&peers=tcp://127.0.0.1:9210", encoding.JSON); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []Server{a, b} {
+		if err = s.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+	}
+
+	resultChan := make(chan testPayloadData, 2)
+	ch := "tcf.test.mangos-server.federation"
+	msg := "Tyk Cluster Framework: Federation"
+
+	var c client.Client
+	if c, err = client.NewClient("mangos://127.0.0.1:9110", encoding.JSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	if _, err = c.Subscribe(ch, func(payload payloads.Payload) {
+		var d testPayloadData
+		if err := payload.DecodeMessage(&d); err != nil {
+			t.Fatalf("Decode payload failed: %v", err)
+		}
+		resultChan <- d
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// This is ugly, but mangos handles connect in the background, so we need to wait :-/
+	time.Sleep(1 * time.Second)
+
+	dp, _ := payloads.NewPayload(testPayloadData{msg})
+	if err = b.Publish(ch, dp); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-resultChan:
+		if v.FullName != msg {
+			t.Fatalf("Unexpected return value: %v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for federated message")
+	}
+
+	// The message must not loop back through the peers
+	select {
+	case v := <-resultChan:
+		t.Fatalf("Received duplicate: %v", v)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestFederationOrigin(t *testing.T) {
+	s := &MangosServer{}
+	s.Init(newMangoConfig("tcp://127.0.0.1:9105", false))
+
+	p, _ := payloads.NewPayload("Hello")
+	payloads.SetOrigin(p, s.GetID())
+	msg, err := s.encodeForWire("tcf.test", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, decoded, err := s.decodeRelayMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payloads.Origin(decoded) != s.GetID() {
+		t.Fatal("Origin should survive the wire encoding")
+	}
+}
+
+func TestMessageLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcf-msglog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "messages.db")
+	s := &MangosServer{}
+	s.Init(newMangoConfig("tcp://127.0.0.1:9106", false))
+	if err = s.EnableMessageLog(path, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	logID, _ := s.MessageLogID()
+	for i := 0; i < 5; i++ {
+		p, _ := payloads.NewPayload(testPayloadData{strconv.Itoa(i)})
+		msg, err := s.encodeForWire("tcf.test.log", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, logged, err := s.decodeRelayMessage(s.logMessage(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id, seq, found := payloads.Sequence(logged); !found || id != logID || seq != uint64(i+1) {
+			t.Fatalf("Unexpected sequence: %v %v %v", id, seq, found)
+		}
+	}
+
+	msgs, err := s.MessagesSince("tcf.test.log", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) != 3 {
+		t.Fatalf("Log should be bounded to 3 messages, got %v", len(msgs))
+	}
+
+	if msgs, _ = s.MessagesSince("tcf.test.log", 4); len(msgs) != 1 {
+		t.Fatalf("Expected one message after 4, got %v", len(msgs))
+	}
+
+	if msgs, _ = s.MessagesSince("tcf.test.other", 0); len(msgs) != 0 {
+		t.Fatal("Unknown topic should have no messages")
+	}
+
+	s.msgLog.Close()
+
+	// The log keeps its ID and sequence across restarts
+	if err = s.EnableMessageLog(path, 3); err != nil {
+		t.Fatal(err)
+	}
+	defer s.msgLog.Close()
+
+	if id, _ := s.MessageLogID(); id != logID {
+		t.Fatalf("Log ID changed from %v to %v", logID, id)
+	}
+
+	p, _ := payloads.NewPayload(testPayloadData{"after restart"})
+	msg, _ := s.encodeForWire("tcf.test.log", p)
+	_, logged, _ := s.decodeRelayMessage(s.logMessage(msg))
+	if _, seq, _ := payloads.Sequence(logged); seq != 6 {
+		t.Fatalf("Sequence should continue after restart, got %v", seq)
+	}
+
+	// Topics past the limit are relayed without being logged
+	s.msgLog.maxTopics = 1
+	msg, _ = s.encodeForWire("tcf.test.other", p)
+	_, logged, _ = s.decodeRelayMessage(s.logMessage(msg))
+	if _, _, found := payloads.Sequence(logged); found {
+		t.Fatal("Topic over the limit should not be logged")
+	}
+
+	// Replays only go to a connection of the client that asked
+	relay := &recordingSocket{}
+	s.relay = relay
+	s.access.AddPort("10.0.0.1:5000", testPort{})
+
+	s.handleCatchUp("10.0.0.2", control.CatchUp{Topic: "tcf.test.log", Since: 4, LocalAddr: "10.0.0.1:5000"})
+	if len(relay.Sent()) != 0 {
+		t.Fatal("Catch up for a connection of another host should be ignored")
+	}
+
+	s.handleCatchUp("10.0.0.1", control.CatchUp{Topic: "tcf.test.log", Since: 4, LocalAddr: "10.0.0.1:5000"})
+	sent := relay.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 replayed messages, got %v", len(sent))
+	}
+	for _, msg := range sent {
+		if !strings.HasPrefix(string(msg), control.DirectTopic("10.0.0.1:5000")) {
+			t.Fatalf("Replay not sent to the connection: %s", msg)
+		}
+	}
+
+	// Replays are subject to the subscribe rules
+	s.SetACL(acl.NewPolicy(&acl.Rules{}))
+	s.handleCatchUp("10.0.0.1", control.CatchUp{Topic: "tcf.test.log", Since: 4, LocalAddr: "10.0.0.1:5000"})
+	if len(relay.Sent()) != 2 {
+		t.Fatal("Catch up for a topic the client may not subscribe to should be denied")
+	}
+}
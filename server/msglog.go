@@ -0,0 +1,307 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/acl"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+	"github.com/boltdb/bolt"
+	"github.com/satori/go.uuid"
+)
+
+var (
+	logMetaBucket   = []byte("meta")
+	logTopicsBucket = []byte("topics")
+	logIDKey        = []byte("id")
+)
+
+var (
+	ErrMessageLogDisabled  = errors.New("Message log is not enabled")
+	ErrTooManyLoggedTopics = errors.New("Message log holds the most topics it can")
+)
+
+// maxLoggedTopics bounds the disk use of the log, messages of further topics are not logged
+var maxLoggedTopics = 1024
+
+// messageLog keeps the last messages of each topic on disk in their wire format, keyed by a per topic
+// sequence number. The log has an ID that survives restarts so clients can tell which log a sequence
+// number belongs to.
+type messageLog struct {
+	// mu orders appends with the sends that follow them, so clients see sequence numbers in order
+	mu          sync.Mutex
+	db          *bolt.DB
+	id          string
+	maxPerTopic uint64
+	maxTopics   int
+}
+
+func openMessageLog(path string, maxPerTopic int) (*messageLog, error) {
+	if maxPerTopic < 1 {
+		return nil, errors.New("Message log must keep at least one message per topic")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open message log: %s", err.Error())
+	}
+
+	l := &messageLog{db: db, maxPerTopic: uint64(maxPerTopic), maxTopics: maxLoggedTopics}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(logMetaBucket)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.CreateBucketIfNotExists(logTopicsBucket); err != nil {
+			return err
+		}
+
+		if id := meta.Get(logIDKey); id != nil {
+			l.id = string(id)
+			return nil
+		}
+
+		l.id = uuid.NewV4().String()
+		return meta.Put(logIDKey, []byte(l.id))
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to initialise message log: %s", err.Error())
+	}
+
+	return l, nil
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// Append assigns the next sequence number of the topic, encode returns the message to store for it.
+// The oldest messages are removed once the topic holds more than maxPerTopic. ErrTooManyLoggedTopics is
+// returned for a new topic once the log holds maxTopics.
+func (l *messageLog) Append(topic string, encode func(seq uint64) ([]byte, error)) ([]byte, error) {
+	var msg []byte
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		topics := tx.Bucket(logTopicsBucket)
+		b := topics.Bucket([]byte(topic))
+		if b == nil {
+			if countBuckets(topics) >= l.maxTopics {
+				return ErrTooManyLoggedTopics
+			}
+
+			var err error
+			if b, err = topics.CreateBucket([]byte(topic)); err != nil {
+				return err
+			}
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		if msg, err = encode(seq); err != nil {
+			return err
+		}
+
+		if err = b.Put(seqKey(seq), msg); err != nil {
+			return err
+		}
+
+		if seq <= l.maxPerTopic {
+			return nil
+		}
+
+		// Collect first, deleting while iterating moves the cursor
+		oldest := seq - l.maxPerTopic
+		var expired [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= oldest; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+
+		for _, k := range expired {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return msg, err
+}
+
+// Since returns the logged messages of the topic after the sequence number, oldest first
+func (l *messageLog) Since(topic string, since uint64) ([][]byte, error) {
+	var msgs [][]byte
+	err := l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(logTopicsBucket).Bucket([]byte(topic))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(seqKey(since + 1)); k != nil; k, v = c.Next() {
+			// Values are only valid during the transaction
+			msg := make([]byte, len(v))
+			copy(msg, v)
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+
+	return msgs, err
+}
+
+// countBuckets returns the number of nested buckets, it only runs when a topic is added
+func countBuckets(b *bolt.Bucket) int {
+	n := 0
+	b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func (l *messageLog) Close() error {
+	return l.db.Close()
+}
+
+// EnableMessageLog keeps the last maxPerTopic messages of every topic in a bolt database at path, the
+// messages are stamped with their sequence number so reconnecting clients can catch up on what they
+// missed. At most 1024 topics are logged, messages of further topics are relayed without a sequence
+// number. It needs the JSON encoding and must be called before Listen().
+func (s *MangosServer) EnableMessageLog(path string, maxPerTopic int) error {
+	if !s.decodable() {
+		return ErrUnsupportedEncoding
+	}
+
+	l, err := openMessageLog(path, maxPerTopic)
+	if err != nil {
+		return err
+	}
+
+	s.msgLog = l
+	return nil
+}
+
+// MessageLogID returns the ID of the message log, sequence numbers are only meaningful within a log
+func (s *MangosServer) MessageLogID() (string, error) {
+	if s.msgLog == nil {
+		return "", ErrMessageLogDisabled
+	}
+	return s.msgLog.id, nil
+}
+
+// MessagesSince returns the logged messages of a topic after the sequence number in their wire format
+func (s *MangosServer) MessagesSince(topic string, since uint64) ([][]byte, error) {
+	if s.msgLog == nil {
+		return nil, ErrMessageLogDisabled
+	}
+	return s.msgLog.Since(topic, since)
+}
+
+// sendLogged appends a message to the message log if it is enabled and sends it on the relay, it
+// returns the message as it was sent
+func (s *MangosServer) sendLogged(msg []byte) ([]byte, error) {
+	if s.msgLog == nil {
+		return msg, s.distribute(msg)
+	}
+
+	s.msgLog.mu.Lock()
+	defer s.msgLog.mu.Unlock()
+
+	msg = s.logMessage(msg)
+	return msg, s.distribute(msg)
+}
+
+// logMessage appends a message to the message log and returns it stamped with its sequence number,
+// the message is sent unlogged if that fails.
+func (s *MangosServer) logMessage(msg []byte) []byte {
+	topic, pl, err := s.decodeRelayMessage(msg)
+	if err == nil {
+		var logged []byte
+		logged, err = s.msgLog.Append(topic, func(seq uint64) ([]byte, error) {
+			payloads.SetSequence(pl, s.msgLog.id, seq)
+			return s.encodeForWire(topic, pl)
+		})
+		if err == nil {
+			return logged
+		}
+	}
+
+	if err == ErrTooManyLoggedTopics {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+			"topic":  topic,
+		}).Debug("Message log is full, not logging topic")
+		return msg
+	}
+
+	s.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.MangosServer",
+		"topic":  topic,
+	}).Error("Failed to log message: ", err)
+	return msg
+}
+
+func (s *MangosServer) handleCatchUp(host string, req control.CatchUp) {
+	if s.msgLog == nil || (req.Log != "" && req.Log != s.msgLog.id) {
+		return
+	}
+
+	if !s.access.HasPort(host, req.LocalAddr) {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+			"host":   host,
+			"topic":  req.Topic,
+		}).Warning("Ignored catch up for an unknown connection: ", req.LocalAddr)
+		return
+	}
+
+	if s.acl != nil {
+		identity := s.identity(host)
+		if !s.acl.CanSubscribe(identity, subscribeTopic(req.Topic)) {
+			s.denied(identity, acl.Subscribe, req.Topic)
+			return
+		}
+	}
+
+	msgs, err := s.msgLog.Since(req.Topic, req.Since)
+	if err != nil {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+			"topic":  req.Topic,
+		}).Error("Failed to read message log: ", err)
+		return
+	}
+
+	// Only the connection of the subscription receives the replay, the client drops what it has seen
+	direct := control.DirectTopic(req.LocalAddr)
+	for _, msg := range msgs {
+		if err = s.relay.Send(append([]byte(direct), msg...)); err != nil {
+			s.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.MangosServer",
+				"topic":  req.Topic,
+			}).Error("Failed to send logged message: ", err)
+			return
+		}
+	}
+
+	s.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.MangosServer",
+		"host":   host,
+		"topic":  req.Topic,
+	}).Debug("Replayed logged messages: ", len(msgs))
+}
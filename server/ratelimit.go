@@ -0,0 +1,316 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/metrics"
+)
+
+// LimitPolicy decides what happens to a client that exceeds its rate limit
+type LimitPolicy int
+
+const (
+	// LimitDrop drops the messages that exceed the limit
+	LimitDrop LimitPolicy = iota
+	// LimitDisconnect drops the message and disconnects the client
+	LimitDisconnect
+)
+
+// topicLimiterSweep is how often limiters of idle topics are removed
+var topicLimiterSweep = 30 * time.Second
+
+// RateLimit is a token bucket limit, a zero value disables that part of the limit. Clients can burst up
+// to one second worth of traffic unless a burst is set, and at least one message.
+type RateLimit struct {
+	MessagesPerSecond float64
+	BytesPerSecond    float64
+	// MessageBurst and ByteBurst are the most messages and bytes that can be sent at once
+	MessageBurst float64
+	ByteBurst    float64
+}
+
+func (r RateLimit) enabled() bool {
+	return r.MessagesPerSecond > 0 || r.BytesPerSecond > 0
+}
+
+// RateLimits configures the relay limits, PerClient applies to all messages of a connected client and
+// PerTopic applies to each topic across all clients.
+type RateLimits struct {
+	PerClient RateLimit
+	PerTopic  RateLimit
+	Policy    LimitPolicy
+}
+
+// tokenBucket refills at rate tokens per second up to its capacity, which defaults to one second worth
+// of tokens and is never less than one
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, capacity: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+// allows returns true if n tokens can be taken, a full bucket allows anything so that messages larger
+// than the capacity pass, the bucket then goes into debt until it refilled for them
+func (b *tokenBucket) allows(n float64) bool {
+	return b.tokens >= n || b.tokens >= b.capacity
+}
+
+func (b *tokenBucket) full() bool {
+	return b.tokens >= b.capacity
+}
+
+// limiter combines a message and a byte bucket, a message is only let through if both allow it
+type limiter struct {
+	mu       sync.Mutex
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newLimiter(limit RateLimit, now time.Time) *limiter {
+	l := &limiter{}
+	if limit.MessagesPerSecond > 0 {
+		l.messages = newTokenBucket(limit.MessagesPerSecond, limit.MessageBurst, now)
+	}
+	if limit.BytesPerSecond > 0 {
+		l.bytes = newTokenBucket(limit.BytesPerSecond, limit.ByteBurst, now)
+	}
+	return l
+}
+
+func (l *limiter) Allow(size int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.messages != nil {
+		l.messages.refill(now)
+		if !l.messages.allows(1) {
+			return false
+		}
+	}
+
+	if l.bytes != nil {
+		l.bytes.refill(now)
+		if !l.bytes.allows(float64(size)) {
+			return false
+		}
+	}
+
+	if l.messages != nil {
+		l.messages.tokens--
+	}
+	if l.bytes != nil {
+		l.bytes.tokens -= float64(size)
+	}
+
+	return true
+}
+
+// Available returns the remaining messages and bytes, -1 means unlimited
+func (l *limiter) Available(now time.Time) (float64, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	msgs, bytes := float64(-1), float64(-1)
+	if l.messages != nil {
+		l.messages.refill(now)
+		msgs = math.Max(l.messages.tokens, 0)
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+		bytes = math.Max(l.bytes.tokens, 0)
+	}
+	return msgs, bytes
+}
+
+// Idle returns true if the limiter refilled completely, it behaves like a new limiter then
+func (l *limiter) Idle(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.messages != nil {
+		l.messages.refill(now)
+		if !l.messages.full() {
+			return false
+		}
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+		if !l.bytes.full() {
+			return false
+		}
+	}
+	return true
+}
+
+// connectionUsage counts the traffic of a client connection and holds its limiter
+type connectionUsage struct {
+	mu           sync.Mutex
+	since        time.Time
+	lastActivity time.Time
+	messages     uint64
+	bytes        uint64
+	dropped      uint64
+	limiter      *limiter
+}
+
+func newConnectionUsage(limit RateLimit, now time.Time) *connectionUsage {
+	u := &connectionUsage{since: now}
+	if limit.enabled() {
+		u.limiter = newLimiter(limit, now)
+	}
+	return u
+}
+
+func (u *connectionUsage) Received(size int, now time.Time) {
+	u.mu.Lock()
+	u.lastActivity = now
+	u.messages++
+	u.bytes += uint64(size)
+	u.mu.Unlock()
+}
+
+func (u *connectionUsage) Dropped() {
+	u.mu.Lock()
+	u.dropped++
+	u.mu.Unlock()
+}
+
+func (u *connectionUsage) Info(now time.Time) ConnectionInfo {
+	u.mu.Lock()
+	info := ConnectionInfo{
+		Messages:          u.messages,
+		Bytes:             u.bytes,
+		Dropped:           u.dropped,
+		ConnectedSince:    u.since,
+		LastActivity:      u.lastActivity,
+		MessagesAvailable: -1,
+		BytesAvailable:    -1,
+	}
+	u.mu.Unlock()
+
+	if u.limiter != nil {
+		info.MessagesAvailable, info.BytesAvailable = u.limiter.Available(now)
+	}
+	return info
+}
+
+// topicLimiters holds a limiter for each topic that has been relayed recently, limiters are removed
+// once their topic is idle
+type topicLimiters struct {
+	mu        sync.Mutex
+	limit     RateLimit
+	limiters  map[string]*limiter
+	lastSwept time.Time
+}
+
+func newTopicLimiters(limit RateLimit) *topicLimiters {
+	return &topicLimiters{limit: limit, limiters: make(map[string]*limiter)}
+}
+
+func (t *topicLimiters) Allow(topic string, size int, now time.Time) bool {
+	if !t.limit.enabled() {
+		return true
+	}
+
+	t.mu.Lock()
+	t.sweep(now)
+	l, found := t.limiters[topic]
+	if !found {
+		l = newLimiter(t.limit, now)
+		t.limiters[topic] = l
+	}
+	t.mu.Unlock()
+
+	return l.Allow(size, now)
+}
+
+// sweep removes the limiters of idle topics, it must be called with the lock held
+func (t *topicLimiters) sweep(now time.Time) {
+	if now.Sub(t.lastSwept) < topicLimiterSweep {
+		return
+	}
+	t.lastSwept = now
+
+	for topic, l := range t.limiters {
+		if l.Idle(now) {
+			delete(t.limiters, topic)
+		}
+	}
+}
+
+// SetRateLimits limits the rate at which clients can send messages through the relay, it must be
+// called before Listen(). Limits of clients that are already connected do not change.
+func (s *MangosServer) SetRateLimits(limits RateLimits) {
+	s.limits = limits
+	s.topicLimits = newTopicLimiters(limits.PerTopic)
+}
+
+// withinLimits accounts a message received from a client and checks it against the limits, it returns
+// false if the message must not be relayed
+func (s *MangosServer) withinLimits(sock *socketMap, topic string, size int) bool {
+	now := time.Now()
+	sock.usage.Received(size, now)
+
+	if sock.usage.limiter != nil && !sock.usage.limiter.Allow(size, now) {
+		s.rateLimited(sock, topic, "client")
+		return false
+	}
+
+	if !s.topicLimits.Allow(topic, size, now) {
+		s.rateLimited(sock, topic, "topic")
+		return false
+	}
+
+	return true
+}
+
+func (s *MangosServer) rateLimited(sock *socketMap, topic, limit string) {
+	sock.usage.Dropped()
+	metrics.IncrCounter(metrics.KeyRateLimited, 1, metrics.Transport("mangos"), metrics.Topic(topic), metrics.Limit(limit))
+
+	if s.limits.Policy != LimitDisconnect {
+		s.Log().WithFields(logrus.Fields{
+			"prefix": "tcf.MangosServer",
+			"host":   sock.Host,
+			"topic":  topic,
+		}).Debug("Dropped message over ", limit, " limit")
+		return
+	}
+
+	s.Log().WithFields(logrus.Fields{
+		"prefix": "tcf.MangosServer",
+		"host":   sock.Host,
+		"topic":  topic,
+	}).Warning("Disconnecting client over ", limit, " limit")
+	s.disconnectHost(sock)
+}
+
+// disconnectHost closes the relay connections of the client, the connection to its publisher is closed
+// once the last of them is removed
+func (s *MangosServer) disconnectHost(sock *socketMap) {
+	for _, port := range s.access.HostPorts(sock.Host) {
+		port.Close()
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-cluster-framework/acl"
+	"github.com/TykTechnologies/tyk-cluster-framework/control"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// retainMarker is used to skip decoding messages that cannot carry the retained header
+var retainMarker = []byte(payloads.HeaderRetain)
+
+// retainedMessages holds the last retained message of each topic in its wire format
+type retainedMessages struct {
+	mu   sync.RWMutex
+	msgs map[string][]byte
+}
+
+func newRetainedMessages() *retainedMessages {
+	return &retainedMessages{msgs: make(map[string][]byte)}
+}
+
+func (r *retainedMessages) Set(topic string, msg []byte) {
+	r.mu.Lock()
+	r.msgs[topic] = msg
+	r.mu.Unlock()
+}
+
+func (r *retainedMessages) Get(topic string) ([]byte, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	msg, found := r.msgs[topic]
+	return msg, found
+}
+
+func (r *retainedMessages) Delete(topic string) {
+	r.mu.Lock()
+	delete(r.msgs, topic)
+	r.mu.Unlock()
+}
+
+// Matching returns the retained messages of the topics a filter matches, ordered by topic
+func (r *retainedMessages) Matching(filter string) [][]byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	topics := make([]string, 0, len(r.msgs))
+	for t := range r.msgs {
+		if strings.HasPrefix(t, filter) {
+			topics = append(topics, t)
+		}
+	}
+	sort.Strings(topics)
+
+	all := make([][]byte, len(topics))
+	for i, t := range topics {
+		all[i] = r.msgs[t]
+	}
+	return all
+}
+
+// observeRetained keeps a relayed message if its payload is flagged as retained
+func (s *MangosServer) observeRetained(msg []byte) {
+	if !s.decodable() || !bytes.Contains(msg, retainMarker) {
+		return
+	}
+
+	topic, pl, err := s.decodeRelayMessage(msg)
+	if err != nil || !payloads.IsRetained(pl) {
+		return
+	}
+
+	s.retained.Set(topic, msg)
+}
+
+// deliverRetained sends the retained messages matching an announced subscription to the connection
+// that carries it. Clients announce their subscriptions again when they reconnect, so handlers of
+// retained topics should be idempotent.
+func (s *MangosServer) deliverRetained(host string, sub control.Subscribe) {
+	direct := control.DirectTopic(sub.LocalAddr)
+	for _, msg := range s.retained.Matching(sub.Filter) {
+		if s.acl != nil {
+			topic, _ := splitTopic(msg)
+			if identity := s.identity(host); !s.acl.CanSubscribe(identity, subscribeTopic(topic)) {
+				s.denied(identity, acl.Subscribe, topic)
+				continue
+			}
+		}
+
+		if err := s.relay.Send(append([]byte(direct), msg...)); err != nil {
+			s.Log().WithFields(logrus.Fields{
+				"prefix": "tcf.MangosServer",
+			}).Error("Failed to deliver retained message: ", err)
+			return
+		}
+	}
+}
+
+// Retained returns the last retained payload of a topic in its wire format
+func (s *MangosServer) Retained(topic string) ([]byte, bool) {
+	return s.retained.Get(topic)
+}
+
+// ClearRetained removes the retained payload of a topic, new subscribers will not receive it
+func (s *MangosServer) ClearRetained(topic string) {
+	s.retained.Delete(topic)
+}
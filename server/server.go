@@ -2,19 +2,41 @@ package server
 
 import (
 	"errors"
-	logger "github.com/TykTechnologies/tykcommon-logger"
 	"strings"
+	"time"
 
-	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-cluster-framework/encoding"
+	"github.com/TykTechnologies/tyk-cluster-framework/logging"
+	"github.com/TykTechnologies/tyk-cluster-framework/middleware"
 	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
 	"net/url"
 )
 
-var log *logrus.Logger = logger.GetLogger()
-
 type PublishHook func([]byte, []byte) error
 
+// ConnectionHook is called when a client connects to or disconnects from a server
+type ConnectionHook func(ConnectionInfo)
+
+// ConnectionInfo describes a connected client
+type ConnectionInfo struct {
+	RemoteAddr string
+	Host       string
+	// ClientID is the ID the client reported with GetID(), it is empty until the client identified itself
+	ClientID       string
+	ConnectedSince time.Time
+	LastActivity   time.Time
+	// Messages and Bytes count what the client sent to be relayed, including Dropped messages
+	Messages uint64
+	Bytes    uint64
+	Dropped  uint64
+	// Subscriptions are the topic prefixes the client subscribed to
+	Subscriptions []string
+	// MessagesAvailable and BytesAvailable are what is left of the rate limit of the client, they are
+	// -1 when there is no limit
+	MessagesAvailable float64
+	BytesAvailable    float64
+}
+
 // Server represents a server object that accepts connections for a queue service
 type Server interface {
 	Listen() error
@@ -22,18 +44,24 @@ type Server interface {
 	SetEncoding(encoding.Encoding) error
 	Init(interface{}) error
 	Stop() error
-	Connections() []string
+	Connections() []ConnectionInfo
 	Publish(string, payloads.Payload) error
 	Relay(string, payloads.Payload) error
 	GetID() string
 	SetOnPublish(PublishHook) error
+	SetOnConnect(ConnectionHook)
+	SetOnDisconnect(ConnectionHook)
+	Use(...middleware.InboundMiddleware)
+	UseOutbound(...middleware.OutboundMiddleware)
+	SetLogger(logging.Logger)
 }
 
 // NewServer will generate a new server object based on the enum provided.
 // 'mangos' will enable a server using the mangos (nanomsg) toolkit, you
 // can add an option to the connection string of `?disable_loopback=true`
 // to have the server dissallow connections from any IP that it recognises
-// as itself.
+// as itself. Servers federate with `?federation=tcp://0.0.0.0:9200&peers=tcp://host2:9200,tcp://host3:9200`,
+// every server must list all other servers as peers.
 func NewServer(connectionString string, baselineEncoding encoding.Encoding) (Server, error) {
 	parts := strings.Split(connectionString, "://")
 	if len(parts) < 2 {
@@ -57,9 +85,19 @@ func NewServer(connectionString string, baselineEncoding encoding.Encoding) (Ser
 		disableConnectionsFromSelf := URL.Query().Get("disable_loopback")
 
 		s := &MangosServer{}
-		s.SetEncoding(baselineEncoding)
-		url := "tcp://" + URL.Host
-		s.Init(newMangoConfig(url, disableConnectionsFromSelf != ""))
+		conf := newMangoConfig("tcp://"+URL.Host, disableConnectionsFromSelf != "")
+		conf.Encoding = baselineEncoding
+		if err = s.Init(conf); err != nil {
+			return nil, err
+		}
+
+		if federation := URL.Query().Get("federation"); federation != "" {
+			var peers []string
+			if p := URL.Query().Get("peers"); p != "" {
+				peers = strings.Split(p, ",")
+			}
+			s.SetFederation(federation, peers...)
+		}
 		return s, nil
 	default:
 		return nil, errors.New("Server scheme not supported.")
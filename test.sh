@@ -6,6 +6,38 @@ echo "Testing verifier/"
 cd verifier
 go test -v
 cd ..
+echo "Testing metrics/"
+cd metrics
+go test -v
+cd ..
+echo "Testing acl/"
+cd acl
+go test -v
+cd ..
+echo "Testing cron/"
+cd cron
+go test -v
+cd ..
+echo "Testing logging/"
+cd logging
+go test -v
+cd ..
+echo "Testing tracing/"
+cd tracing
+go test -v
+cd ..
+echo "Testing pool/"
+cd pool
+go test -v
+cd ..
+echo "Testing middleware/"
+cd middleware
+go test -v
+cd ..
+echo "Testing membership/"
+cd membership
+go test -v
+cd ..
 echo "Testing client/"
 cd client
 go test -v
@@ -14,6 +46,14 @@ echo "Testing client/beacon"
 cd client/beacon
 go test -v
 cd ../..
+echo "Testing bus/"
+cd bus
+go test -v
+cd ..
+echo "Testing discovery/"
+cd discovery
+go test -v
+cd ..
 echo "Testing server/"
 cd server
 go test -v
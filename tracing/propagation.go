@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"github.com/TykTechnologies/tyk-cluster-framework/middleware"
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+// Inject writes the span context into the payload headers, invalid contexts are ignored
+func Inject(p payloads.Payload, s SpanContext) {
+	if p == nil || !s.IsValid() {
+		return
+	}
+
+	p.SetHeader(TraceparentHeader, s.Traceparent())
+	if s.TraceState != "" {
+		p.SetHeader(TracestateHeader, s.TraceState)
+	}
+}
+
+// Extract reads the span context from the payload headers, use it in a payload handler to continue
+// the trace of the publisher. The second return value is false if the payload is not traced.
+func Extract(p payloads.Payload) (SpanContext, bool) {
+	if p == nil {
+		return SpanContext{}, false
+	}
+
+	s, err := ParseTraceparent(p.GetHeader(TraceparentHeader), p.GetHeader(TracestateHeader))
+	if err != nil {
+		return SpanContext{}, false
+	}
+
+	return s, true
+}
+
+// Outbound returns middleware that starts a producer span for every message sent by a transport
+// and injects its context into a copy of the payload so subscribers can continue the trace. The
+// caller's payload keeps its own context, a payload that is sent again starts from the same parent.
+func Outbound(transport string) middleware.OutboundMiddleware {
+	return func(next middleware.OutboundHandler) middleware.OutboundHandler {
+		return func(topic string, payload payloads.Payload) error {
+			parent, _ := Extract(payload)
+			span := GetTracer().StartSpan("publish "+topic, SpanKindProducer, parent)
+			span.SetAttribute("messaging.system", transport)
+			span.SetAttribute("messaging.destination", topic)
+			if payload != nil {
+				payload = payload.Copy()
+				Inject(payload, span.Context())
+			}
+
+			err := next(topic, payload)
+			if err != nil {
+				span.RecordError(err)
+			}
+			span.End()
+
+			return err
+		}
+	}
+}
+
+// Inbound returns middleware that starts a consumer span around the payload handler, the payload
+// carries the context of the consumer span so Extract returns it inside the handler.
+func Inbound(transport string) middleware.InboundMiddleware {
+	return func(next middleware.InboundHandler) middleware.InboundHandler {
+		return func(payload payloads.Payload) {
+			parent, _ := Extract(payload)
+			span := GetTracer().StartSpan("receive "+payload.GetTopic(), SpanKindConsumer, parent)
+			span.SetAttribute("messaging.system", transport)
+			span.SetAttribute("messaging.destination", payload.GetTopic())
+			Inject(payload, span.Context())
+
+			defer span.End()
+			next(payload)
+		}
+	}
+}
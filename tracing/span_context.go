@@ -0,0 +1,128 @@
+// Package tracing propagates W3C trace context (`traceparent` / `tracestate`) through the payload
+// envelope, so work triggered by a message can be correlated with the request that published it.
+// Spans are created through a pluggable Tracer, the default tracer does not record anything, it
+// only carries the context from publishers to subscribers, so TCF does not depend on a tracing SDK.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// TraceparentHeader is the payload header that carries the W3C traceparent
+	TraceparentHeader = "traceparent"
+	// TracestateHeader is the payload header that carries the W3C tracestate
+	TracestateHeader = "tracestate"
+
+	traceparentVersion = "00"
+	flagSampled        = 0x01
+)
+
+var ErrInvalidTraceparent = errors.New("Invalid traceparent")
+
+// SpanContext identifies a span and the trace it belongs to
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte
+	TraceState string
+}
+
+// IsValid returns true if both the trace and span IDs are set
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != [16]byte{} && s.SpanID != [8]byte{}
+}
+
+// IsSampled returns true if the sampled flag is set
+func (s SpanContext) IsSampled() bool {
+	return s.Flags&flagSampled != 0
+}
+
+// TraceIDString returns the hex encoded trace ID
+func (s SpanContext) TraceIDString() string {
+	return hex.EncodeToString(s.TraceID[:])
+}
+
+// SpanIDString returns the hex encoded span ID
+func (s SpanContext) SpanIDString() string {
+	return hex.EncodeToString(s.SpanID[:])
+}
+
+// Traceparent formats the span context as a W3C traceparent header value
+func (s SpanContext) Traceparent() string {
+	return fmt.Sprintf("%s-%s-%s-%02x", traceparentVersion, s.TraceIDString(), s.SpanIDString(), s.Flags)
+}
+
+// NewChild returns a span context in the same trace with a new random span ID
+func (s SpanContext) NewChild() SpanContext {
+	child := s
+	rand.Read(child.SpanID[:])
+	return child
+}
+
+// NewRootSpanContext returns a sampled span context with random trace and span IDs
+func NewRootSpanContext() SpanContext {
+	s := SpanContext{Flags: flagSampled}
+	rand.Read(s.TraceID[:])
+	rand.Read(s.SpanID[:])
+	return s
+}
+
+// ParseTraceparent parses W3C traceparent and tracestate header values
+func ParseTraceparent(traceparent, tracestate string) (SpanContext, error) {
+	var s SpanContext
+
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return s, ErrInvalidTraceparent
+	}
+
+	version := parts[0]
+	if len(version) != 2 || version == "ff" || !isHex(version) {
+		return s, ErrInvalidTraceparent
+	}
+
+	// Future versions may append fields, version 00 must have exactly four
+	if version == traceparentVersion && len(parts) != 4 {
+		return s, ErrInvalidTraceparent
+	}
+
+	if !decodeHex(parts[1], s.TraceID[:]) || !decodeHex(parts[2], s.SpanID[:]) {
+		return s, ErrInvalidTraceparent
+	}
+
+	var flags [1]byte
+	if !decodeHex(parts[3], flags[:]) {
+		return s, ErrInvalidTraceparent
+	}
+	s.Flags = flags[0]
+
+	if !s.IsValid() {
+		return s, ErrInvalidTraceparent
+	}
+
+	s.TraceState = strings.TrimSpace(tracestate)
+	return s, nil
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeHex(s string, into []byte) bool {
+	if len(s) != len(into)*2 || !isHex(s) {
+		return false
+	}
+
+	_, err := hex.Decode(into, []byte(s))
+	return err == nil
+}
@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"sync"
+)
+
+// SpanKind describes the role of a span in a messaging operation
+type SpanKind int
+
+const (
+	SpanKindProducer SpanKind = iota
+	SpanKindConsumer
+)
+
+// Span is a unit of work recorded by a Tracer
+type Span interface {
+	// Context returns the span context that is propagated to children of the span
+	Context() SpanContext
+	SetAttribute(key, value string)
+	RecordError(err error)
+	End()
+}
+
+// Tracer creates spans, implement it to bridge TCF to a tracing SDK
+type Tracer interface {
+	// StartSpan starts a span, parent is invalid if there is no trace to continue
+	StartSpan(name string, kind SpanKind, parent SpanContext) Span
+}
+
+// NoopTracer does not record spans, it carries the parent context through unchanged so existing
+// traces are still propagated across the cluster.
+type NoopTracer struct{}
+
+func (NoopTracer) StartSpan(name string, kind SpanKind, parent SpanContext) Span {
+	return noopSpan{ctx: parent}
+}
+
+type noopSpan struct {
+	ctx SpanContext
+}
+
+func (n noopSpan) Context() SpanContext           { return n.ctx }
+func (n noopSpan) SetAttribute(key, value string) {}
+func (n noopSpan) RecordError(err error)          {}
+func (n noopSpan) End()                           {}
+
+var (
+	tracerMu     sync.RWMutex
+	globalTracer Tracer = NoopTracer{}
+)
+
+// SetTracer sets the tracer used by all TCF transports, set it to nil to restore the NoopTracer
+func SetTracer(t Tracer) {
+	if t == nil {
+		t = NoopTracer{}
+	}
+
+	tracerMu.Lock()
+	globalTracer = t
+	tracerMu.Unlock()
+}
+
+// GetTracer returns the tracer used by TCF transports
+func GetTracer() Tracer {
+	tracerMu.RLock()
+	defer tracerMu.RUnlock()
+	return globalTracer
+}
@@ -0,0 +1,165 @@
+package tracing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-cluster-framework/payloads"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	s, err := ParseTraceparent(testTraceparent, "vendor=value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" || s.SpanIDString() != "00f067aa0ba902b7" {
+		t.Fatalf("IDs incorrect: %v %v", s.TraceIDString(), s.SpanIDString())
+	}
+
+	if !s.IsSampled() || s.TraceState != "vendor=value" {
+		t.Fatalf("Flags or state incorrect: %+v", s)
+	}
+
+	if s.Traceparent() != testTraceparent {
+		t.Fatalf("Round trip failed: %v", s.Traceparent())
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+
+	for _, v := range invalid {
+		if _, err := ParseTraceparent(v, ""); err != ErrInvalidTraceparent {
+			t.Fatalf("Expected %v to be invalid", v)
+		}
+	}
+
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ""); err != nil {
+		t.Fatalf("Future versions may have more fields: %v", err)
+	}
+}
+
+type recordedSpan struct {
+	name   string
+	kind   SpanKind
+	parent SpanContext
+	ctx    SpanContext
+	err    error
+	ended  bool
+}
+
+func (r *recordedSpan) Context() SpanContext           { return r.ctx }
+func (r *recordedSpan) SetAttribute(key, value string) {}
+func (r *recordedSpan) RecordError(err error)          { r.err = err }
+func (r *recordedSpan) End()                           { r.ended = true }
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+func (r *recordingTracer) StartSpan(name string, kind SpanKind, parent SpanContext) Span {
+	ctx := NewRootSpanContext()
+	if parent.IsValid() {
+		ctx = parent.NewChild()
+	}
+
+	s := &recordedSpan{name: name, kind: kind, parent: parent, ctx: ctx}
+	r.spans = append(r.spans, s)
+	return s
+}
+
+func newTestPayload(t *testing.T) payloads.Payload {
+	p, err := payloads.NewPayload("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetTopic("tcf.test")
+	return p
+}
+
+func TestNoopPropagation(t *testing.T) {
+	SetTracer(nil)
+
+	p := newTestPayload(t)
+	if _, traced := Extract(p); traced {
+		t.Fatal("Untraced payload should not have a context")
+	}
+
+	send := Outbound("test")(func(topic string, payload payloads.Payload) error { return nil })
+
+	// Nothing to propagate, the noop tracer must not invent a trace
+	send("tcf.test", p)
+	if p.GetHeader(TraceparentHeader) != "" {
+		t.Fatal("Noop tracer should not start a trace")
+	}
+
+	origin, _ := ParseTraceparent(testTraceparent, "vendor=value")
+	Inject(p, origin)
+	send("tcf.test", p)
+
+	var seen SpanContext
+	Inbound("test")(func(payload payloads.Payload) {
+		seen, _ = Extract(payload)
+	})(p)
+
+	if seen != origin {
+		t.Fatalf("Context not propagated, expected %+v got %+v", origin, seen)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	tracer := &recordingTracer{}
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	p := newTestPayload(t)
+	sendErr := errors.New("send failed")
+	var sent []payloads.Payload
+	send := Outbound("test")(func(topic string, payload payloads.Payload) error {
+		sent = append(sent, payload)
+		return sendErr
+	})
+	if err := send("tcf.test", p); err != sendErr {
+		t.Fatalf("Error not returned: %v", err)
+	}
+	if p.GetHeader(TraceparentHeader) != "" {
+		t.Fatal("The context should be injected into a copy of the payload")
+	}
+
+	var inHandler SpanContext
+	Inbound("test")(func(payload payloads.Payload) {
+		inHandler, _ = Extract(payload)
+	})(sent[0])
+
+	// Sending the payload again starts a new trace, not a child of the first send
+	send("tcf.test", p)
+
+	if len(tracer.spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %v", len(tracer.spans))
+	}
+	if again := tracer.spans[2]; again.parent.IsValid() {
+		t.Fatalf("A payload sent again should not continue its previous send: %+v", again)
+	}
+
+	producer, consumer := tracer.spans[0], tracer.spans[1]
+	if producer.kind != SpanKindProducer || producer.name != "publish tcf.test" || producer.err != sendErr || !producer.ended {
+		t.Fatalf("Producer span incorrect: %+v", producer)
+	}
+
+	if consumer.kind != SpanKindConsumer || consumer.parent != producer.ctx || !consumer.ended {
+		t.Fatalf("Consumer span should be a child of the producer: %+v", consumer)
+	}
+
+	if inHandler != consumer.ctx || inHandler.TraceID != producer.ctx.TraceID {
+		t.Fatalf("Handler should see the consumer span context: %+v", inHandler)
+	}
+}